@@ -0,0 +1,327 @@
+// mpt generates, checks and prints the witnesses of the MPT circuit.
+//
+// Usage:
+//
+//	mpt gen -block <number> (-mods <mods.json> | -diff <trace.json>) [state flags] [-format witness] [-o <witness.json>]
+//	mpt fetch -block <number> -mods <mods.json> [state flags] -o <bundle>
+//	mpt verify [-mods <mods.json>] <witness.json>...
+//	mpt inspect <witness.json>...
+//	mpt serve [-addr <host:port> | -addr <socket path>] [state flags] [-blocks <number>]
+//
+// gen generates the witness of the modifications in the file (JSON or YAML, see
+// witness.ParseModifications) applied on the state of the block, or of the
+// whole block from its state diffs (a debug_traceBlockByNumber dump with
+// prestateTracer in diff mode, see oracle.ParseStateDiffs) applied on the state
+// of the parent block. The state is read from the node (-node, the responses are
+// cached in -cache), the fixtures (-fixtures) or a preimage bundle (-bundle).
+//
+// fetch reads everything the generation of the witness needs from the node and
+// writes it into a bundle, gen -bundle then works offline.
+//
+// verify checks the witness constraints (see witness.Verify), with -mods also the
+// new values of the modifications. inspect prints the witness (a matrix as in
+// generated_witnesses or the versioned witness JSON) as a human-readable tree.
+//
+// serve answers the JSON-RPC requests mpt_generateWitness, mpt_verifyWitness and
+// mpt_getProof on HTTP (see server.Server), the preimages of the last -blocks
+// blocks are kept between the requests.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/server"
+	"github.com/miha-stopar/mpt/witness"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mpt gen -block <number> (-mods <mods.json> | -diff <trace.json>) [flags]\n")
+	fmt.Fprintf(os.Stderr, "       mpt fetch -block <number> -mods <mods.json> [flags] -o <bundle>\n")
+	fmt.Fprintf(os.Stderr, "       mpt verify [-mods <mods.json>] <witness.json>...\n")
+	fmt.Fprintf(os.Stderr, "       mpt inspect <witness.json>...\n")
+	fmt.Fprintf(os.Stderr, "       mpt serve [-addr <address>] [flags]\n")
+	fmt.Fprintf(os.Stderr, "run mpt <command> -h for the flags of the command\n")
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	commands := map[string]func([]string) error{
+		"gen":     gen,
+		"fetch":   fetch,
+		"verify":  verify,
+		"inspect": inspect,
+		"serve":   serve,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+	}
+	if err := command(flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "mpt:", err)
+		os.Exit(1)
+	}
+}
+
+// stateFlags select where the state is read from.
+type stateFlags struct {
+	node     *string
+	cache    *string
+	timeout  *time.Duration
+	fixtures *string
+	bundle   *string
+}
+
+func addStateFlags(fs *flag.FlagSet) *stateFlags {
+	return &stateFlags{
+		node:     fs.String("node", "", "URL of the node the state is read from (needed without -fixtures and -bundle)"),
+		cache:    fs.String("cache", oracle.DefaultCacheDir, "directory of the node response cache"),
+		timeout:  fs.Duration("timeout", oracle.DefaultRPCConfig.Timeout, "deadline of each node request"),
+		fixtures: fs.String("fixtures", "", "fixture directory the state is read from instead of the node"),
+		bundle:   fs.String("bundle", "", "preimage bundle the state is read from instead of the node"),
+	}
+}
+
+func (f *stateFlags) source() (oracle.NodeSource, error) {
+	switch {
+	case *f.bundle != "":
+		b, err := oracle.ReadBundleFile(*f.bundle)
+		if err != nil {
+			return nil, err
+		}
+		return b.Source(), nil
+	case *f.fixtures != "":
+		return oracle.NewFileSource(*f.fixtures), nil
+	case *f.node == "":
+		return nil, fmt.Errorf("one of -node, -fixtures and -bundle is needed")
+	}
+	config := oracle.DefaultRPCConfig
+	config.Timeout = *f.timeout
+	config.CacheDir = *f.cache
+	return oracle.NewRPCSourceWithConfig(*f.node, config), nil
+}
+
+func readModifications(name string) ([]witness.TrieModification, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	mods, err := witness.ParseModifications(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(mods) == 0 {
+		return nil, fmt.Errorf("%s: no modifications", name)
+	}
+	return mods, nil
+}
+
+// writeOutput writes data into the file, to the standard output if name is empty.
+func writeOutput(name string, data []byte) error {
+	if name == "" {
+		_, err := os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+func gen(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	block := fs.Int("block", 0, "number of the block (with -mods the modifications are applied on its state, with -diff on the state of its parent)")
+	modsFile := fs.String("mods", "", "file with the modifications (JSON or YAML)")
+	diff := fs.String("diff", "", "file with the state diffs of the block (prestateTracer in diff mode)")
+	state := addStateFlags(fs)
+	format := fs.String("format", "matrix", "output format: matrix or witness (the versioned witness JSON)")
+	out := fs.String("o", "", "output file (standard output if empty)")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *block <= 0 || (*modsFile == "") == (*diff == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, err := state.source()
+	if err != nil {
+		return err
+	}
+	var proof [][]byte
+	if *diff != "" {
+		proof, _, err = witness.GetBlockProofs(src, oracle.StateDiffFile(*diff), *block, nil)
+	} else {
+		var mods []witness.TrieModification
+		if mods, err = readModifications(*modsFile); err != nil {
+			return err
+		}
+		proof, err = witness.GetParallelProofsFromSource(src, *block, mods)
+	}
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch *format {
+	case "matrix":
+		data = []byte(witness.MatrixToJson(proof))
+	case "witness":
+		w, err := witness.WitnessFromMatrix(proof)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(w); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return writeOutput(*out, data)
+}
+
+func fetch(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	block := fs.Int("block", 0, "number of the block the modifications are applied on")
+	modsFile := fs.String("mods", "", "file with the modifications (JSON or YAML)")
+	state := addStateFlags(fs)
+	out := fs.String("o", "", "bundle file")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *block <= 0 || *modsFile == "" || *out == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	mods, err := readModifications(*modsFile)
+	if err != nil {
+		return err
+	}
+	src, err := state.source()
+	if err != nil {
+		return err
+	}
+	orc := oracle.NewOracle(src)
+	if _, err := witness.GetParallelProofsWithOracle(orc, *block, mods); err != nil {
+		return err
+	}
+	return orc.Bundle().WriteFile(*out)
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	modsFile := fs.String("mods", "", "file with the modifications of the witnesses, to check the new values")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	// Without the modifications the checks that need them are skipped.
+	var mods []witness.TrieModification
+	if *modsFile != "" {
+		var err error
+		if mods, err = readModifications(*modsFile); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, name := range fs.Args() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		w, err := witness.ParseWitness(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := w.Verify(mods); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: ok\n", name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d witnesses invalid", failed, fs.NArg())
+	}
+
+	return nil
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		usage()
+	}
+
+	for _, name := range fs.Args() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		w, err := witness.ParseWitness(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if fs.NArg() > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		if err := w.Print(os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8547", "address to listen on (host:port, or the path of a unix socket)")
+	state := addStateFlags(fs)
+	blocks := fs.Int("blocks", server.DefaultMaxBlocks, "number of blocks whose preimages are kept between the requests")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *blocks <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, err := state.source()
+	if err != nil {
+		return err
+	}
+	network := "tcp"
+	if strings.ContainsRune(*addr, '/') {
+		network = "unix"
+	}
+	listener, err := net.Listen(network, *addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "mpt: serving JSON-RPC on %s\n", listener.Addr())
+
+	httpServer := &http.Server{Handler: server.New(src, *blocks), ReadHeaderTimeout: 10 * time.Second}
+	// Closing the server removes the unix socket.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		httpServer.Close()
+	}()
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
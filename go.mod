@@ -7,4 +7,5 @@ require (
 	github.com/ethereum/go-ethereum v1.10.8 // indirect
 	github.com/holiman/uint256 v1.2.0 // indirect
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
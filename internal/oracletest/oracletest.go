@@ -0,0 +1,79 @@
+// Package oracletest provides the node sources shared by the tests of the
+// oracle, witness and server packages.
+package oracletest
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// CountingSource is a MemorySource that counts the eth_getProof calls per block
+// and the highest number of concurrent calls, for example to check that the
+// oracle doesn't fetch a proof twice. It is safe for concurrent use.
+type CountingSource struct {
+	*oracle.MemorySource
+	Delay time.Duration // added to each GetProof call, so that concurrent calls overlap
+
+	lock      sync.Mutex
+	calls     map[uint64]int
+	active    int
+	maxActive int
+}
+
+func NewCountingSource(src *oracle.MemorySource) *CountingSource {
+	return &CountingSource{MemorySource: src, calls: make(map[uint64]int)}
+}
+
+func (s *CountingSource) GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*oracle.AccountResult, error) {
+	s.lock.Lock()
+	s.calls[blockNumber.Uint64()]++
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.active--
+		s.lock.Unlock()
+	}()
+	time.Sleep(s.Delay)
+	return s.MemorySource.GetProof(blockNumber, addr, keys)
+}
+
+// Calls returns the number of GetProof calls for the block.
+func (s *CountingSource) Calls(blockNumber uint64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[blockNumber]
+}
+
+// TotalCalls returns the number of GetProof calls for all the blocks.
+func (s *CountingSource) TotalCalls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	total := 0
+	for _, n := range s.calls {
+		total += n
+	}
+	return total
+}
+
+// MaxActive returns the highest number of concurrent GetProof calls.
+func (s *CountingSource) MaxActive() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.maxActive
+}
+
+// Reset sets the counts to zero.
+func (s *CountingSource) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls = make(map[uint64]int)
+	s.maxActive = 0
+}
@@ -54,6 +54,8 @@ type Header struct {
 	MixDigest   *common.Hash      `json:"mixHash"`
 	Nonce       *types.BlockNonce `json:"nonce"`
 	BaseFee     *hexutil.Big      `json:"baseFeePerGas" rlp:"optional"`
+	// hashes of the uncle headers
+	Uncles []common.Hash `json:"uncles"`
 	// transactions
 	Transactions []SendTxArgs `json:"transactions"`
 }
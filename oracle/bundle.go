@@ -0,0 +1,181 @@
+package oracle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// bundleVersion is the version of the bundle encoding.
+const bundleVersion = 1
+
+// Bundle is all the data a witness generation obtained from its NodeSource: the
+// block headers, the state roots of the blocks that were only used for proofs (for
+// example the next block in case of deletions) and the preimages (trie nodes,
+// code, header RLPs). A bundle loaded as a MemorySource (see Source) serves the
+// same generation again without the original source.
+type Bundle struct {
+	Headers   []*Header
+	Roots     map[uint64]common.Hash
+	Preimages [][]byte
+}
+
+// bundleRoot is the state root of a block without a header in the bundle.
+type bundleRoot struct {
+	Number uint64
+	Root   common.Hash
+}
+
+// encodedBundle is the RLP layout of a bundle. The headers are kept in their
+// JSON-RPC form (as eth_getBlockByNumber returns them), the preimages are sorted
+// by hash and stored without the hash.
+type encodedBundle struct {
+	Version   uint
+	Headers   [][]byte
+	Roots     []bundleRoot
+	Preimages [][]byte
+}
+
+// Bundle returns the data the oracle obtained so far.
+func (o *Oracle) Bundle() *Bundle {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	b := &Bundle{Roots: make(map[uint64]common.Hash)}
+	for _, header := range o.headers {
+		b.Headers = append(b.Headers, header)
+	}
+	for number, root := range o.roots {
+		if _, ok := o.headers[number]; !ok {
+			b.Roots[number] = root
+		}
+	}
+	for _, val := range o.preimages {
+		b.Preimages = append(b.Preimages, val)
+	}
+	return b
+}
+
+// Source returns a MemorySource holding the bundle.
+func (b *Bundle) Source() *MemorySource {
+	src := NewMemorySource()
+	for _, header := range b.Headers {
+		src.AddHeader(header)
+	}
+	for number, root := range b.Roots {
+		root := root
+		src.AddHeader(&Header{Number: (*hexutil.Big)(new(big.Int).SetUint64(number)), Root: &root})
+	}
+	for _, val := range b.Preimages {
+		src.AddPreimage(val)
+	}
+	return src
+}
+
+// Write writes the RLP encoded bundle. The encoding doesn't depend on the order of
+// the headers and preimages, the same data always gives the same bytes.
+func (b *Bundle) Write(w io.Writer) error {
+	enc := encodedBundle{Version: bundleVersion}
+
+	headers := append([]*Header{}, b.Headers...)
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Number.ToInt().Cmp(headers[j].Number.ToInt()) < 0
+	})
+	for _, header := range headers {
+		dat, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		enc.Headers = append(enc.Headers, dat)
+	}
+
+	for number, root := range b.Roots {
+		enc.Roots = append(enc.Roots, bundleRoot{number, root})
+	}
+	sort.Slice(enc.Roots, func(i, j int) bool {
+		return enc.Roots[i].Number < enc.Roots[j].Number
+	})
+
+	preimages := make(map[common.Hash][]byte, len(b.Preimages))
+	hashes := make([]common.Hash, 0, len(b.Preimages))
+	for _, val := range b.Preimages {
+		hash := crypto.Keccak256Hash(val)
+		if _, ok := preimages[hash]; !ok {
+			preimages[hash] = val
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	for _, hash := range hashes {
+		enc.Preimages = append(enc.Preimages, preimages[hash])
+	}
+
+	return rlp.Encode(w, &enc)
+}
+
+// ReadBundle decodes a bundle written by Bundle.Write.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	var enc encodedBundle
+	if err := rlp.Decode(r, &enc); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if enc.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", enc.Version)
+	}
+
+	b := &Bundle{Roots: make(map[uint64]common.Hash), Preimages: enc.Preimages}
+	for _, dat := range enc.Headers {
+		header := new(Header)
+		if err := json.Unmarshal(dat, header); err != nil {
+			return nil, fmt.Errorf("invalid bundle header: %w", err)
+		}
+		if header.Number == nil || header.Root == nil {
+			return nil, fmt.Errorf("invalid bundle header: missing number or state root")
+		}
+		b.Headers = append(b.Headers, header)
+	}
+	for _, r := range enc.Roots {
+		b.Roots[r.Number] = r.Root
+	}
+	return b, nil
+}
+
+// WriteFile writes the bundle into the file name.
+func (b *Bundle) WriteFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := b.Write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadBundleFile reads the bundle from the file name.
+func ReadBundleFile(name string) (*Bundle, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBundle(bufio.NewReader(f))
+}
@@ -0,0 +1,215 @@
+package oracle
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DefaultCacheDir is the directory of the RPC response cache of the mpt command.
+// RPCSource doesn't cache the responses unless RPCConfig.CacheDir is set.
+var DefaultCacheDir = filepath.Join(os.TempDir(), "eth")
+
+// DefaultCacheMaxBytes is the size limit of the RPC response cache used by NewRPCSource
+// (if RPCConfig.CacheDir is set).
+const DefaultCacheMaxBytes = 1 << 30
+
+// Cache stores the responses of the node on disk. An entry is addressed by the
+// keccak hash of the request and named json_<from>_<to>_<hash>, where from and to
+// are the lowest and the highest block of the request, so the entries of a block
+// range can be pruned. Each entry starts with the keccak hash of the response,
+// entries that don't match it are dropped. Entries are written atomically and the
+// least recently used ones are evicted when the size of the cache exceeds MaxBytes.
+// The directory is created on the first write.
+type Cache struct {
+	Dir      string
+	MaxBytes int64 // 0 means no limit
+
+	lock sync.Mutex
+	size int64 // -1 until the directory is scanned
+}
+
+func NewCache(dir string, maxBytes int64) *Cache {
+	return &Cache{Dir: dir, MaxBytes: maxBytes, size: -1}
+}
+
+func cacheFilename(request []byte, from, to uint64) string {
+	return fmt.Sprintf("json_%d_%d_%s", from, to, hexutil.Encode(crypto.Keccak256(request)))
+}
+
+// parseCacheFilename returns the block range of the entry.
+func parseCacheFilename(name string) (uint64, uint64, bool) {
+	var from, to uint64
+	var hash string
+	if n, err := fmt.Sscanf(strings.Replace(name, "_", " ", -1), "json %d %d %s", &from, &to, &hash); n != 3 || err != nil {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// Get returns the cached response to the request of the blocks from..to.
+func (c *Cache) Get(request []byte, from, to uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	name := filepath.Join(c.Dir, cacheFilename(request, from, to))
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+	if len(dat) < 32 || !bytes.Equal(dat[:32], crypto.Keccak256(dat[32:])) {
+		c.Remove(request, from, to)
+		return nil, false
+	}
+	// The modification time orders the entries for the eviction.
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return dat[32:], true
+}
+
+// Put stores the response to the request of the blocks from..to.
+func (c *Cache) Put(request []byte, from, to uint64, response []byte) error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	if err := c.scan(); err != nil {
+		return err
+	}
+	name := filepath.Join(c.Dir, cacheFilename(request, from, to))
+	if info, err := os.Stat(name); err == nil {
+		c.size -= info.Size()
+	}
+
+	tmp, err := ioutil.TempFile(c.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	dat := append(crypto.Keccak256(response), response...)
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.size += int64(len(dat))
+
+	return c.evict()
+}
+
+// Remove drops the cached response to the request of the blocks from..to.
+func (c *Cache) Remove(request []byte, from, to uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name := filepath.Join(c.Dir, cacheFilename(request, from, to))
+	if info, err := os.Stat(name); err == nil && os.Remove(name) == nil && c.size >= 0 {
+		c.size -= info.Size()
+	}
+}
+
+// Prune removes the entries of the requests touching any block in from..to and
+// returns their number.
+func (c *Cache) Prune(from, to uint64) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, e := range entries {
+		eFrom, eTo, _ := parseCacheFilename(e.Name())
+		if eTo < from || eFrom > to {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.Dir, e.Name())); err != nil {
+			return pruned, err
+		}
+		pruned++
+		if c.size >= 0 {
+			c.size -= e.Size()
+		}
+	}
+	return pruned, nil
+}
+
+// entries returns the cache entries (and skips the other files of the directory).
+func (c *Cache) entries() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []os.FileInfo
+	for _, info := range infos {
+		if _, _, ok := parseCacheFilename(info.Name()); ok && info.Mode().IsRegular() {
+			entries = append(entries, info)
+		}
+	}
+	return entries, nil
+}
+
+// scan computes the size of the cache if it isn't known yet.
+func (c *Cache) scan() error {
+	if c.size >= 0 {
+		return nil
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	c.size = 0
+	for _, e := range entries {
+		c.size += e.Size()
+	}
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits into MaxBytes.
+func (c *Cache) evict() error {
+	if c.MaxBytes <= 0 || c.size <= c.MaxBytes {
+		return nil
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for _, e := range entries {
+		if c.size <= c.MaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.Dir, e.Name())); err != nil {
+			return err
+		}
+		c.size -= e.Size()
+	}
+	return nil
+}
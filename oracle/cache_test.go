@@ -0,0 +1,168 @@
+package oracle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	c := NewCache(dir, 0)
+	req := []byte(`{"method":"eth_getCode"}`)
+	if _, ok := c.Get(req, 1, 1); ok {
+		t.Fatal("empty cache returned an entry")
+	}
+	if err := c.Put(req, 1, 1, []byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := c.Get(req, 1, 1); !ok || string(resp) != "response" {
+		t.Fatalf("got %q", resp)
+	}
+
+	// A corrupted entry is dropped.
+	name := filepath.Join(dir, cacheFilename(req, 1, 1))
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat[len(dat)-1] ^= 1
+	if err := ioutil.WriteFile(name, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(req, 1, 1); ok {
+		t.Error("corrupted entry returned")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("corrupted entry not removed")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	response := make([]byte, 100)
+	// Each entry takes 132 bytes, the cache holds three of them.
+	c := NewCache(dir, 400)
+	for i := 0; i < 3; i++ {
+		req := []byte(fmt.Sprintf("request %d", i))
+		if err := c.Put(req, 1, 1, response); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(filepath.Join(dir, cacheFilename(req, 1, 1)), at, at)
+	}
+	// Request 0 was used last.
+	if _, ok := c.Get([]byte("request 0"), 1, 1); !ok {
+		t.Fatal("missing entry")
+	}
+	if err := c.Put([]byte("request 3"), 1, 1, response); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := c.Get([]byte(fmt.Sprintf("request %d", i)), 1, 1); ok != want {
+			t.Errorf("request %d: cached %t, expected %t", i, ok, want)
+		}
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	c := NewCache(t.TempDir(), 0)
+	ranges := [][2]uint64{{1, 1}, {5, 5}, {9, 10}, {10, 12}, {20, 20}}
+	for i, r := range ranges {
+		if err := c.Put([]byte(fmt.Sprintf("request %d", i)), r[0], r[1], []byte("response")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruned, err := c.Prune(5, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Errorf("pruned %d entries, expected 2", pruned)
+	}
+	for i, want := range []bool{true, false, false, true, true} {
+		if _, ok := c.Get([]byte(fmt.Sprintf("request %d", i)), ranges[i][0], ranges[i][1]); ok != want {
+			t.Errorf("request %d: cached %t, expected %t", i, ok, want)
+		}
+	}
+}
+
+func TestRPCCache(t *testing.T) {
+	leaf := []byte{0xc2, 0x20, 0x01}
+	root := append([]byte{0xe1, 0xa0}, crypto.Keccak256(leaf)...)
+	proof := func(nodes ...[]byte) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":{"accountProof":["%s","%s"],"storageProof":[]}}`,
+			hexutil.Encode(nodes[0]), hexutil.Encode(nodes[1]))
+	}
+	server := &testServer{responses: []func(w http.ResponseWriter){
+		body(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node"}}`),
+		body(proof(root, leaf)),
+		body(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"missing trie node"}}`),
+	}}
+	src := testSource(t, server, RPCConfig{CacheDir: t.TempDir()})
+
+	get := func() (*AccountResult, error) {
+		return src.GetProof(big.NewInt(7), common.Address{}, nil)
+	}
+	// Error responses are not cached.
+	if _, err := get(); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 2 {
+		t.Errorf("%d requests, expected 2", server.requests)
+	}
+
+	// A cached proof with a node that doesn't hash correctly is dropped.
+	server.requests = 0
+	server.responses = []func(w http.ResponseWriter){body(proof(root, leaf))}
+	entries := mustReadDir(t, src.Cache().Dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected one cached response, got %v", entries)
+	}
+	corrupt := []byte(proof(root, []byte{0xc2, 0x20, 0x02}))
+	name := filepath.Join(src.Cache().Dir, entries[0])
+	if err := ioutil.WriteFile(name, append(crypto.Keccak256(corrupt), corrupt...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AccountProof[1] != hexutil.Encode(leaf) {
+		t.Errorf("corrupted proof returned")
+	}
+	if server.requests != 1 {
+		t.Errorf("%d requests, expected 1", server.requests)
+	}
+
+	if pruned, err := src.Cache().Prune(7, 7); err != nil || pruned != 1 {
+		t.Errorf("pruned %d entries (%v), expected 1", pruned, err)
+	}
+}
+
+func mustReadDir(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
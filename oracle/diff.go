@@ -0,0 +1,217 @@
+package oracle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// DiffAccount is an account in a StateDiff. Fields that are not part of the diff
+// are nil (storage slots are missing).
+type DiffAccount struct {
+	Balance *hexutil.Big                `json:"balance,omitempty"`
+	Nonce   *uint64                     `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// StateDiff is the state change of a transaction as reported by geth prestateTracer
+// in diff mode: Pre holds the modified accounts before the transaction, Post only the
+// fields that changed. An account missing in Post was deleted, a storage slot missing
+// in Post (but present in Pre) was cleared. An account missing in Pre was created.
+type StateDiff struct {
+	Pre  map[common.Address]*DiffAccount `json:"pre"`
+	Post map[common.Address]*DiffAccount `json:"post"`
+}
+
+// DiffSource provides the state changes of a block.
+type DiffSource interface {
+	// BlockStateDiffs returns the state diffs of the block transactions in order.
+	BlockStateDiffs(blockNumber *big.Int) ([]*StateDiff, error)
+}
+
+// UnmarshalJSON accepts the nonce as a number (geth) or as a hex string.
+func (a *DiffAccount) UnmarshalJSON(input []byte) error {
+	type diffAccount DiffAccount
+	var dec struct {
+		diffAccount
+		Nonce json.RawMessage `json:"nonce,omitempty"`
+	}
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	*a = DiffAccount(dec.diffAccount)
+	if len(dec.Nonce) == 0 || string(dec.Nonce) == "null" {
+		return nil
+	}
+	var nonce uint64
+	if err := json.Unmarshal(dec.Nonce, &nonce); err != nil {
+		var hexNonce hexutil.Uint64
+		if err := json.Unmarshal(dec.Nonce, &hexNonce); err != nil {
+			return fmt.Errorf("invalid nonce %s", dec.Nonce)
+		}
+		nonce = uint64(hexNonce)
+	}
+	a.Nonce = &nonce
+	return nil
+}
+
+// exists tells whether the account exists (geth reports the accounts that didn't
+// exist before the transaction in Pre as empty accounts).
+func (a *DiffAccount) exists() bool {
+	return (a.Balance != nil && a.Balance.ToInt().Sign() != 0) || (a.Nonce != nil && *a.Nonce != 0) ||
+		len(a.Code) > 0 || len(a.Storage) > 0
+}
+
+// normalize removes the accounts that didn't exist from Pre, so that the account
+// is created by the transaction.
+func (d *StateDiff) normalize() {
+	for addr, pre := range d.Pre {
+		if pre == nil || !pre.exists() {
+			delete(d.Pre, addr)
+		}
+	}
+}
+
+// txStateDiff is an element of the debug_traceBlockByNumber result. The result is
+// missing (and Error set) if the tracer failed for the transaction.
+type txStateDiff struct {
+	TxHash common.Hash `json:"txHash"`
+	Result *StateDiff  `json:"result"`
+	Error  string      `json:"error"`
+
+	// The element is a diff itself (a list of debug_traceTransaction results).
+	Pre  map[common.Address]*DiffAccount `json:"pre"`
+	Post map[common.Address]*DiffAccount `json:"post"`
+}
+
+func toStateDiffs(txs []txStateDiff) ([]*StateDiff, error) {
+	diffs := make([]*StateDiff, len(txs))
+	for i, tx := range txs {
+		switch {
+		case tx.Error != "":
+			return nil, fmt.Errorf("transaction %d (%s): %s", i, tx.TxHash.Hex(), tx.Error)
+		case tx.Result != nil:
+			diffs[i] = tx.Result
+		case tx.Pre != nil || tx.Post != nil:
+			diffs[i] = &StateDiff{Pre: tx.Pre, Post: tx.Post}
+		default:
+			return nil, fmt.Errorf("transaction %d (%s): no state diff", i, tx.TxHash.Hex())
+		}
+		if diffs[i].Pre == nil {
+			diffs[i].Pre = make(map[common.Address]*DiffAccount)
+		}
+		if diffs[i].Post == nil {
+			diffs[i].Post = make(map[common.Address]*DiffAccount)
+		}
+		diffs[i].normalize()
+	}
+	return diffs, nil
+}
+
+// ParseStateDiffs parses the state diffs of prestateTracer in diff mode: the
+// debug_traceBlockByNumber (or debug_traceBlockByHash) result with the diff of each
+// transaction, a list of diffs, or the diff of one transaction
+// (debug_traceTransaction). Each of them can be the whole JSON-RPC response too.
+func ParseStateDiffs(data []byte) ([]*StateDiff, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("no state diffs")
+	}
+	if data[0] == '[' {
+		var txs []txStateDiff
+		if err := json.Unmarshal(data, &txs); err != nil {
+			return nil, err
+		}
+		return toStateDiffs(txs)
+	}
+
+	var obj struct {
+		Result json.RawMessage                 `json:"result"`
+		Error  *RPCError                       `json:"error"`
+		Pre    map[common.Address]*DiffAccount `json:"pre"`
+		Post   map[common.Address]*DiffAccount `json:"post"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	switch {
+	case obj.Error != nil:
+		return nil, obj.Error
+	case obj.Result != nil:
+		return ParseStateDiffs(obj.Result)
+	case obj.Pre != nil || obj.Post != nil:
+		return toStateDiffs([]txStateDiff{{Pre: obj.Pre, Post: obj.Post}})
+	}
+	return nil, errors.New("no state diffs (prestateTracer output not in diff mode?)")
+}
+
+// ReadStateDiffFile reads the state diffs from the file (see ParseStateDiffs).
+func ReadStateDiffFile(name string) ([]*StateDiff, error) {
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := ParseStateDiffs(dat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return diffs, nil
+}
+
+// StateDiffFile is a DiffSource reading the state diffs from the file (see
+// ReadStateDiffFile) whatever the block, for a dump of one block.
+type StateDiffFile string
+
+func (name StateDiffFile) BlockStateDiffs(blockNumber *big.Int) ([]*StateDiff, error) {
+	return ReadStateDiffFile(string(name))
+}
+
+// BlockStateDiffs uses debug_traceBlockByNumber with prestateTracer in diff mode.
+func (s *RPCSource) BlockStateDiffs(blockNumber *big.Int) ([]*StateDiff, error) {
+	r := jsonreq{Jsonrpc: "2.0", Method: "debug_traceBlockByNumber", Id: 1}
+	r.Params = make([]interface{}, 2)
+	r.Params[0] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	r.Params[1] = map[string]interface{}{
+		"tracer":       "prestateTracer",
+		"tracerConfig": map[string]interface{}{"diffMode": true},
+	}
+	var txs []txStateDiff
+	if err := s.call(r, &txs); err != nil {
+		return nil, err
+	}
+	return toStateDiffs(txs)
+}
+
+// AddStateDiffs stores the transaction state diffs of the block.
+func (s *MemorySource) AddStateDiffs(blockNumber uint64, diffs []*StateDiff) {
+	s.diffs[blockNumber] = diffs
+}
+
+func (s *MemorySource) BlockStateDiffs(blockNumber *big.Int) ([]*StateDiff, error) {
+	diffs, ok := s.diffs[blockNumber.Uint64()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return diffs, nil
+}
+
+// BlockStateDiffs reads diff_<number>.json holding the debug_traceBlockByNumber result
+// (prestateTracer in diff mode, any format of ParseStateDiffs).
+func (s *FileSource) BlockStateDiffs(blockNumber *big.Int) ([]*StateDiff, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(s.Dir, fmt.Sprintf("diff_%d.json", blockNumber)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseStateDiffs(dat)
+}
@@ -0,0 +1,70 @@
+package oracle
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const testDiff = `{
+	"pre": {
+		"0x00000000000000000000000000000000000000aa": {"balance": "0x10", "nonce": 1, "code": "0x6000"},
+		"0x00000000000000000000000000000000000000bb": {"balance": "0x0"}
+	},
+	"post": {
+		"0x00000000000000000000000000000000000000bb": {"balance": "0x5", "nonce": "0x2"}
+	}
+}`
+
+func TestParseStateDiffs(t *testing.T) {
+	aa := common.HexToAddress("0xaa")
+	bb := common.HexToAddress("0xbb")
+	for _, data := range []string{
+		testDiff,
+		`{"jsonrpc": "2.0", "id": 1, "result": ` + testDiff + `}`,
+		`[` + testDiff + `]`,
+		`[{"txHash": "0x0000000000000000000000000000000000000000000000000000000000000001", "result": ` + testDiff + `}]`,
+		`{"jsonrpc": "2.0", "id": 1, "result": [{"result": ` + testDiff + `}]}`,
+	} {
+		diffs, err := ParseStateDiffs([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if len(diffs) != 1 {
+			t.Fatalf("%s: expected one diff, got %d", data, len(diffs))
+		}
+		diff := diffs[0]
+		// aa is deleted (self-destruct), bb didn't exist before the transaction.
+		if _, ok := diff.Pre[aa]; !ok {
+			t.Errorf("%s: deleted account missing in pre", data)
+		}
+		if _, ok := diff.Pre[bb]; ok {
+			t.Errorf("%s: created account in pre", data)
+		}
+		if post := diff.Post[bb]; post == nil || post.Nonce == nil || *post.Nonce != 2 || post.Balance.ToInt().Int64() != 5 {
+			t.Errorf("%s: wrong post state %+v", data, post)
+		}
+	}
+}
+
+func TestParseStateDiffsErrors(t *testing.T) {
+	for _, data := range []string{
+		``,
+		`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32000, "message": "tracing failed"}}`,
+		`[{"txHash": "0x0000000000000000000000000000000000000000000000000000000000000001", "error": "execution timeout"}]`,
+		// prestateTracer without diff mode
+		`{"0x00000000000000000000000000000000000000aa": {"balance": "0x10"}}`,
+		`{"pre": {"0x00000000000000000000000000000000000000aa": {"nonce": "one"}}, "post": {}}`,
+	} {
+		if _, err := ParseStateDiffs([]byte(data)); err == nil {
+			t.Errorf("no error for %s", data)
+		}
+	}
+
+	var rpcErr *RPCError
+	_, err := ParseStateDiffs([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32000, "message": "tracing failed"}}`))
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32000 {
+		t.Errorf("expected the RPC error, got %v", err)
+	}
+}
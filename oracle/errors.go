@@ -0,0 +1,61 @@
+package oracle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MissingPreimageError is returned when neither the preimage store nor the node
+// source can provide the value of a hash (trie node, code or header).
+type MissingPreimageError struct {
+	Hash common.Hash
+}
+
+func (err *MissingPreimageError) Error() string {
+	return fmt.Sprintf("missing preimage %s", err.Hash)
+}
+
+// CorruptPreimageError is returned when a value doesn't hash to the key it is
+// stored (or requested) under.
+type CorruptPreimageError struct {
+	Hash common.Hash
+}
+
+func (err *CorruptPreimageError) Error() string {
+	return fmt.Sprintf("corruption in hash %s", err.Hash)
+}
+
+// SourceError is returned when a NodeSource request fails (for RPCSource this is
+// a failed JSON-RPC call).
+type SourceError struct {
+	Method string
+	Err    error
+}
+
+func (err *SourceError) Error() string {
+	return fmt.Sprintf("%s failed: %v", err.Method, err.Err)
+}
+
+func (err *SourceError) Unwrap() error {
+	return err.Err
+}
+
+// RPCError is a JSON-RPC error object returned by the node.
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (err *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", err.Code, err.Message)
+}
+
+// Is reports the errors about a missing block (for example the next block, used
+// for absence proofs, is not available yet) as ErrNotFound.
+func (err *RPCError) Is(target error) bool {
+	return target == ErrNotFound && (strings.Contains(err.Message, "not found") || strings.Contains(err.Message, "unknown block"))
+}
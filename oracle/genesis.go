@@ -0,0 +1,147 @@
+package oracle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// GenesisAccount is an account of a GenesisAlloc. The JSON format is the one of
+// the accounts in the alloc of a geth genesis.json.
+type GenesisAccount struct {
+	Nonce   math.HexOrDecimal64         `json:"nonce,omitempty"`
+	Balance *math.HexOrDecimal256       `json:"balance,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// GenesisAlloc is a state given by its accounts. It is used to build a local
+// state (see Source), for example for tests that don't need a node.
+type GenesisAlloc map[common.Address]GenesisAccount
+
+// ReadGenesisAlloc reads the alloc from the JSON file name, which is either a
+// genesis.json or only its alloc.
+func ReadGenesisAlloc(name string) (GenesisAlloc, error) {
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var genesis struct {
+		Alloc GenesisAlloc `json:"alloc"`
+	}
+	if err := json.Unmarshal(dat, &genesis); err == nil && genesis.Alloc != nil {
+		return genesis.Alloc, nil
+	}
+	var alloc GenesisAlloc
+	if err := json.Unmarshal(dat, &alloc); err != nil {
+		return nil, fmt.Errorf("invalid genesis alloc %s: %w", name, err)
+	}
+	return alloc, nil
+}
+
+// Source builds the state tries of the alloc and returns a MemorySource holding
+// their nodes, the code of the accounts and the header of block blockNumber
+// with the state root. An empty (or nil) alloc gives the empty state.
+func (alloc GenesisAlloc) Source(blockNumber uint64) (*MemorySource, error) {
+	src := NewMemorySource()
+	if err := alloc.AddToSource(src, blockNumber); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// AddToSource adds the state of the alloc as the state of block blockNumber to
+// src (see Source), for example to have the states of two blocks in one source.
+func (alloc GenesisAlloc) AddToSource(src *MemorySource, blockNumber uint64) error {
+	diskdb := memorydb.New()
+	triedb := trie.NewDatabase(diskdb)
+	accountTrie, err := trie.NewSecure(common.Hash{}, triedb)
+	if err != nil {
+		return err
+	}
+
+	for addr, account := range alloc {
+		storageTrie, err := trie.NewSecure(common.Hash{}, triedb)
+		if err != nil {
+			return err
+		}
+		for key, value := range account.Storage {
+			if value == (common.Hash{}) {
+				continue
+			}
+			enc, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
+			if err := storageTrie.TryUpdate(key[:], enc); err != nil {
+				return err
+			}
+		}
+		storageRoot, err := storageTrie.Commit(nil)
+		if err != nil {
+			return err
+		}
+		if err := triedb.Commit(storageRoot, false, nil); err != nil {
+			return err
+		}
+
+		balance := new(big.Int)
+		if account.Balance != nil {
+			balance = (*big.Int)(account.Balance)
+		}
+		codeHash := crypto.Keccak256(account.Code)
+		if len(account.Code) > 0 {
+			src.AddPreimage(account.Code)
+		}
+		enc, err := rlp.EncodeToBytes(&Account{
+			Nonce:    uint64(account.Nonce),
+			Balance:  balance,
+			Root:     storageRoot,
+			CodeHash: codeHash,
+		})
+		if err != nil {
+			return err
+		}
+		if err := accountTrie.TryUpdate(addr[:], enc); err != nil {
+			return err
+		}
+	}
+	root, err := accountTrie.Commit(nil)
+	if err != nil {
+		return err
+	}
+	if err := triedb.Commit(root, false, nil); err != nil {
+		return err
+	}
+
+	it := diskdb.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		src.AddPreimage(it.Value())
+	}
+	src.AddHeader(NewHeader(blockNumber, root))
+
+	return nil
+}
+
+// NewHeader returns the header of block number with the state root and all
+// the other fields eth_getBlockByNumber returns set to zero values.
+func NewHeader(number uint64, root common.Hash) *Header {
+	var h common.Hash
+	var coinbase common.Address
+	var bloom types.Bloom
+	var gas hexutil.Uint64
+	var extra hexutil.Bytes
+	return &Header{
+		ParentHash: &h, UncleHash: &h, Coinbase: &coinbase, Root: &root, TxHash: &h, ReceiptHash: &h,
+		Bloom: &bloom, Difficulty: (*hexutil.Big)(new(big.Int)), Number: (*hexutil.Big)(new(big.Int).SetUint64(number)),
+		GasLimit: &gas, GasUsed: &gas, Time: &gas, Extra: &extra,
+	}
+}
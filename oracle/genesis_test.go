@@ -0,0 +1,70 @@
+package oracle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestGenesisAlloc(t *testing.T) {
+	addr := common.HexToAddress("0xc0de")
+	key := common.HexToHash("0x1")
+	alloc := `{
+		"0x000000000000000000000000000000000000c0de": {
+			"balance": "1000", "nonce": "0x2", "code": "0x6000",
+			"storage": {"0x0000000000000000000000000000000000000000000000000000000000000001": "0x00000000000000000000000000000000000000000000000000000000000000ff"}
+		},
+		"0x0000000000000000000000000000000000000001": {"balance": "0x10"}
+	}`
+	dir := t.TempDir()
+	for _, name := range []string{"alloc.json", "genesis.json"} {
+		content := alloc
+		if name == "genesis.json" {
+			content = `{"config": {}, "alloc": ` + alloc + `}`
+		}
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, err := ReadGenesisAlloc(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := a.Source(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := src.GetProof(big.NewInt(5), addr, []common.Hash{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Balance.ToInt().Int64() != 1000 || result.Nonce != 2 {
+			t.Errorf("%s: unexpected account %v %v", name, result.Balance, result.Nonce)
+		}
+		if result.StorageProof[0].Value.ToInt().Int64() != 0xff {
+			t.Errorf("%s: unexpected storage value %v", name, result.StorageProof[0].Value)
+		}
+		code, err := src.GetCode(big.NewInt(5), addr)
+		if err != nil || !bytes.Equal(code, []byte{0x60, 0x00}) {
+			t.Errorf("%s: unexpected code %x (%v)", name, code, err)
+		}
+	}
+
+	src, err := GenesisAlloc{}.Source(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := src.GetBlockByNumber(big.NewInt(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *header.Root != types.EmptyRootHash {
+		t.Errorf("empty alloc has root %s", header.Root)
+	}
+}
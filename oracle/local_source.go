@@ -0,0 +1,336 @@
+package oracle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	emptyCodeHash = crypto.Keccak256Hash(nil)
+)
+
+// MemorySource is a NodeSource that keeps headers and preimages in memory.
+// Proofs and code are obtained by walking the tries stored in the preimages.
+type MemorySource struct {
+	headers   map[uint64]*Header
+	preimages map[common.Hash][]byte
+	diffs     map[uint64][]*StateDiff
+	uncles    map[uint64][]*Header
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		headers:   make(map[uint64]*Header),
+		preimages: make(map[common.Hash][]byte),
+		diffs:     make(map[uint64][]*StateDiff),
+		uncles:    make(map[uint64][]*Header),
+	}
+}
+
+// AddHeader stores the header under its block number.
+func (s *MemorySource) AddHeader(header *Header) {
+	s.headers[(*big.Int)(header.Number).Uint64()] = header
+}
+
+// AddUncle appends the uncle header to the uncles of the block.
+func (s *MemorySource) AddUncle(blockNumber uint64, uncle *Header) {
+	s.uncles[blockNumber] = append(s.uncles[blockNumber], uncle)
+}
+
+// AddPreimage stores value under its keccak hash and returns the hash.
+func (s *MemorySource) AddPreimage(value []byte) common.Hash {
+	hash := crypto.Keccak256Hash(value)
+	s.preimages[hash] = common.CopyBytes(value)
+	return hash
+}
+
+func (s *MemorySource) GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	return proveFromPreimages(s, blockNumber, addr, keys)
+}
+
+func (s *MemorySource) GetCode(blockNumber *big.Int, addr common.Address) ([]byte, error) {
+	return codeFromPreimages(s, blockNumber, addr)
+}
+
+func (s *MemorySource) GetBlockByNumber(blockNumber *big.Int) (*Header, error) {
+	header, ok := s.headers[blockNumber.Uint64()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return header, nil
+}
+
+func (s *MemorySource) GetUncleByBlockNumberAndIndex(blockNumber *big.Int, index int) (*Header, error) {
+	uncles := s.uncles[blockNumber.Uint64()]
+	if index < 0 || index >= len(uncles) {
+		return nil, ErrNotFound
+	}
+	return uncles[index], nil
+}
+
+func (s *MemorySource) Preimage(hash common.Hash) ([]byte, error) {
+	val, ok := s.preimages[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return val, nil
+}
+
+// FileSource is a NodeSource backed by a fixture directory. Each preimage is
+// stored in its own file named by the hash, each header in block_<number>.json holding the
+// eth_getBlockByNumber result, the uncles of a block in uncle_<number>_<index>.json and
+// the state diffs of a block in diff_<number>.json.
+type FileSource struct {
+	Dir string
+}
+
+func NewFileSource(dir string) *FileSource {
+	return &FileSource{Dir: dir}
+}
+
+func (s *FileSource) GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	return proveFromPreimages(s, blockNumber, addr, keys)
+}
+
+func (s *FileSource) GetCode(blockNumber *big.Int, addr common.Address) ([]byte, error) {
+	return codeFromPreimages(s, blockNumber, addr)
+}
+
+func (s *FileSource) GetBlockByNumber(blockNumber *big.Int) (*Header, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(s.Dir, fmt.Sprintf("block_%d.json", blockNumber)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	header := new(Header)
+	if err := json.Unmarshal(dat, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// GetUncleByBlockNumberAndIndex reads uncle_<number>_<index>.json.
+func (s *FileSource) GetUncleByBlockNumberAndIndex(blockNumber *big.Int, index int) (*Header, error) {
+	dat, err := ioutil.ReadFile(filepath.Join(s.Dir, fmt.Sprintf("uncle_%d_%d.json", blockNumber, index)))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	header := new(Header)
+	if err := json.Unmarshal(dat, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func (s *FileSource) Preimage(hash common.Hash) ([]byte, error) {
+	val, err := ioutil.ReadFile(filepath.Join(s.Dir, hash.String()))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if crypto.Keccak256Hash(val) != hash {
+		return nil, fmt.Errorf("fixture %s doesn't hash to its name", hash)
+	}
+	return val, nil
+}
+
+// proveFromPreimages builds eth_getProof output by walking the state trie of
+// the given block (and the storage trie of addr) using src.Preimage.
+func proveFromPreimages(src NodeSource, blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	header, err := src.GetBlockByNumber(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return proveFromRoot(src, *header.Root, addr, keys)
+}
+
+// preimageSource provides the trie nodes, a NodeSource or an Oracle.
+type preimageSource interface {
+	Preimage(hash common.Hash) ([]byte, error)
+}
+
+// proveFromRoot builds eth_getProof output by walking the state trie with the
+// given root (and the storage trie of addr) using src.Preimage.
+func proveFromRoot(src preimageSource, root common.Hash, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	accountProof, enc, err := walkTrie(src, root, crypto.Keccak256(addr[:]))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AccountResult{
+		Address:      addr,
+		AccountProof: accountProof,
+		Balance:      (*hexutil.Big)(new(big.Int)),
+		CodeHash:     emptyCodeHash,
+		StorageHash:  types.EmptyRootHash,
+	}
+	if enc != nil {
+		var account Account
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return nil, err
+		}
+		result.Nonce = hexutil.Uint64(account.Nonce)
+		result.Balance = (*hexutil.Big)(account.Balance)
+		result.StorageHash = account.Root
+		result.CodeHash = common.BytesToHash(account.CodeHash)
+	}
+
+	for _, key := range keys {
+		storageResult := StorageResult{
+			Key:   key.Hex(),
+			Value: (*hexutil.Big)(new(big.Int)),
+			Proof: []string{},
+		}
+		storageProof, enc, err := walkTrie(src, result.StorageHash, crypto.Keccak256(key[:]))
+		if err != nil {
+			return nil, err
+		}
+		if storageProof != nil {
+			storageResult.Proof = storageProof
+		}
+		if enc != nil {
+			_, content, _, err := rlp.Split(enc)
+			if err != nil {
+				return nil, err
+			}
+			storageResult.Value = (*hexutil.Big)(new(big.Int).SetBytes(content))
+		}
+		result.StorageProof = append(result.StorageProof, storageResult)
+	}
+
+	return result, nil
+}
+
+func codeFromPreimages(src NodeSource, blockNumber *big.Int, addr common.Address) ([]byte, error) {
+	account, err := proveFromPreimages(src, blockNumber, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if account.CodeHash == emptyCodeHash {
+		return []byte{}, nil
+	}
+	return src.Preimage(account.CodeHash)
+}
+
+// walkTrie follows key (not yet converted into nibbles) from root and returns the
+// hex encoded nodes on the path (as eth_getProof does) and the value stored at
+// key, which is nil if the trie doesn't contain the key.
+func walkTrie(src preimageSource, root common.Hash, key []byte) ([]string, []byte, error) {
+	if root == types.EmptyRootHash {
+		return nil, nil, nil
+	}
+	nibbles := make([]byte, 2*len(key))
+	for i, b := range key {
+		nibbles[2*i] = b / 16
+		nibbles[2*i+1] = b % 16
+	}
+
+	var proof []string
+	node, err := src.Preimage(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof = append(proof, hexutil.Encode(node))
+
+	for {
+		elems, _, err := rlp.SplitList(node)
+		if err != nil {
+			return nil, nil, err
+		}
+		var child []byte
+		switch c, _ := rlp.CountValues(elems); c {
+		case 17:
+			if len(nibbles) == 0 {
+				return nil, nil, fmt.Errorf("key %x is too short for trie %s", key, root)
+			}
+			if child, err = listElement(elems, int(nibbles[0])); err != nil {
+				return nil, nil, err
+			}
+			nibbles = nibbles[1:]
+		case 2:
+			compact, rest, err := rlp.SplitString(elems)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyNibbles, isLeaf := CompactToNibbles(compact)
+			if len(nibbles) < len(keyNibbles) || !bytes.Equal(keyNibbles, nibbles[:len(keyNibbles)]) {
+				return proof, nil, nil
+			}
+			nibbles = nibbles[len(keyNibbles):]
+			if isLeaf {
+				val, _, err := rlp.SplitString(rest)
+				return proof, val, err
+			}
+			if child, err = listElement(rest, 0); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("invalid number of list elements in node of trie %s", root)
+		}
+
+		kind, content, _, err := rlp.Split(child)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case kind == rlp.List:
+			// Nodes shorter than 32 bytes are embedded into the parent.
+			node = child
+		case len(content) == 0:
+			return proof, nil, nil
+		case len(content) == 32:
+			if node, err = src.Preimage(common.BytesToHash(content)); err != nil {
+				return nil, nil, err
+			}
+			proof = append(proof, hexutil.Encode(node))
+		default:
+			return nil, nil, fmt.Errorf("invalid child reference in trie %s", root)
+		}
+	}
+}
+
+// listElement returns the raw RLP of the i-th element in the list content elems.
+func listElement(elems []byte, i int) ([]byte, error) {
+	for j := 0; ; j++ {
+		_, _, rest, err := rlp.Split(elems)
+		if err != nil {
+			return nil, err
+		}
+		if j == i {
+			return elems[:len(elems)-len(rest)], nil
+		}
+		elems = rest
+	}
+}
+
+// CompactToNibbles decodes the hex-prefix encoded key of a short node (leaf or
+// extension node) and reports whether it is a leaf.
+func CompactToNibbles(compact []byte) ([]byte, bool) {
+	if len(compact) == 0 {
+		return nil, false
+	}
+	flag := compact[0] >> 4
+	var nibbles []byte
+	if flag&1 == 1 {
+		nibbles = append(nibbles, compact[0]&0x0f)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b/16, b%16)
+	}
+	return nibbles, flag&2 == 2
+}
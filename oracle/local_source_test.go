@@ -0,0 +1,171 @@
+package oracle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	localAddr = common.HexToAddress("0xc0de")
+	localKey  = common.HexToHash("0x1")
+)
+
+// localSources returns a MemorySource and a FileSource with the same state at
+// block 1: localAddr with localKey set and a few other accounts.
+func localSources(t *testing.T) (*MemorySource, *FileSource) {
+	alloc := GenesisAlloc{
+		localAddr: {Balance: math.NewHexOrDecimal256(1000), Nonce: 2, Storage: map[common.Hash]common.Hash{
+			localKey:                common.HexToHash("0xff"),
+			common.HexToHash("0x3"): common.HexToHash("0x33"),
+		}},
+	}
+	for i := 0; i < 16; i++ {
+		alloc[common.BigToAddress(big.NewInt(int64(i+1)))] = GenesisAccount{Balance: math.NewHexOrDecimal256(1)}
+	}
+	mem, err := alloc.Source(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for hash, val := range mem.preimages {
+		if err := ioutil.WriteFile(filepath.Join(dir, hash.String()), val, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header, err := json.Marshal(mem.headers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "block_1.json"), header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return mem, NewFileSource(dir)
+}
+
+// verifyProof checks the hex encoded proof of key against root with the trie
+// package of geth and returns the proved value (nil if the key is not in the trie).
+func verifyProof(root common.Hash, key []byte, proof []string) ([]byte, error) {
+	db := memorydb.New()
+	for _, node := range proof {
+		enc, err := hexutil.Decode(node)
+		if err != nil {
+			return nil, err
+		}
+		db.Put(crypto.Keccak256(enc), enc)
+	}
+	return trie.VerifyProof(root, crypto.Keccak256(key), db)
+}
+
+func TestLocalSourceProofs(t *testing.T) {
+	mem, file := localSources(t)
+	root := *mem.headers[1].Root
+
+	tests := []struct {
+		name    string
+		addr    common.Address
+		key     common.Hash
+		exists  bool
+		balance int64
+		value   int64
+	}{
+		{"existing account and key", localAddr, localKey, true, 1000, 0xff},
+		{"existing account, missing key", localAddr, common.HexToHash("0x2"), true, 1000, 0},
+		{"missing account", common.HexToAddress("0xdead"), localKey, false, 0, 0},
+	}
+	for _, src := range []NodeSource{mem, file} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%T/%s", src, test.name), func(t *testing.T) {
+				result, err := src.GetProof(big.NewInt(1), test.addr, []common.Hash{test.key})
+				if err != nil {
+					t.Fatal(err)
+				}
+				account, err := verifyProof(root, test.addr[:], result.AccountProof)
+				if err != nil {
+					t.Fatalf("invalid account proof: %v", err)
+				}
+				if (account != nil) != test.exists {
+					t.Fatalf("account proved %x, expected it to exist: %v", account, test.exists)
+				}
+				if result.Balance.ToInt().Int64() != test.balance {
+					t.Errorf("balance %v, want %d", result.Balance, test.balance)
+				}
+				if !test.exists && (result.StorageHash != types.EmptyRootHash || result.CodeHash != emptyCodeHash) {
+					t.Errorf("missing account with storage root %s and code hash %s", result.StorageHash, result.CodeHash)
+				}
+
+				if len(result.StorageProof) != 1 {
+					t.Fatalf("%d storage proofs for one key", len(result.StorageProof))
+				}
+				sp := result.StorageProof[0]
+				if sp.Key != test.key.Hex() || sp.Value.ToInt().Int64() != test.value {
+					t.Errorf("storage %s = %v, want %s = %d", sp.Key, sp.Value, test.key.Hex(), test.value)
+				}
+				if result.StorageHash == types.EmptyRootHash {
+					// As in geth, the proof of a key in the empty trie is empty.
+					if len(sp.Proof) != 0 {
+						t.Errorf("proof %v in the empty storage trie", sp.Proof)
+					}
+					return
+				}
+				value, err := verifyProof(result.StorageHash, test.key[:], sp.Proof)
+				if err != nil {
+					t.Fatalf("invalid storage proof: %v", err)
+				}
+				if (value != nil) != (test.value != 0) {
+					t.Errorf("storage proof proves %x for value %d", value, test.value)
+				}
+			})
+		}
+	}
+}
+
+func TestLocalSourceNotFound(t *testing.T) {
+	mem, file := localSources(t)
+	for _, src := range []NodeSource{mem, file} {
+		if _, err := src.GetBlockByNumber(big.NewInt(2)); err != ErrNotFound {
+			t.Errorf("%T: GetBlockByNumber of a missing block returned %v", src, err)
+		}
+		if _, err := src.GetProof(big.NewInt(2), localAddr, nil); err != ErrNotFound {
+			t.Errorf("%T: GetProof of a missing block returned %v", src, err)
+		}
+		if _, err := src.GetCode(big.NewInt(2), localAddr); err != ErrNotFound {
+			t.Errorf("%T: GetCode of a missing block returned %v", src, err)
+		}
+		if _, err := src.Preimage(common.HexToHash("0x1234")); err != ErrNotFound {
+			t.Errorf("%T: Preimage of a missing hash returned %v", src, err)
+		}
+	}
+
+	// A missing node on the path of the proof.
+	root := *mem.headers[1].Root
+	name := filepath.Join(file.Dir, root.String())
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.GetProof(big.NewInt(1), localAddr, nil); err != ErrNotFound {
+		t.Errorf("GetProof with a missing trie node returned %v", err)
+	}
+
+	// A fixture that doesn't hash to its name is not a missing one.
+	if err := ioutil.WriteFile(name, []byte{0xc0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.GetProof(big.NewInt(1), localAddr, nil); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetProof with a corrupt fixture returned %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package oracle
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Oracle is the preimage store filled from a NodeSource: the trie nodes and code
+// obtained through eth_getProof and eth_getCode, the headers of the prefetched
+// blocks and the block transition inputs. An Oracle is safe for concurrent use;
+// each witness generation should use its own Oracle, so that the preimages of
+// different blocks (or sources) don't mix.
+type Oracle struct {
+	src NodeSource
+
+	lock      sync.RWMutex
+	preimages map[common.Hash][]byte
+	cached    map[string]bool // prefetched proofs and code
+	unhashMap map[common.Hash]common.Address
+	inputs    [7]common.Hash
+	headers   map[uint64]*Header     // fetched headers, see Bundle
+	roots     map[uint64]common.Hash // state roots of the blocks proofs were fetched for
+}
+
+// NewOracle returns an empty Oracle that fetches the missing data from src.
+func NewOracle(src NodeSource) *Oracle {
+	return &Oracle{
+		src:       src,
+		preimages: make(map[common.Hash][]byte),
+		cached:    make(map[string]bool),
+		unhashMap: make(map[common.Hash]common.Address),
+		headers:   make(map[uint64]*Header),
+		roots:     make(map[uint64]common.Hash),
+	}
+}
+
+// Source returns the NodeSource of the oracle.
+func (o *Oracle) Source() NodeSource {
+	return o.src
+}
+
+func (o *Oracle) isCached(key string) bool {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.cached[key]
+}
+
+// addPreimages stores the preimages and marks the keys as cached.
+func (o *Oracle) addPreimages(newPreimages map[common.Hash][]byte, keys ...string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for hash, val := range newPreimages {
+		o.preimages[hash] = val
+	}
+	for _, key := range keys {
+		o.cached[key] = true
+	}
+}
+
+// addRoot records the state root of the block the proof belongs to.
+func (o *Oracle) addRoot(blockNumber *big.Int, result *AccountResult) {
+	root := types.EmptyRootHash
+	if len(result.AccountProof) > 0 {
+		node, err := hexutil.Decode(result.AccountProof[0])
+		if err != nil {
+			return
+		}
+		root = crypto.Keccak256Hash(node)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.roots[blockNumber.Uint64()] = root
+}
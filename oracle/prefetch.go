@@ -1,16 +1,10 @@
 package oracle
 
 import (
-	"bytes"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
 	"math/big"
-	"net/http"
-	"os"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -26,28 +20,13 @@ type jsonreq struct {
 	Id      uint64        `json:"id"`
 }
 
+// jsonresp is a JSON-RPC response, the result is decoded once the request it
+// belongs to is known.
 type jsonresp struct {
-	Jsonrpc string        `json:"jsonrpc"`
-	Id      uint64        `json:"id"`
-	Result  AccountResult `json:"result"`
-}
-
-type jsonresps struct {
-	Jsonrpc string `json:"jsonrpc"`
-	Id      uint64 `json:"id"`
-	Result  string `json:"result"`
-}
-
-type jsonrespi struct {
-	Jsonrpc string         `json:"jsonrpc"`
-	Id      uint64         `json:"id"`
-	Result  hexutil.Uint64 `json:"result"`
-}
-
-type jsonrespt struct {
-	Jsonrpc string `json:"jsonrpc"`
-	Id      uint64 `json:"id"`
-	Result  Header `json:"result"`
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      uint64          `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *RPCError       `json:"error"`
 }
 
 // Result structs for GetProof
@@ -76,254 +55,232 @@ type Account struct {
 	CodeHash []byte
 }
 
-var NodeUrl = "https://mainnet.infura.io/v3/9aa3d95b3bc440fa88ea12eaa4456161"
-// var NodeUrl = "http://localhost:8545"
-
-func toFilename(key string) string {
-	return fmt.Sprintf("/tmp/eth/json_%s", key)
+func (o *Oracle) unhash(addrHash common.Hash) common.Address {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.unhashMap[addrHash]
 }
 
-func cacheRead(key string) []byte {
-	dat, err := ioutil.ReadFile(toFilename(key))
-	if err == nil {
-		return dat
+func (o *Oracle) PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) ([]string, error) {
+	key := fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)
+	// TODO: should return proof anyway
+	if o.isCached(key) {
+		return nil, nil
 	}
-	panic("cache missing")
-}
-
-func cacheExists(key string) bool {
-	_, err := os.Stat(toFilename(key))
-	return err == nil
-}
 
-func cacheWrite(key string, value []byte) {
-	ioutil.WriteFile(toFilename(key), value, 0644)
-}
+	result, err := o.getProofAccount(blockNumber, addr, []common.Hash{skey})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		o.addPreimages(nil, key)
+		return nil, nil
+	}
+	newPreimages, err := proofPreimages(result)
+	if err != nil {
+		return nil, err
+	}
 
-func getAPI(jsonData []byte) io.Reader {
-	key := hexutil.Encode(crypto.Keccak256(jsonData))
-	if cacheExists(key) {
-		return bytes.NewReader(cacheRead(key))
+	if postProcess != nil {
+		postProcess(newPreimages)
 	}
-	resp, _ := http.Post(NodeUrl, "application/json", bytes.NewBuffer(jsonData))
-	defer resp.Body.Close()
-	ret, _ := ioutil.ReadAll(resp.Body)
-	cacheWrite(key, ret)
-	return bytes.NewReader(ret)
-}
 
-var unhashMap = make(map[common.Hash]common.Address)
+	o.addPreimages(newPreimages, key)
 
-func unhash(addrHash common.Hash) common.Address {
-	return unhashMap[addrHash]
+	return result.StorageProof[0].Proof, nil
 }
 
-var cached = make(map[string]bool)
-
-func PrefetchStorage(blockNumber *big.Int, addr common.Address, skey common.Hash, postProcess func(map[common.Hash][]byte)) []string {
-	key := fmt.Sprintf("proof_%d_%s_%s", blockNumber, addr, skey)
-	// TODO: should return proof anyway
-	if cached[key] {
-		return nil
+func (o *Oracle) PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) ([]string, error) {
+	key := fmt.Sprintf("proof_%d_%s", blockNumber, addr)
+	if o.isCached(key) {
+		return nil, nil
 	}
-	cached[key] = true
 
-	ap := getProofAccount(blockNumber, addr, skey, true)
-	//fmt.Println("PrefetchStorage", blockNumber, addr, skey, len(ap))
-	newPreimages := make(map[common.Hash][]byte)
-	for _, s := range ap {
-		ret, _ := hex.DecodeString(s[2:])
-		hash := crypto.Keccak256Hash(ret)
-		//fmt.Println("   ", i, hash)
-		newPreimages[hash] = ret
+	result, err := o.getProofAccount(blockNumber, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		o.addPreimages(nil, key)
+		return nil, nil
+	}
+	newPreimages, err := proofPreimages(result)
+	if err != nil {
+		return nil, err
 	}
 
 	if postProcess != nil {
 		postProcess(newPreimages)
 	}
 
-	for hash, val := range newPreimages {
-		preimages[hash] = val
-	}
+	o.addPreimages(newPreimages, key)
 
-	return ap
+	return result.AccountProof, nil
 }
 
-func PrefetchAccount(blockNumber *big.Int, addr common.Address, postProcess func(map[common.Hash][]byte)) []string {
-	key := fmt.Sprintf("proof_%d_%s", blockNumber, addr)
-	if cached[key] {
-		return nil
-	}
-	cached[key] = true
-
-	ap := getProofAccount(blockNumber, addr, common.Hash{}, false)
+// decodeProof maps the hash of each (hex encoded) proof node to the node.
+func decodeProof(proof []string) (map[common.Hash][]byte, error) {
 	newPreimages := make(map[common.Hash][]byte)
-	for _, s := range ap {
-		ret, _ := hex.DecodeString(s[2:])
+	for _, s := range proof {
+		ret, err := hexutil.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("malformed proof node %q: %w", s, err)
+		}
 		hash := crypto.Keccak256Hash(ret)
+		//fmt.Println("   ", i, hash)
 		newPreimages[hash] = ret
-
-		/*
-			// just for debugging:
-			elems, _, err := rlp.SplitList(ret)
-			if err != nil {
-				fmt.Println("decode error", err)
-			}
-			switch c, _ := rlp.CountValues(elems); c {
-			case 2:
-				fmt.Println("2")
-			case 17:
-				fmt.Println("17")
-			default:
-				fmt.Println("invalid number of list elements")
-			}
-		*/
 	}
+	return newPreimages, nil
+}
 
-	if postProcess != nil {
-		postProcess(newPreimages)
+// proofPreimages maps the hash of each node of the account proof and of the storage
+// proofs to the node.
+func proofPreimages(result *AccountResult) (map[common.Hash][]byte, error) {
+	newPreimages, err := decodeProof(result.AccountProof)
+	if err != nil {
+		return nil, err
 	}
-
-	for hash, val := range newPreimages {
-		preimages[hash] = val
+	for _, sp := range result.StorageProof {
+		storagePreimages, err := decodeProof(sp.Proof)
+		if err != nil {
+			return nil, err
+		}
+		for hash, val := range storagePreimages {
+			newPreimages[hash] = val
+		}
 	}
-
-	return ap
+	return newPreimages, nil
 }
 
-func PrefetchCode(blockNumber *big.Int, addrHash common.Hash) {
+func (o *Oracle) PrefetchCode(blockNumber *big.Int, addrHash common.Hash) error {
 	key := fmt.Sprintf("code_%d_%s", blockNumber, addrHash)
-	if cached[key] {
-		return
+	if o.isCached(key) {
+		return nil
+	}
+	ret, err := o.getProvedCodeBytes(blockNumber, addrHash)
+	if err != nil {
+		return err
 	}
-	cached[key] = true
-	ret := getProvedCodeBytes(blockNumber, addrHash)
 	hash := crypto.Keccak256Hash(ret)
-	preimages[hash] = ret
+	o.addPreimages(map[common.Hash][]byte{hash: ret}, key)
+	return nil
 }
 
-var inputs [7]common.Hash
-
-func Input(index int) common.Hash {
+// Input returns the block transition input with the given index (0 to 5), see
+// PrefetchBlock.
+func (o *Oracle) Input(index int) (common.Hash, error) {
 	if index < 0 || index > 5 {
-		panic("bad input index")
+		return common.Hash{}, fmt.Errorf("bad input index %d", index)
 	}
-	return inputs[index]
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.inputs[index], nil
 }
 
-func Output(output common.Hash) {
-	if output == inputs[6] {
-		fmt.Println("good transition")
-	} else {
-		fmt.Println(output, "!=", inputs[5])
-		panic("BAD transition :((")
+func (o *Oracle) Output(output common.Hash) error {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if output != o.inputs[6] {
+		return fmt.Errorf("bad transition: %s != %s", output, o.inputs[6])
 	}
+	return nil
 }
 
-func check(err error) {
+func (o *Oracle) PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) (types.Header, error) {
+	block, err := o.src.GetBlockByNumber(blockNumber)
 	if err != nil {
-		log.Fatal(err)
+		return types.Header{}, &SourceError{Method: "eth_getBlockByNumber", Err: err}
 	}
-}
-
-func PrefetchBlock(blockNumber *big.Int, startBlock bool, hasher types.TrieHasher) types.Header {
-	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getBlockByNumber", Id: 1}
-	r.Params = make([]interface{}, 2)
-	r.Params[0] = fmt.Sprintf("0x%x", blockNumber.Int64())
-	r.Params[1] = true
-	jsonData, _ := json.Marshal(r)
-
-	/*dat, _ := ioutil.ReadAll(getAPI(jsonData))
-	fmt.Println(string(dat))*/
-
-	jr := jsonrespt{}
-	check(json.NewDecoder(getAPI(jsonData)).Decode(&jr))
-	//fmt.Println(jr.Result)
-	// blockHeader := types.Header(jr.Result)
-	blockHeader := jr.Result.ToHeader()
+	//fmt.Println(block)
+	// blockHeader := types.Header(*block)
+	blockHeader := block.ToHeader()
+	o.lock.Lock()
+	o.headers[blockNumber.Uint64()] = block
+	o.lock.Unlock()
 
 	// put in the start block header
 	if startBlock {
-		blockHeaderRlp, _ := rlp.EncodeToBytes(blockHeader)
+		blockHeaderRlp, err := rlp.EncodeToBytes(blockHeader)
+		if err != nil {
+			return types.Header{}, err
+		}
 		hash := crypto.Keccak256Hash(blockHeaderRlp)
-		preimages[hash] = blockHeaderRlp
-		inputs[0] = hash
-		return blockHeader
+		o.lock.Lock()
+		o.preimages[hash] = blockHeaderRlp
+		o.inputs[0] = hash
+		o.lock.Unlock()
+		return blockHeader, nil
 	}
 
 	// second block
-	if blockHeader.ParentHash != Input(0) {
-		fmt.Println(blockHeader.ParentHash, Input(0))
-		panic("block transition isn't correct")
+	o.lock.Lock()
+	if blockHeader.ParentHash != o.inputs[0] {
+		o.lock.Unlock()
+		return types.Header{}, fmt.Errorf("block transition isn't correct: parent %s != %s", blockHeader.ParentHash, o.inputs[0])
 	}
-	inputs[1] = blockHeader.TxHash
-	inputs[2] = blockHeader.Coinbase.Hash()
-	inputs[3] = blockHeader.UncleHash
-	inputs[4] = common.BigToHash(big.NewInt(int64(blockHeader.GasLimit)))
-	inputs[5] = common.BigToHash(big.NewInt(int64(blockHeader.Time)))
+	o.inputs[1] = blockHeader.TxHash
+	o.inputs[2] = blockHeader.Coinbase.Hash()
+	o.inputs[3] = blockHeader.UncleHash
+	o.inputs[4] = common.BigToHash(big.NewInt(int64(blockHeader.GasLimit)))
+	o.inputs[5] = common.BigToHash(big.NewInt(int64(blockHeader.Time)))
 
 	// secret input
-	inputs[6] = blockHeader.Root
-
-	// save the inputs
-	saveinput := make([]byte, 0)
-	for i := 0; i < len(inputs); i++ {
-		saveinput = append(saveinput, inputs[i].Bytes()[:]...)
-	}
-	key := fmt.Sprintf("/tmp/eth/%d", blockNumber.Uint64()-1)
-	ioutil.WriteFile(key, saveinput, 0644)
+	o.inputs[6] = blockHeader.Root
+	o.lock.Unlock()
 
 	// save the txs
-	txs := make([]*types.Transaction, len(jr.Result.Transactions))
-	for i := 0; i < len(jr.Result.Transactions); i++ {
-		txs[i] = jr.Result.Transactions[i].ToTransaction()
+	txs := make([]*types.Transaction, len(block.Transactions))
+	for i := 0; i < len(block.Transactions); i++ {
+		txs[i] = block.Transactions[i].ToTransaction()
 	}
-	fmt.Println(txs[0].To())
 	testTxHash := types.DeriveSha(types.Transactions(txs), hasher)
 	if testTxHash != blockHeader.TxHash {
-		fmt.Println(testTxHash, "!=", blockHeader.TxHash)
-		panic("tx hash derived wrong")
+		return types.Header{}, fmt.Errorf("tx hash derived wrong: %s != %s", testTxHash, blockHeader.TxHash)
 	}
 
-	return blockHeader
+	return blockHeader, nil
 }
 
-func getProofAccount(blockNumber *big.Int, addr common.Address, skey common.Hash, storage bool) []string {
-	addrHash := crypto.Keccak256Hash(addr[:])
-	unhashMap[addrHash] = addr
-
-	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getProof", Id: 1}
-	r.Params = make([]interface{}, 3)
-	r.Params[0] = addr
-	r.Params[1] = [1]common.Hash{skey}
-	r.Params[2] = fmt.Sprintf("0x%x", blockNumber.Int64())
-	jsonData, _ := json.Marshal(r)
-	jr := jsonresp{}
-	json.NewDecoder(getAPI(jsonData)).Decode(&jr)
-
-	if storage {
-		return jr.Result.StorageProof[0].Proof
-	} else {
-		return jr.Result.AccountProof
+// getProofAccount returns the eth_getProof result for addr and the storage keys,
+// nil if the source doesn't have the block.
+func (o *Oracle) getProofAccount(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	o.addUnhash(addr)
+
+	result, err := o.src.GetProof(blockNumber, addr, keys)
+	if errors.Is(err, ErrNotFound) {
+		// For example the next block (used for absence proofs) is not available.
+		return nil, nil
 	}
+	if err != nil {
+		return nil, &SourceError{Method: "eth_getProof", Err: err}
+	}
+	if err := checkStorageProofs(result, keys); err != nil {
+		return nil, err
+	}
+	o.addRoot(blockNumber, result)
+	return result, nil
 }
 
-func getProvedCodeBytes(blockNumber *big.Int, addrHash common.Hash) []byte {
-	addr := unhash(addrHash)
-
-	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getCode", Id: 1}
-	r.Params = make([]interface{}, 2)
-	r.Params[0] = addr
-	r.Params[1] = fmt.Sprintf("0x%x", blockNumber.Int64())
-	jsonData, _ := json.Marshal(r)
-	jr := jsonresps{}
-	json.NewDecoder(getAPI(jsonData)).Decode(&jr)
+func checkStorageProofs(result *AccountResult, keys []common.Hash) error {
+	if len(result.StorageProof) != len(keys) {
+		return &SourceError{Method: "eth_getProof", Err: fmt.Errorf("%d storage proofs for %d keys", len(result.StorageProof), len(keys))}
+	}
+	return nil
+}
 
-	//fmt.Println(jr.Result)
+func (o *Oracle) addUnhash(addr common.Address) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.unhashMap[crypto.Keccak256Hash(addr[:])] = addr
+}
 
-	// curl -X POST --data '{"jsonrpc":"2.0","method":"eth_getCode","params":["0xa94f5374fce5edbc8e2a8697c15331677e6ebf0b", "0x2"],"id":1}'
+func (o *Oracle) getProvedCodeBytes(blockNumber *big.Int, addrHash common.Hash) ([]byte, error) {
+	addr := o.unhash(addrHash)
 
-	ret, _ := hex.DecodeString(jr.Result[2:])
+	ret, err := o.src.GetCode(blockNumber, addr)
+	if err != nil {
+		return nil, &SourceError{Method: "eth_getCode", Err: err}
+	}
 	//fmt.Println(ret)
-	return ret
+	return ret, nil
 }
@@ -0,0 +1,243 @@
+package oracle
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultPrefetchWorkers is the number of concurrent requests Prefetch uses when
+// no number is given.
+const DefaultPrefetchWorkers = 8
+
+// maxProofKeys is the maximum number of storage keys requested in one eth_getProof.
+const maxProofKeys = 64
+
+// maxBatchSize is the maximum number of eth_getProof calls sent together to a
+// BatchProofSource.
+const maxBatchSize = 16
+
+// ProofRequest asks for the account proof of Address and the storage proofs of
+// Keys at the given block.
+type ProofRequest struct {
+	BlockNumber *big.Int
+	Address     common.Address
+	Keys        []common.Hash
+	// PostProcess is called with the preimages of each fetched proof before they
+	// are stored (see PrefetchAccount).
+	PostProcess func(map[common.Hash][]byte)
+}
+
+// Proof returns the account proof of addr and the storage proofs of keys at the
+// block (the same as eth_getProof) built from the preimage store. The proofs the
+// oracle doesn't have yet are fetched first (see Prefetch), so repeated requests
+// and the witness generation of the block don't query the source again.
+func (o *Oracle) Proof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	if err := o.Prefetch([]ProofRequest{{BlockNumber: blockNumber, Address: addr, Keys: keys}}, 1); err != nil {
+		return nil, err
+	}
+	o.lock.RLock()
+	root, ok := o.roots[blockNumber.Uint64()]
+	o.lock.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return proveFromRoot(o, root, addr, keys)
+}
+
+// proofJob is a single eth_getProof call of Prefetch.
+type proofJob struct {
+	req        ProofRequest
+	accountKey string   // cache key of the account proof
+	storageKey []string // cache keys of the storage proofs
+}
+
+// Prefetch fetches the proofs of all the requests using at most workers concurrent
+// requests to the source and puts the proof nodes into the preimage store. The
+// storage keys of the same account (and block) are requested together in one
+// eth_getProof call, and if the source is a BatchProofSource, the calls are sent
+// in batches of up to maxBatchSize. Proofs that were already fetched are skipped,
+// and the later PrefetchAccount and PrefetchStorage calls for the prefetched
+// proofs don't query the source again.
+func (o *Oracle) Prefetch(reqs []ProofRequest, workers int) error {
+	if workers <= 0 {
+		workers = DefaultPrefetchWorkers
+	}
+
+	jobs := o.proofJobs(reqs)
+	if len(jobs) == 0 {
+		return nil
+	}
+	batchSize := 1
+	if _, ok := o.src.(BatchProofSource); ok {
+		batchSize = maxBatchSize
+	}
+	var batches [][]proofJob
+	for start := 0; start < len(jobs); start += batchSize {
+		end := start + batchSize
+		if end > len(jobs) {
+			end = len(jobs)
+		}
+		batches = append(batches, jobs[start:end])
+	}
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		queue    = make(chan []proofJob)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				if err := o.fetchProofs(batch); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+loop:
+	for _, batch := range batches {
+		select {
+		case queue <- batch:
+		case <-failed:
+			break loop
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return firstErr
+}
+
+// proofJobs groups the requests by block and account, drops the proofs that are
+// already cached and splits the remaining keys into chunks of maxProofKeys.
+func (o *Oracle) proofJobs(reqs []ProofRequest) []proofJob {
+	type account struct {
+		blockNumber *big.Int
+		addr        common.Address
+	}
+	var order []account
+	merged := make(map[string]*ProofRequest)
+	seen := make(map[string]bool)
+	for _, req := range reqs {
+		accountKey := fmt.Sprintf("proof_%d_%s", req.BlockNumber, req.Address)
+		m, ok := merged[accountKey]
+		if !ok {
+			m = &ProofRequest{BlockNumber: req.BlockNumber, Address: req.Address, PostProcess: req.PostProcess}
+			merged[accountKey] = m
+			order = append(order, account{req.BlockNumber, req.Address})
+		}
+		if m.PostProcess == nil {
+			m.PostProcess = req.PostProcess
+		}
+		for _, key := range req.Keys {
+			storageKey := fmt.Sprintf("proof_%d_%s_%s", req.BlockNumber, req.Address, key)
+			if !seen[storageKey] && !o.isCached(storageKey) {
+				seen[storageKey] = true
+				m.Keys = append(m.Keys, key)
+			}
+		}
+	}
+
+	var jobs []proofJob
+	for _, a := range order {
+		accountKey := fmt.Sprintf("proof_%d_%s", a.blockNumber, a.addr)
+		m := merged[accountKey]
+		if len(m.Keys) == 0 {
+			if !o.isCached(accountKey) {
+				jobs = append(jobs, proofJob{req: *m, accountKey: accountKey})
+			}
+			continue
+		}
+		for start := 0; start < len(m.Keys); start += maxProofKeys {
+			end := start + maxProofKeys
+			if end > len(m.Keys) {
+				end = len(m.Keys)
+			}
+			job := proofJob{req: *m, accountKey: accountKey}
+			job.req.Keys = m.Keys[start:end]
+			for _, key := range job.req.Keys {
+				job.storageKey = append(job.storageKey, fmt.Sprintf("proof_%d_%s_%s", a.blockNumber, a.addr, key))
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// fetchProofs fetches the proofs of the jobs, in one request if the source is a
+// BatchProofSource.
+func (o *Oracle) fetchProofs(jobs []proofJob) error {
+	batchSrc, ok := o.src.(BatchProofSource)
+	if !ok || len(jobs) == 1 {
+		for _, job := range jobs {
+			result, err := o.getProofAccount(job.req.BlockNumber, job.req.Address, job.req.Keys)
+			if err != nil {
+				return err
+			}
+			if err := o.storeProof(job, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reqs := make([]ProofRequest, len(jobs))
+	for i, job := range jobs {
+		o.addUnhash(job.req.Address)
+		reqs[i] = job.req
+	}
+	results, err := batchSrc.GetProofs(reqs)
+	if err != nil {
+		return &SourceError{Method: "eth_getProof", Err: err}
+	}
+	if len(results) != len(jobs) {
+		return &SourceError{Method: "eth_getProof", Err: fmt.Errorf("%d results for %d requests", len(results), len(jobs))}
+	}
+	for i, job := range jobs {
+		if results[i] != nil {
+			if err := checkStorageProofs(results[i], job.req.Keys); err != nil {
+				return err
+			}
+			o.addRoot(job.req.BlockNumber, results[i])
+		}
+		if err := o.storeProof(job, results[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeProof puts the nodes of the proof into the preimage store and marks the
+// proofs of the job as cached. A nil result means the source doesn't have the block.
+func (o *Oracle) storeProof(job proofJob, result *AccountResult) error {
+	keys := append([]string{job.accountKey}, job.storageKey...)
+	if result == nil {
+		o.addPreimages(nil, keys...)
+		return nil
+	}
+	newPreimages, err := proofPreimages(result)
+	if err != nil {
+		return err
+	}
+	if job.req.PostProcess != nil {
+		job.req.PostProcess(newPreimages)
+	}
+	o.addPreimages(newPreimages, keys...)
+
+	return nil
+}
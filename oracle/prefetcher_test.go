@@ -0,0 +1,52 @@
+package oracle_test
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/miha-stopar/mpt/internal/oracletest"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+func TestOracleProof(t *testing.T) {
+	addr := common.HexToAddress("0xc0de")
+	keys := []common.Hash{common.HexToHash("0x1"), common.HexToHash("0x2")}
+	alloc := oracle.GenesisAlloc{
+		addr: {Balance: math.NewHexOrDecimal256(1000), Nonce: 2, Storage: map[common.Hash]common.Hash{
+			keys[0]: common.HexToHash("0xff"),
+		}},
+	}
+	for i := 0; i < 16; i++ {
+		alloc[common.BigToAddress(big.NewInt(int64(i+1)))] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(1)}
+	}
+	mem, err := alloc.Source(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := oracletest.NewCountingSource(mem)
+	want, err := mem.GetProof(big.NewInt(1), addr, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orc := oracle.NewOracle(src)
+	for i := 0; i < 2; i++ {
+		got, err := orc.Proof(big.NewInt(1), addr, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got proof\n%+v\nwant\n%+v", got, want)
+		}
+	}
+	if src.TotalCalls() != 1 {
+		t.Errorf("expected one eth_getProof call, got %d", src.TotalCalls())
+	}
+
+	if _, err := orc.Proof(big.NewInt(2), addr, keys); err != oracle.ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing block, got %v", err)
+	}
+}
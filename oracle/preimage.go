@@ -1,44 +1,64 @@
 package oracle
 
 import (
-	"fmt"
-	"io/ioutil"
-
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
-var preimages = make(map[common.Hash][]byte)
-
-func Preimage(hash common.Hash) []byte {
-	val, ok := preimages[hash]
-	key := fmt.Sprintf("/tmp/eth/%s", hash)
-	ioutil.WriteFile(key, val, 0644)
+func (o *Oracle) Preimage(hash common.Hash) ([]byte, error) {
+	o.lock.RLock()
+	val, ok := o.preimages[hash]
+	o.lock.RUnlock()
+	if !ok && o.src != nil {
+		// Not prefetched, the source might still be able to provide it directly.
+		v, err := o.src.Preimage(hash)
+		if err != nil && err != ErrNotFound {
+			return nil, &SourceError{Method: "preimage", Err: err}
+		}
+		if err == nil {
+			val, ok = v, true
+			o.addPreimages(map[common.Hash][]byte{hash: v})
+		}
+	}
 	if !ok {
-		fmt.Println("can't find preimage", hash)
+		return nil, &MissingPreimageError{Hash: hash}
 	}
 	comphash := crypto.Keccak256Hash(val)
 	if hash != comphash {
-		panic("corruption in hash " + hash.String())
+		return nil, &CorruptPreimageError{Hash: hash}
 	}
-	return val
+	return val, nil
 }
 
+// Preimages returns a copy of the preimage store.
 // TODO: Maybe we will want to have a seperate preimages for next block's preimages?
-func Preimages() map[common.Hash][]byte {
-	return preimages
+func (o *Oracle) Preimages() map[common.Hash][]byte {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	ret := make(map[common.Hash][]byte, len(o.preimages))
+	for hash, val := range o.preimages {
+		ret[hash] = val
+	}
+	return ret
+}
+
+// PreimageWriter returns a KeyValueWriter putting the values into the preimage store.
+func (o *Oracle) PreimageWriter() PreimageKeyValueWriter {
+	return PreimageKeyValueWriter{oracle: o}
 }
 
 // KeyValueWriter wraps the Put method of a backing data store.
-type PreimageKeyValueWriter struct{}
+type PreimageKeyValueWriter struct {
+	oracle *Oracle
+}
 
 // Put inserts the given value into the key-value data store.
 func (kw PreimageKeyValueWriter) Put(key []byte, value []byte) error {
 	hash := crypto.Keccak256Hash(value)
 	if hash != common.BytesToHash(key) {
-		panic("bad preimage value write")
+		return &CorruptPreimageError{Hash: common.BytesToHash(key)}
 	}
-	preimages[hash] = common.CopyBytes(value)
+	kw.oracle.addPreimages(map[common.Hash][]byte{hash: common.CopyBytes(value)})
 	// fmt.Println("tx preimage", hash, common.Bytes2Hex(value))
 	return nil
 }
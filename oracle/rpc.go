@@ -0,0 +1,260 @@
+package oracle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// RPCConfig configures the HTTP requests of an RPCSource.
+type RPCConfig struct {
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Timeout is the deadline of each attempt of a request (0 means no deadline).
+	Timeout time.Duration
+	// Retries is the number of times a failed request is sent again. Network errors,
+	// HTTP 429 and 5xx responses and JSON-RPC rate limit errors are retried.
+	Retries int
+	// Backoff is the delay before the first retry, it doubles for each next retry
+	// up to MaxBackoff. A Retry-After header of a 429 response takes precedence.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// RequestsPerSecond limits the rate of the requests (0 means no limit).
+	RequestsPerSecond float64
+	// CacheDir is the directory of the response cache (no caching if empty), the
+	// least recently used responses are evicted above CacheMaxBytes (0 means no limit).
+	CacheDir      string
+	CacheMaxBytes int64
+}
+
+// DefaultRPCConfig is the configuration used by NewRPCSource.
+var DefaultRPCConfig = RPCConfig{
+	Timeout:    30 * time.Second,
+	Retries:    5,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+
+	CacheMaxBytes: DefaultCacheMaxBytes,
+}
+
+// rpcRateLimitCode is the JSON-RPC error code providers use when the request rate
+// is exceeded.
+const rpcRateLimitCode = -32005
+
+// rateLimiter spaces out the requests so that there are at most perSecond of them
+// in a second.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next request is allowed.
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// retryError is a failed attempt that is worth repeating, after is the delay
+// the server asked for (0 if it didn't).
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (err *retryError) Error() string {
+	return err.err.Error()
+}
+
+// post sends the JSON-RPC request body (retrying as configured) and returns the
+// response body.
+func (s *RPCSource) post(jsonData []byte) ([]byte, error) {
+	backoff := s.Config.Backoff
+	for attempt := 0; ; attempt++ {
+		s.limiter.wait()
+		ret, err := s.postOnce(jsonData)
+		var retry *retryError
+		if !errors.As(err, &retry) {
+			return ret, err
+		}
+		if attempt >= s.Config.Retries {
+			return nil, retry.err
+		}
+		delay := backoff
+		if retry.after > 0 {
+			delay = retry.after
+		}
+		time.Sleep(delay)
+		backoff *= 2
+		if s.Config.MaxBackoff > 0 && backoff > s.Config.MaxBackoff {
+			backoff = s.Config.MaxBackoff
+		}
+	}
+}
+
+func (s *RPCSource) postOnce(jsonData []byte) ([]byte, error) {
+	ctx := context.Background()
+	if s.Config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Config.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+			return nil, &retryError{err: err}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	ret, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &retryError{err: err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		after, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return nil, &retryError{err: fmt.Errorf("http status %s", resp.Status), after: time.Duration(after) * time.Second}
+	case resp.StatusCode >= 500:
+		return nil, &retryError{err: fmt.Errorf("http status %s", resp.Status)}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("http status %s: %s", resp.Status, bytes.TrimSpace(ret))
+	case rateLimited(ret):
+		return nil, &retryError{err: fmt.Errorf("rate limited: %s", bytes.TrimSpace(ret))}
+	}
+	return ret, nil
+}
+
+// rateLimited reports whether the response (or a response in the batch) is a
+// JSON-RPC rate limit error.
+func rateLimited(body []byte) bool {
+	var jrs []jsonresp
+	if err := json.Unmarshal(body, &jrs); err != nil {
+		var jr jsonresp
+		if err := json.Unmarshal(body, &jr); err != nil {
+			return false
+		}
+		jrs = []jsonresp{jr}
+	}
+	for _, jr := range jrs {
+		if jr.Error != nil && jr.Error.Code == rpcRateLimitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch sends the request (or takes the response from the cache) and passes the
+// response to decode, which reports whether the response can be cached. A cached
+// response that decode rejects is dropped and the request is sent again.
+func (s *RPCSource) fetch(jsonData []byte, from, to uint64, decode func(resp []byte) (bool, error)) error {
+	if resp, ok := s.cache.Get(jsonData, from, to); ok {
+		if _, err := decode(resp); err == nil {
+			return nil
+		}
+		s.cache.Remove(jsonData, from, to)
+	}
+	resp, err := s.post(jsonData)
+	if err != nil {
+		return err
+	}
+	cacheable, err := decode(resp)
+	if err != nil {
+		return err
+	}
+	if cacheable {
+		// The cache is an optimization, failing to write it doesn't fail the request.
+		s.cache.Put(jsonData, from, to, resp)
+	}
+	return nil
+}
+
+// requestBlocks returns the block the request is about (the block numbers are the
+// only hex string parameters of the requests RPCSource sends).
+func requestBlocks(r jsonreq) (uint64, uint64) {
+	for _, p := range r.Params {
+		if s, ok := p.(string); ok {
+			if n, err := hexutil.DecodeUint64(s); err == nil {
+				return n, n
+			}
+		}
+	}
+	return 0, 0
+}
+
+// validateResult checks the result of the request before it is used (or cached):
+// each node of the eth_getProof proofs needs to be referenced by its hash in the
+// previous node.
+func validateResult(method string, result json.RawMessage) error {
+	if method != "eth_getProof" {
+		return nil
+	}
+	var account AccountResult
+	if err := json.Unmarshal(result, &account); err != nil {
+		return err
+	}
+	if err := checkProofNodes(account.AccountProof); err != nil {
+		return fmt.Errorf("account proof of %s: %w", account.Address, err)
+	}
+	for _, sp := range account.StorageProof {
+		if err := checkProofNodes(sp.Proof); err != nil {
+			return fmt.Errorf("storage proof of %s key %s: %w", account.Address, sp.Key, err)
+		}
+	}
+	return nil
+}
+
+func checkProofNodes(proof []string) error {
+	var parent []byte
+	for i, s := range proof {
+		node, err := hexutil.Decode(s)
+		if err != nil {
+			return fmt.Errorf("malformed proof node %q: %w", s, err)
+		}
+		if i > 0 && !bytes.Contains(parent, crypto.Keccak256(node)) {
+			return fmt.Errorf("proof node %d is not referenced by its parent", i)
+		}
+		parent = node
+	}
+	return nil
+}
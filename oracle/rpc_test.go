@@ -0,0 +1,181 @@
+package oracle
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// testServer answers each request with the next of the responses (the last one
+// is repeated) and counts the requests.
+type testServer struct {
+	lock      sync.Mutex
+	requests  int
+	responses []func(w http.ResponseWriter)
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	i := s.requests
+	if i >= len(s.responses) {
+		i = len(s.responses) - 1
+	}
+	s.requests++
+	s.lock.Unlock()
+	s.responses[i](w)
+}
+
+func status(code int, header map[string]string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func body(s string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		fmt.Fprint(w, s)
+	}
+}
+
+const codeResponse = `{"jsonrpc":"2.0","id":1,"result":"0x6000"}`
+
+func testSource(t *testing.T, server *testServer, config RPCConfig) *RPCSource {
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return NewRPCSourceWithConfig(ts.URL, config)
+}
+
+func TestRPCRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []func(w http.ResponseWriter)
+	}{
+		{"TooManyRequests", []func(w http.ResponseWriter){status(http.StatusTooManyRequests, nil), body(codeResponse)}},
+		{"RetryAfter", []func(w http.ResponseWriter){status(http.StatusTooManyRequests, map[string]string{"Retry-After": "1"}), body(codeResponse)}},
+		{"ServerError", []func(w http.ResponseWriter){status(http.StatusBadGateway, nil), status(http.StatusServiceUnavailable, nil), body(codeResponse)}},
+		{"RateLimitError", []func(w http.ResponseWriter){body(`{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"limit exceeded"}}`), body(codeResponse)}},
+	}
+	for _, test := range tests {
+		server := &testServer{responses: test.responses}
+		src := testSource(t, server, RPCConfig{Retries: 3, Backoff: time.Millisecond})
+		code, err := src.GetCode(big.NewInt(1), common.Address{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(code) != 2 {
+			t.Errorf("%s: unexpected code %x", test.name, code)
+		}
+		if server.requests != len(test.responses) {
+			t.Errorf("%s: %d requests, expected %d", test.name, server.requests, len(test.responses))
+		}
+	}
+}
+
+func TestRPCRetriesExhausted(t *testing.T) {
+	server := &testServer{responses: []func(w http.ResponseWriter){status(http.StatusTooManyRequests, nil)}}
+	src := testSource(t, server, RPCConfig{Retries: 2, Backoff: time.Millisecond})
+	if _, err := src.GetCode(big.NewInt(1), common.Address{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if server.requests != 3 {
+		t.Errorf("%d requests, expected 3", server.requests)
+	}
+}
+
+func TestRPCErrorResponse(t *testing.T) {
+	server := &testServer{responses: []func(w http.ResponseWriter){
+		body(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid argument"}}`),
+	}}
+	src := testSource(t, server, RPCConfig{Retries: 3, Backoff: time.Millisecond})
+	_, err := src.GetCode(big.NewInt(1), common.Address{})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32602 {
+		t.Fatalf("expected RPCError, got %v", err)
+	}
+	if server.requests != 1 {
+		t.Errorf("error response retried: %d requests", server.requests)
+	}
+
+	server = &testServer{responses: []func(w http.ResponseWriter){
+		body(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`),
+	}}
+	src = testSource(t, server, RPCConfig{})
+	if _, err := src.GetProof(big.NewInt(1), common.Address{}, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRPCNullResult(t *testing.T) {
+	server := &testServer{responses: []func(w http.ResponseWriter){
+		body(`{"jsonrpc":"2.0","id":1,"result":null}`),
+	}}
+	src := testSource(t, server, RPCConfig{})
+	if result, err := src.GetProof(big.NewInt(1), common.Address{}, nil); err != ErrNotFound {
+		t.Errorf("GetProof: expected ErrNotFound, got %v %v", result, err)
+	}
+	if code, err := src.GetCode(big.NewInt(1), common.Address{}); err != ErrNotFound {
+		t.Errorf("GetCode: expected ErrNotFound, got %x %v", code, err)
+	}
+	if header, err := src.GetBlockByNumber(big.NewInt(1)); err != ErrNotFound {
+		t.Errorf("GetBlockByNumber: expected ErrNotFound, got %v %v", header, err)
+	}
+
+	// In a batch the missing results are nil, as for a not found error.
+	server = &testServer{responses: []func(w http.ResponseWriter){
+		body(`[{"jsonrpc":"2.0","id":0,"result":null},{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}]`),
+	}}
+	src = testSource(t, server, RPCConfig{})
+	reqs := []ProofRequest{{BlockNumber: big.NewInt(1)}, {BlockNumber: big.NewInt(2)}}
+	results, err := src.GetProofs(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0] != nil || results[1] != nil {
+		t.Errorf("expected two nil results, got %v", results)
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	server := &testServer{responses: []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, codeResponse)
+		},
+		body(codeResponse),
+	}}
+	src := testSource(t, server, RPCConfig{Timeout: 50 * time.Millisecond, Retries: 1, Backoff: time.Millisecond})
+	if _, err := src.GetCode(big.NewInt(1), common.Address{}); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 2 {
+		t.Errorf("%d requests, expected 2", server.requests)
+	}
+}
+
+func TestRPCRateLimit(t *testing.T) {
+	server := &testServer{responses: []func(w http.ResponseWriter){body(codeResponse)}}
+	src := testSource(t, server, RPCConfig{RequestsPerSecond: 20})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := src.GetCode(big.NewInt(1), common.Address{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request is sent immediately, each next one 50ms later.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("5 requests took %s at 20 requests per second", elapsed)
+	}
+}
@@ -0,0 +1,249 @@
+package oracle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ErrNotFound is returned by a NodeSource that doesn't have the requested data.
+var ErrNotFound = errors.New("not found in node source")
+
+// NodeSource provides the chain data the oracle needs to fill its preimage store:
+// eth_getProof results, contract code, block headers and raw trie nodes by hash.
+type NodeSource interface {
+	// GetProof returns the account proof of addr and the storage proofs of keys
+	// at the given block (the same as eth_getProof).
+	GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error)
+
+	// GetCode returns the code of addr at the given block.
+	GetCode(blockNumber *big.Int, addr common.Address) ([]byte, error)
+
+	// GetBlockByNumber returns the block header together with its transactions.
+	GetBlockByNumber(blockNumber *big.Int) (*Header, error)
+
+	// Preimage returns the value whose keccak hash is hash (trie node or code).
+	// ErrNotFound is returned if the source can't provide it.
+	Preimage(hash common.Hash) ([]byte, error)
+}
+
+// BatchProofSource is implemented by the sources that can serve many eth_getProof
+// requests at once (for example with a JSON-RPC batch).
+type BatchProofSource interface {
+	// GetProofs returns the results of the requests in the same order. A result is
+	// nil if the source doesn't have the requested block.
+	GetProofs(reqs []ProofRequest) ([]*AccountResult, error)
+}
+
+// UncleSource is implemented by the sources that provide the uncle headers of a
+// block (they are needed for the uncle rewards).
+type UncleSource interface {
+	// GetUncleByBlockNumberAndIndex returns the uncle header with the given index in
+	// the uncle list of the block.
+	GetUncleByBlockNumberAndIndex(blockNumber *big.Int, index int) (*Header, error)
+}
+
+// RPCSource is a NodeSource that queries an Ethereum node over HTTP JSON-RPC.
+// Responses are cached on disk, see Cache.
+type RPCSource struct {
+	Url     string
+	Config  RPCConfig
+	limiter *rateLimiter
+	cache   *Cache
+}
+
+// NewRPCSource returns an RPCSource using DefaultRPCConfig.
+func NewRPCSource(nodeUrl string) *RPCSource {
+	return NewRPCSourceWithConfig(nodeUrl, DefaultRPCConfig)
+}
+
+func NewRPCSourceWithConfig(nodeUrl string, config RPCConfig) *RPCSource {
+	s := &RPCSource{Url: nodeUrl, Config: config, limiter: newRateLimiter(config.RequestsPerSecond)}
+	if config.CacheDir != "" {
+		s.cache = NewCache(config.CacheDir, config.CacheMaxBytes)
+	}
+	return s
+}
+
+// Cache returns the response cache, nil if the responses are not cached.
+func (s *RPCSource) Cache() *Cache {
+	return s.cache
+}
+
+// call sends the request and decodes its result into result. A JSON-RPC error
+// response is returned as RPCError, a null result (the node doesn't have the
+// block) as ErrNotFound.
+func (s *RPCSource) call(r jsonreq, result interface{}) error {
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	from, to := requestBlocks(r)
+	return s.fetch(jsonData, from, to, func(resp []byte) (bool, error) {
+		var jr jsonresp
+		if err := json.Unmarshal(resp, &jr); err != nil {
+			return false, err
+		}
+		if jr.Error != nil {
+			return false, jr.Error
+		}
+		if len(jr.Result) == 0 || string(jr.Result) == "null" {
+			// Not cached, the data might not be available yet.
+			return false, ErrNotFound
+		}
+		if err := validateResult(r.Method, jr.Result); err != nil {
+			return false, err
+		}
+		return true, json.Unmarshal(jr.Result, result)
+	})
+}
+
+// callBatch sends the requests in one JSON-RPC batch and decodes the result of each
+// request into the element of results with the same index. The requests are
+// matched with the responses by their ids, which are set here. The results of the
+// requests that failed with ErrNotFound (see RPCError.Is) are left as they are,
+// any other error response fails the whole batch.
+func (s *RPCSource) callBatch(rs []jsonreq, results []interface{}) error {
+	for i := range rs {
+		rs[i].Id = uint64(i)
+	}
+	jsonData, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	var from, to uint64
+	for i := range rs {
+		f, t := requestBlocks(rs[i])
+		if i == 0 || f < from {
+			from = f
+		}
+		if t > to {
+			to = t
+		}
+	}
+	return s.fetch(jsonData, from, to, func(resp []byte) (bool, error) {
+		var jrs []jsonresp
+		if err := json.Unmarshal(resp, &jrs); err != nil {
+			// A batch that is rejected as a whole gets a single error response.
+			var jr jsonresp
+			if json.Unmarshal(resp, &jr) == nil && jr.Error != nil {
+				return false, jr.Error
+			}
+			return false, err
+		}
+		complete := true
+		answered := make([]bool, len(rs))
+		for _, jr := range jrs {
+			if jr.Id >= uint64(len(rs)) || answered[jr.Id] {
+				return false, fmt.Errorf("unexpected response id %d in batch", jr.Id)
+			}
+			answered[jr.Id] = true
+			if jr.Error != nil {
+				if !errors.Is(jr.Error, ErrNotFound) {
+					return false, jr.Error
+				}
+				complete = false
+				continue
+			}
+			if len(jr.Result) == 0 || string(jr.Result) == "null" {
+				complete = false
+				continue
+			}
+			if err := validateResult(rs[jr.Id].Method, jr.Result); err != nil {
+				return false, err
+			}
+			if err := json.Unmarshal(jr.Result, results[jr.Id]); err != nil {
+				return false, err
+			}
+		}
+		for i := range answered {
+			if !answered[i] {
+				return false, fmt.Errorf("no response for %s request %d in batch", rs[i].Method, i)
+			}
+		}
+		return complete, nil
+	})
+}
+
+func getProofRequest(blockNumber *big.Int, addr common.Address, keys []common.Hash) jsonreq {
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getProof", Id: 1}
+	if keys == nil {
+		keys = []common.Hash{}
+	}
+	r.Params = make([]interface{}, 3)
+	r.Params[0] = addr
+	r.Params[1] = keys
+	r.Params[2] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	return r
+}
+
+func (s *RPCSource) GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*AccountResult, error) {
+	r := getProofRequest(blockNumber, addr, keys)
+	var result AccountResult
+	if err := s.call(r, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetProofs sends all the eth_getProof requests in one JSON-RPC batch.
+func (s *RPCSource) GetProofs(reqs []ProofRequest) ([]*AccountResult, error) {
+	rs := make([]jsonreq, len(reqs))
+	results := make([]*AccountResult, len(reqs))
+	ptrs := make([]interface{}, len(reqs))
+	for i, req := range reqs {
+		rs[i] = getProofRequest(req.BlockNumber, req.Address, req.Keys)
+		ptrs[i] = &results[i]
+	}
+	if err := s.callBatch(rs, ptrs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *RPCSource) GetCode(blockNumber *big.Int, addr common.Address) ([]byte, error) {
+	// curl -X POST --data '{"jsonrpc":"2.0","method":"eth_getCode","params":["0xa94f5374fce5edbc8e2a8697c15331677e6ebf0b", "0x2"],"id":1}'
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getCode", Id: 1}
+	r.Params = make([]interface{}, 2)
+	r.Params[0] = addr
+	r.Params[1] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	var code hexutil.Bytes
+	if err := s.call(r, &code); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+func (s *RPCSource) GetBlockByNumber(blockNumber *big.Int) (*Header, error) {
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getBlockByNumber", Id: 1}
+	r.Params = make([]interface{}, 2)
+	r.Params[0] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	r.Params[1] = true
+	var header Header
+	if err := s.call(r, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func (s *RPCSource) GetUncleByBlockNumberAndIndex(blockNumber *big.Int, index int) (*Header, error) {
+	r := jsonreq{Jsonrpc: "2.0", Method: "eth_getUncleByBlockNumberAndIndex", Id: 1}
+	r.Params = make([]interface{}, 2)
+	r.Params[0] = fmt.Sprintf("0x%x", blockNumber.Int64())
+	r.Params[1] = hexutil.Uint(index)
+	var header Header
+	if err := s.call(r, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// Preimage is not supported by the standard JSON-RPC API, nodes are obtained
+// through GetProof instead.
+func (s *RPCSource) Preimage(hash common.Hash) ([]byte, error) {
+	return nil, ErrNotFound
+}
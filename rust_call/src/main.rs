@@ -1,4 +1,4 @@
-// use serde_json::{json, Value};
+use serde_json::Value;
 use std::ffi::{CStr, CString};
 use std::os::raw::c_char;
 
@@ -21,5 +21,11 @@ fn main() {
     let result = unsafe { GetParallelProofs(c_config.as_ptr()) };
     let c_str = unsafe { CStr::from_ptr(result) };
     let string = c_str.to_str().expect("Error translating from library");
+
+    // On failure the library returns {"error":{"kind":...,"message":...}} instead of the witness.
+    let v: Value = serde_json::from_str(string).expect("invalid json returned");
+    if let Some(err) = v.get("error") {
+        panic!("witness generation failed ({}): {}", err["kind"], err["message"]);
+    }
     println!("{:?}", string);
 }
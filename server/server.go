@@ -0,0 +1,375 @@
+// Package server serves the witness generator over JSON-RPC 2.0 on HTTP, so that
+// the prover and other services can request witnesses without linking the
+// generator (see Server).
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/witness"
+)
+
+// DefaultMaxBlocks is the number of blocks whose oracles a Server keeps when no
+// number is given.
+const DefaultMaxBlocks = 16
+
+// maxRequestSize is the size limit of a request body.
+const maxRequestSize = 64 << 20
+
+// JSON-RPC error codes.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	// codeWitnessError is returned when the generation fails, the data holds the
+	// kind of the error (see witness.ErrorKind).
+	codeWitnessError = -32000
+)
+
+// Server is an http.Handler serving the JSON-RPC methods:
+//
+//	mpt_generateWitness  the witness of the modifications or of a whole block
+//	mpt_verifyWitness    checks the witness constraints (see witness.Verify)
+//	mpt_getProof         eth_getProof of the state of a block
+//
+// The parameters are given as one object (or an array holding it), see the
+// *Params types. The oracles (the preimages obtained from the source) of the
+// recently used blocks are shared between the requests, so the requests for a
+// block the server has seen don't query the source again.
+type Server struct {
+	src       oracle.NodeSource
+	maxBlocks int
+
+	lock    sync.Mutex
+	oracles map[int]*oracle.Oracle
+	recent  []int // blocks of the oracles, the most recently used last
+}
+
+// New returns a Server reading the state from src and keeping the oracles of
+// maxBlocks blocks (DefaultMaxBlocks if 0).
+func New(src oracle.NodeSource, maxBlocks int) *Server {
+	if maxBlocks <= 0 {
+		maxBlocks = DefaultMaxBlocks
+	}
+	return &Server{src: src, maxBlocks: maxBlocks, oracles: make(map[int]*oracle.Oracle)}
+}
+
+// oracle returns the oracle of the requests for the block.
+func (s *Server) oracle(block int) *oracle.Oracle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, b := range s.recent {
+		if b == block {
+			s.recent = append(append(s.recent[:i:i], s.recent[i+1:]...), block)
+			return s.oracles[block]
+		}
+	}
+	orc := oracle.NewOracle(s.src)
+	s.oracles[block] = orc
+	s.recent = append(s.recent, block)
+	if len(s.recent) > s.maxBlocks {
+		delete(s.oracles, s.recent[0])
+		s.recent = s.recent[1:]
+	}
+	return orc
+}
+
+type request struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	ID      json.RawMessage  `json:"id"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *oracle.RPCError `json:"error,omitempty"`
+}
+
+func errorResponse(id json.RawMessage, code int, err error) *response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &response{Jsonrpc: "2.0", ID: id, Error: &oracle.RPCError{Code: code, Message: err.Error()}}
+}
+
+// witnessError returns the error of a failed generation with its kind.
+func witnessError(id json.RawMessage, err error) *response {
+	resp := errorResponse(id, codeWitnessError, err)
+	resp.Error.Data, _ = json.Marshal(map[string]string{"kind": witness.ErrorKind(err)})
+	return resp
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests are sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var result interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []json.RawMessage
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			result = errorResponse(nil, codeParseError, err)
+		} else if len(reqs) == 0 {
+			result = errorResponse(nil, codeInvalidRequest, errors.New("empty batch"))
+		} else {
+			resps := make([]*response, len(reqs))
+			for i, req := range reqs {
+				resps[i] = s.handle(req)
+			}
+			result = resps
+		}
+	} else {
+		result = s.handle(body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) handle(input []byte) *response {
+	var req request
+	if err := json.Unmarshal(input, &req); err != nil {
+		return errorResponse(nil, codeParseError, err)
+	}
+	if req.Jsonrpc != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, codeInvalidRequest, errors.New("not a JSON-RPC 2.0 request"))
+	}
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "mpt_generateWitness":
+		var params GenerateWitnessParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return errorResponse(req.ID, codeInvalidParams, err)
+		}
+		result, err = s.generateWitness(&params)
+	case "mpt_verifyWitness":
+		var params VerifyWitnessParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return errorResponse(req.ID, codeInvalidParams, err)
+		}
+		result, err = verifyWitness(&params)
+	case "mpt_getProof":
+		var params GetProofParams
+		if err := decodeParams(req.Params, &params); err != nil {
+			return errorResponse(req.ID, codeInvalidParams, err)
+		}
+		result, err = s.getProof(&params)
+	default:
+		return errorResponse(req.ID, codeMethodNotFound, fmt.Errorf("method %s not found", req.Method))
+	}
+
+	var invalidParams *invalidParamsError
+	switch {
+	case errors.As(err, &invalidParams):
+		return errorResponse(req.ID, codeInvalidParams, err)
+	case err != nil:
+		return witnessError(req.ID, err)
+	}
+	return &response{Jsonrpc: "2.0", ID: req.ID, Result: result}
+}
+
+// invalidParamsError is returned by the methods for parameters that can't be used.
+type invalidParamsError struct {
+	msg string
+}
+
+func (err *invalidParamsError) Error() string {
+	return err.msg
+}
+
+func invalidParams(format string, a ...interface{}) error {
+	return &invalidParamsError{msg: fmt.Sprintf(format, a...)}
+}
+
+// decodeParams decodes the parameter object, given alone or as the only element
+// of the params array.
+func decodeParams(input json.RawMessage, params interface{}) error {
+	input = bytes.TrimSpace(input)
+	if len(input) > 0 && input[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(input, &list); err != nil {
+			return err
+		}
+		if len(list) != 1 {
+			return fmt.Errorf("expected one parameter object, got %d parameters", len(list))
+		}
+		input = list[0]
+	}
+	if len(input) == 0 {
+		return errors.New("missing parameters")
+	}
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.DisallowUnknownFields()
+	return dec.Decode(params)
+}
+
+// GenerateWitnessParams are the parameters of mpt_generateWitness: either the
+// modifications applied on the state of the block, or the whole block (its
+// state diffs applied on the state of the parent block) with the state diffs
+// from the source (FullBlock) or given in StateDiffs (a prestateTracer dump, see
+// oracle.ParseStateDiffs). Format is "matrix" (the default) or "witness" (the
+// versioned witness JSON).
+type GenerateWitnessParams struct {
+	Block         int                        `json:"block"`
+	Modifications []witness.TrieModification `json:"modifications,omitempty"`
+	FullBlock     bool                       `json:"full_block,omitempty"`
+	StateDiffs    json.RawMessage            `json:"state_diffs,omitempty"`
+	Format        string                     `json:"format,omitempty"`
+}
+
+// GenerateWitnessResult is the result of mpt_generateWitness, the modifications
+// are the ones of the block if the witness is of a whole block.
+type GenerateWitnessResult struct {
+	Witness       json.RawMessage            `json:"witness"`
+	Modifications []witness.TrieModification `json:"modifications"`
+}
+
+// stateDiffs is a DiffSource with the diffs of the block given in the request.
+type stateDiffs []*oracle.StateDiff
+
+func (d stateDiffs) BlockStateDiffs(blockNumber *big.Int) ([]*oracle.StateDiff, error) {
+	return d, nil
+}
+
+func (s *Server) generateWitness(params *GenerateWitnessParams) (*GenerateWitnessResult, error) {
+	if params.Block <= 0 {
+		return nil, invalidParams("invalid block %d", params.Block)
+	}
+	inputs := 0
+	for _, given := range []bool{len(params.Modifications) > 0, params.FullBlock, params.StateDiffs != nil} {
+		if given {
+			inputs++
+		}
+	}
+	if inputs != 1 {
+		return nil, invalidParams("one of modifications, full_block and state_diffs is needed")
+	}
+	if params.Format != "" && params.Format != "matrix" && params.Format != "witness" {
+		return nil, invalidParams("unknown format %q", params.Format)
+	}
+
+	orc := s.oracle(params.Block)
+	var proof [][]byte
+	mods := params.Modifications
+	var err error
+	switch {
+	case params.FullBlock:
+		diffs, ok := s.src.(oracle.DiffSource)
+		if !ok {
+			return nil, invalidParams("the source doesn't provide the state diffs")
+		}
+		proof, mods, err = witness.GetBlockProofsWithOracle(orc, diffs, params.Block, nil)
+	case params.StateDiffs != nil:
+		var diffs []*oracle.StateDiff
+		if diffs, err = oracle.ParseStateDiffs(params.StateDiffs); err != nil {
+			return nil, invalidParams("state_diffs: %v", err)
+		}
+		proof, mods, err = witness.GetBlockProofsWithOracle(orc, stateDiffs(diffs), params.Block, nil)
+	default:
+		proof, err = witness.GetParallelProofsWithOracle(orc, params.Block, mods)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GenerateWitnessResult{Witness: json.RawMessage(witness.MatrixToJson(proof)), Modifications: mods}
+	if params.Format == "witness" {
+		w, err := witness.WitnessFromMatrix(proof)
+		if err != nil {
+			return nil, err
+		}
+		if result.Witness, err = json.Marshal(w); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// VerifyWitnessParams are the parameters of mpt_verifyWitness: the witness (the
+// matrix or the versioned witness JSON) and its modifications, without them
+// the checks of the new values are skipped.
+type VerifyWitnessParams struct {
+	Witness       json.RawMessage            `json:"witness"`
+	Modifications []witness.TrieModification `json:"modifications,omitempty"`
+}
+
+// VerifyWitnessResult is the result of mpt_verifyWitness, Row is the row of the
+// first failed check.
+type VerifyWitnessResult struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	Row   *int   `json:"row,omitempty"`
+}
+
+func verifyWitness(params *VerifyWitnessParams) (*VerifyWitnessResult, error) {
+	if params.Witness == nil {
+		return nil, invalidParams("missing witness")
+	}
+	w, err := witness.ParseWitness(params.Witness)
+	if err != nil {
+		return nil, invalidParams("witness: %v", err)
+	}
+	err = w.Verify(params.Modifications)
+	if err == nil {
+		return &VerifyWitnessResult{Valid: true}, nil
+	}
+	result := &VerifyWitnessResult{Error: err.Error()}
+	var invalid *witness.InvalidWitnessError
+	if errors.As(err, &invalid) {
+		row := invalid.Row
+		result.Row = &row
+	}
+	return result, nil
+}
+
+// GetProofParams are the parameters of mpt_getProof, the storage keys are hex
+// numbers of up to 32 bytes (as in eth_getProof).
+type GetProofParams struct {
+	Block   int            `json:"block"`
+	Address common.Address `json:"address"`
+	Keys    []string       `json:"keys,omitempty"`
+}
+
+func (s *Server) getProof(params *GetProofParams) (*oracle.AccountResult, error) {
+	if params.Block < 0 {
+		return nil, invalidParams("invalid block %d", params.Block)
+	}
+	keys := make([]common.Hash, len(params.Keys))
+	for i, key := range params.Keys {
+		digits := strings.TrimPrefix(strings.TrimPrefix(key, "0x"), "0X")
+		if len(digits)%2 == 1 {
+			digits = "0" + digits
+		}
+		b, err := hex.DecodeString(digits)
+		if err != nil || len(b) == 0 || len(b) > common.HashLength {
+			return nil, invalidParams("invalid storage key %q", key)
+		}
+		keys[i] = common.BytesToHash(b)
+	}
+	return s.oracle(params.Block).Proof(big.NewInt(int64(params.Block)), params.Address, keys)
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/miha-stopar/mpt/internal/oracletest"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/witness"
+)
+
+var (
+	testAddr = common.HexToAddress("0x50efbf12580138bc263c95757826df4e24eb81c9")
+	testKey  = common.HexToHash("0x12")
+)
+
+// testSource returns the state of block 1 with testAddr and a few other accounts.
+func testSource(t *testing.T) *oracletest.CountingSource {
+	alloc := oracle.GenesisAlloc{
+		testAddr: {Balance: math.NewHexOrDecimal256(1000), Storage: map[common.Hash]common.Hash{
+			testKey: common.HexToHash("0x1"),
+		}},
+	}
+	for i := 0; i < 16; i++ {
+		alloc[common.BigToAddress(big.NewInt(int64(0x1000+i)))] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(1)}
+	}
+	src, err := alloc.Source(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oracletest.NewCountingSource(src)
+}
+
+type testResponse struct {
+	ID     int              `json:"id"`
+	Result json.RawMessage  `json:"result"`
+	Error  *oracle.RPCError `json:"error"`
+}
+
+func post(t *testing.T, url string, body string) []byte {
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// call calls the method and decodes its result into result, it returns the error
+// of the response.
+func call(t *testing.T, url string, method string, params interface{}, result interface{}) *oracle.RPCError {
+	p, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":[%s]}`, method, p)
+	var resp testResponse
+	if err := json.Unmarshal(post(t, url, body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestGenerateAndVerifyWitness(t *testing.T) {
+	src := testSource(t)
+	ts := httptest.NewServer(New(src, 0))
+	defer ts.Close()
+
+	mods := []witness.TrieModification{
+		{Type: witness.StorageMod, Address: testAddr, Key: testKey, Value: common.HexToHash("0x2")},
+		{Type: witness.BalanceMod, Address: testAddr, Balance: big.NewInt(7)},
+	}
+	proofs := 0
+	for i, format := range []string{"", "witness"} {
+		var gen GenerateWitnessResult
+		if err := call(t, ts.URL, "mpt_generateWitness", GenerateWitnessParams{Block: 1, Modifications: mods, Format: format}, &gen); err != nil {
+			t.Fatal(err)
+		}
+		// The preimages of the block are kept between the requests.
+		if i == 0 {
+			proofs = src.TotalCalls()
+		} else if src.TotalCalls() != proofs {
+			t.Errorf("the proofs were fetched again, %d eth_getProof calls", src.TotalCalls()-proofs)
+		}
+		if !reflect.DeepEqual(gen.Modifications, mods) {
+			t.Errorf("got modifications %+v", gen.Modifications)
+		}
+		w, err := witness.ParseWitness(gen.Witness)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Verify(mods); err != nil {
+			t.Fatal(err)
+		}
+
+		var result VerifyWitnessResult
+		if err := call(t, ts.URL, "mpt_verifyWitness", VerifyWitnessParams{Witness: gen.Witness, Modifications: mods}, &result); err != nil {
+			t.Fatal(err)
+		}
+		if !result.Valid {
+			t.Errorf("witness invalid: %s", result.Error)
+		}
+
+		// The witness doesn't prove other new values.
+		other := []witness.TrieModification{mods[0], {Type: witness.BalanceMod, Address: testAddr, Balance: big.NewInt(8)}}
+		result = VerifyWitnessResult{}
+		if err := call(t, ts.URL, "mpt_verifyWitness", VerifyWitnessParams{Witness: gen.Witness, Modifications: other}, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Valid || result.Row == nil {
+			t.Errorf("expected the witness to be invalid at a row, got %+v", result)
+		}
+	}
+}
+
+func TestGenerateBlockWitness(t *testing.T) {
+	// The state of block 1 is the state after the diffs in trace_block_1.json
+	// applied on the empty state of block 0.
+	src := oracle.NewMemorySource()
+	src.AddHeader(oracle.NewHeader(0, common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")))
+	postState := oracle.GenesisAlloc{
+		testAddr: {Balance: math.NewHexOrDecimal256(90), Storage: map[common.Hash]common.Hash{
+			testKey:                  common.HexToHash("0x3"),
+			common.HexToHash("0x21"): common.HexToHash("0x2"),
+		}},
+		common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab"): {Balance: math.NewHexOrDecimal256(10), Nonce: 1},
+	}
+	if err := postState.AddToSource(src, 1); err != nil {
+		t.Fatal(err)
+	}
+	trace, err := ioutil.ReadFile("../witness/testdata/trace_block_1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(src, 0))
+	defer ts.Close()
+
+	var gen GenerateWitnessResult
+	if err := call(t, ts.URL, "mpt_generateWitness", GenerateWitnessParams{Block: 1, StateDiffs: trace}, &gen); err != nil {
+		t.Fatal(err)
+	}
+	want, err := witness.ParseStateDiffModifications(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gen.Modifications, want) {
+		t.Fatalf("got modifications\n%+v\nwant\n%+v", gen.Modifications, want)
+	}
+	w, err := witness.ParseWitness(gen.Witness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(gen.Modifications); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source has no state diffs of the block.
+	if err := call(t, ts.URL, "mpt_generateWitness", GenerateWitnessParams{Block: 1, FullBlock: true}, &gen); err == nil {
+		t.Error("no error without the state diffs")
+	}
+}
+
+func TestGetProof(t *testing.T) {
+	src := testSource(t)
+	ts := httptest.NewServer(New(src, 0))
+	defer ts.Close()
+
+	keys := []common.Hash{testKey, common.HexToHash("0x2")}
+	want, err := src.MemorySource.GetProof(big.NewInt(1), testAddr, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got json.RawMessage
+	if err := call(t, ts.URL, "mpt_getProof", GetProofParams{Block: 1, Address: testAddr, Keys: []string{"0x12", keys[1].Hex()}}, &got); err != nil {
+		t.Fatal(err)
+	}
+	wantJson, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, wantJson) {
+		t.Fatalf("got proof\n%s\nwant\n%s", got, wantJson)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := httptest.NewServer(New(testSource(t), 0))
+	defer ts.Close()
+
+	mod := `{"type": "storage", "address": "0x50efbf12580138bc263c95757826df4e24eb81c9", "key": "0x12", "value": "0x2"}`
+	tests := []struct {
+		body string
+		code int
+		kind string
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness"`, codeParseError, ""},
+		{`{"id":1,"method":"mpt_generateWitness","params":[]}`, codeInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_unknown","params":[]}`, codeMethodNotFound, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness","params":[]}`, codeInvalidParams, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness","params":{"block":1,"modifications":[` + mod + `],"full_block":true}}`, codeInvalidParams, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness","params":{"block":1,"modifications":[` + mod + `],"fromat":"witness"}}`, codeInvalidParams, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness","params":{"block":1,"modifications":[{"type":"storage"}]}}`, codeInvalidParams, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_generateWitness","params":{"block":2,"modifications":[` + mod + `]}}`, codeWitnessError, witness.ErrKindMissingNode},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_verifyWitness","params":{"witness":{}}}`, codeInvalidParams, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"mpt_getProof","params":{"block":1,"address":"0x50efbf12580138bc263c95757826df4e24eb81c9","keys":["0xz1"]}}`, codeInvalidParams, ""},
+	}
+	for _, test := range tests {
+		var resp testResponse
+		if err := json.Unmarshal(post(t, ts.URL, test.body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("expected error code %d for %s, got %+v", test.code, test.body, resp.Error)
+			continue
+		}
+		if test.kind != "" {
+			var data struct{ Kind string }
+			if err := json.Unmarshal(resp.Error.Data, &data); err != nil || data.Kind != test.kind {
+				t.Errorf("expected error kind %s for %s, got %s", test.kind, test.body, resp.Error.Data)
+			}
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ts := httptest.NewServer(New(testSource(t), 0))
+	defer ts.Close()
+
+	body := `[
+		{"jsonrpc":"2.0","id":1,"method":"mpt_getProof","params":[{"block":1,"address":"0x50efbf12580138bc263c95757826df4e24eb81c9"}]},
+		{"jsonrpc":"2.0","id":2,"method":"mpt_unknown","params":[]}
+	]`
+	var resps []testResponse
+	if err := json.Unmarshal(post(t, ts.URL, body), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 2 || resps[0].ID != 1 || resps[0].Error != nil || resps[1].ID != 2 || resps[1].Error == nil {
+		t.Fatalf("unexpected batch response %+v", resps)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	srv := New(testSource(t), 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mods := []witness.TrieModification{
+				{Type: witness.StorageMod, Address: testAddr, Key: testKey, Value: common.BigToHash(big.NewInt(int64(i + 2)))},
+			}
+			result, err := srv.generateWitness(&GenerateWitnessParams{Block: 1, Modifications: mods})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w, err := witness.ParseWitness(result.Witness)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := w.Verify(mods); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestOracleEviction(t *testing.T) {
+	srv := New(testSource(t), 2)
+	orc1 := srv.oracle(1)
+	srv.oracle(2)
+	if srv.oracle(1) != orc1 {
+		t.Fatal("oracle of block 1 not kept")
+	}
+	srv.oracle(3)
+	if _, ok := srv.oracles[2]; ok {
+		t.Error("oracle of the least recently used block 2 not evicted")
+	}
+	if srv.oracle(1) != orc1 {
+		t.Error("oracle of block 1 evicted")
+	}
+}
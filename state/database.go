@@ -18,27 +18,36 @@ type Database struct {
 	db          *trie.Database
 	BlockNumber *big.Int
 	StateRoot   common.Hash
+	Oracle      *oracle.Oracle
 }
 
-func NewDatabase(header types.Header) Database {
+// NewDatabase returns the state database of the block with the given header. All
+// the state is obtained from (and cached in) orc.
+func NewDatabase(header types.Header, orc *oracle.Oracle) (Database, error) {
 	//triedb := trie.Database{BlockNumber: header.Number, Root: header.Root}
 	//triedb.Preseed()
-	triedb := trie.NewDatabase(header)
-	return Database{db: &triedb, BlockNumber: header.Number, StateRoot: header.Root}
+	triedb, err := trie.NewDatabase(header, orc)
+	if err != nil {
+		return Database{}, err
+	}
+	return Database{db: triedb, BlockNumber: header.Number, StateRoot: header.Root, Oracle: orc}, nil
 }
 
 // ContractCode retrieves a particular contract's code.
 func (db *Database) ContractCode(addrHash common.Hash, codeHash common.Hash) ([]byte, error) {
-	oracle.PrefetchCode(db.BlockNumber, addrHash)
-	code := oracle.Preimage(codeHash)
-	return code, nil
+	if err := db.Oracle.PrefetchCode(db.BlockNumber, addrHash); err != nil {
+		return nil, err
+	}
+	return db.Oracle.Preimage(codeHash)
 }
 
 // ContractCodeSize retrieves a particular contracts code's size.
 func (db *Database) ContractCodeSize(addrHash common.Hash, codeHash common.Hash) (int, error) {
-	oracle.PrefetchCode(db.BlockNumber, addrHash)
-	code := oracle.Preimage(codeHash)
-	return len(code), nil
+	if err := db.Oracle.PrefetchCode(db.BlockNumber, addrHash); err != nil {
+		return 0, err
+	}
+	code, err := db.Oracle.Preimage(codeHash)
+	return len(code), err
 }
 
 func (db *Database) CopyTrie(t Trie) Trie {
@@ -96,10 +105,14 @@ type Trie interface {
 
 	Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) ([]byte, [][]byte, error)
 
+	// ResolveNeighbour returns the RLP of the neighbour node returned by Prove
+	// (resolved from the database if Prove returned its hash).
+	ResolveNeighbour(neighbourNode []byte) ([]byte, error)
+
 	GetNodeByNibbles(key []byte) ([]byte, error)
 }
 
-// stubbed: we don't prefetch
+// stubbed: the proofs are prefetched by the oracle (see oracle.Oracle.Prefetch)
 
 type triePrefetcher struct {
 }
@@ -116,6 +116,10 @@ type (
 		account            *common.Address
 		prevcode, prevhash []byte
 	}
+	storageRootChange struct {
+		account *common.Address
+		prev    common.Hash
+	}
 
 	// Changes to other state values.
 	refundChange struct {
@@ -197,6 +201,14 @@ func (ch nonceChange) dirtied() *common.Address {
 	return ch.account
 }
 
+func (ch storageRootChange) revert(s *StateDB) {
+	s.getStateObject(*ch.account).setStorageRoot(ch.prev)
+}
+
+func (ch storageRootChange) dirtied() *common.Address {
+	return ch.account
+}
+
 func (ch codeChange) revert(s *StateDB) {
 	s.getStateObject(*ch.account).setCode(common.BytesToHash(ch.prevhash), ch.prevcode)
 }
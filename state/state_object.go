@@ -27,7 +27,6 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/miha-stopar/mpt/oracle"
 	"github.com/miha-stopar/mpt/trie"
 )
 
@@ -249,7 +248,10 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 		if metrics.EnabledExpensive {
 			meter = &s.db.StorageReads
 		}
-		oracle.PrefetchStorage(db.BlockNumber, s.address, key, nil)
+		if _, err = db.Oracle.PrefetchStorage(db.BlockNumber, s.address, key, nil); err != nil {
+			s.db.setError(err)
+			return common.Hash{}
+		}
 		if enc, err = s.getTrie(db).TryGet(key.Bytes()); err != nil {
 			s.setError(err)
 			return common.Hash{}
@@ -358,7 +360,9 @@ func (s *stateObject) updateTrie(db Database) Trie {
 		if (value == common.Hash{}) {
 			//fmt.Println("delete", s.address, key)
 			// Get absense proof of key in case the deletion needs the sister node.
-			oracle.PrefetchStorage(big.NewInt(db.BlockNumber.Int64()+1), s.address, key, trie.GenPossibleShortNodePreimage)
+			if _, err := db.Oracle.PrefetchStorage(big.NewInt(db.BlockNumber.Int64()+1), s.address, key, trie.GenPossibleShortNodePreimage); err != nil {
+				s.db.setError(err)
+			}
 			s.setError(tr.TryDelete(key[:]))
 		} else {
 			//fmt.Println("update", s.address, key, value)
@@ -530,6 +534,23 @@ func (s *stateObject) setCode(codeHash common.Hash, code []byte) {
 	s.dirtyCode = true
 }
 
+func (s *stateObject) SetStorageRoot(root common.Hash) {
+	s.db.journal.append(storageRootChange{
+		account: &s.address,
+		prev:    s.data.Root,
+	})
+	s.setStorageRoot(root)
+}
+
+// setStorageRoot drops the cached storage, it is read from the trie with the new root.
+func (s *stateObject) setStorageRoot(root common.Hash) {
+	s.data.Root = root
+	s.Trie = nil
+	s.originStorage = make(Storage)
+	s.pendingStorage = make(Storage)
+	s.dirtyStorage = make(Storage)
+}
+
 func (s *stateObject) SetNonce(nonce uint64) {
 	s.db.journal.append(nonceChange{
 		account: &s.address,
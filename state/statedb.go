@@ -32,7 +32,6 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/miha-stopar/mpt/oracle"
 	"github.com/miha-stopar/mpt/trie"
 )
 
@@ -315,6 +314,13 @@ func (s *StateDB) GetStorageProof(a common.Address, key common.Hash) ([][]byte,
 	return proof, neighbourNode, extNibbles, err
 }
 
+// ResolveNeighbour returns the RLP of the neighbour node returned by GetProof or
+// GetStorageProof, which is only a hash if the node hasn't been loaded from the
+// database yet. The account and the storage tries share the database.
+func (s *StateDB) ResolveNeighbour(neighbourNode []byte) ([]byte, error) {
+	return s.trie.ResolveNeighbour(neighbourNode)
+}
+
 func (s *StateDB) GetNodeByNibbles(a common.Address, key []byte) ([]byte, error) {
 	trie := s.StorageTrie(a)
 	return trie.GetNodeByNibbles(key)
@@ -408,6 +414,16 @@ func (s *StateDB) SetState(addr common.Address, key, value common.Hash) {
 	}
 }
 
+// SetStorageRoot sets the storage root of the account, the storage is then read
+// from the trie with the given root. Added for MPT generator.
+func (s *StateDB) SetStorageRoot(addr common.Address, root common.Hash) {
+	s.SetStateObjectIfExists(addr)
+	stateObject := s.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetStorageRoot(root)
+	}
+}
+
 // SetStorage replaces the entire storage for the specified account with given
 // storage. This function should only be used for debugging.
 func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common.Hash) {
@@ -424,7 +440,11 @@ func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common
 // is populated only with the objects that are created locally.
 func (s *StateDB) SetStateObjectIfExists(addr common.Address) {
 	if s.loadRemoteAccountsIntoStateObjects {
-		ap := oracle.PrefetchAccount(s.Db.BlockNumber, addr, nil)
+		ap, err := s.Db.Oracle.PrefetchAccount(s.Db.BlockNumber, addr, nil)
+		if err != nil {
+			s.setError(err)
+			return
+		}
 		if len(ap) > 0 {
 			ret, _ := hex.DecodeString(ap[len(ap)-1][2:])
 			s.setStateObjectFromEncoding(addr, ret)
@@ -482,7 +502,7 @@ func (s *StateDB) updateStateObject(obj *stateObject) {
 		panic(fmt.Errorf("can't encode object at %x: %v", addr[:], err))
 	}
 	if err = s.trie.TryUpdate(addr[:], data); err != nil {
-		s.setError(fmt.Errorf("updateStateObject (%x) error: %v", addr[:], err))
+		s.setError(fmt.Errorf("updateStateObject (%x) error: %w", addr[:], err))
 	}
 
 	// If state snapshotting is active, cache the data til commit. Note, this
@@ -503,9 +523,12 @@ func (s *StateDB) deleteStateObject(obj *stateObject) {
 	// Delete the account from the trie
 	addr := obj.Address()
 	// Get absense proof of account in case the deletion needs the sister node.
-	oracle.PrefetchAccount(big.NewInt(s.Db.BlockNumber.Int64()+1), addr, trie.GenPossibleShortNodePreimage)
+	if _, err := s.Db.Oracle.PrefetchAccount(big.NewInt(s.Db.BlockNumber.Int64()+1), addr, trie.GenPossibleShortNodePreimage); err != nil {
+		s.setError(fmt.Errorf("deleteStateObject (%x) error: %w", addr[:], err))
+		return
+	}
 	if err := s.trie.TryDelete(addr[:]); err != nil {
-		s.setError(fmt.Errorf("deleteStateObject (%x) error: %v", addr[:], err))
+		s.setError(fmt.Errorf("deleteStateObject (%x) error: %w", addr[:], err))
 	}
 }
 
@@ -561,10 +584,13 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		if metrics.EnabledExpensive {
 			defer func(start time.Time) { s.AccountReads += time.Since(start) }(time.Now())
 		}
-		oracle.PrefetchAccount(s.Db.BlockNumber, addr, nil)
+		if _, err := s.Db.Oracle.PrefetchAccount(s.Db.BlockNumber, addr, nil); err != nil {
+			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %w", addr.Bytes(), err))
+			return nil
+		}
 		enc, err := s.trie.TryGet(addr.Bytes())
 		if err != nil {
-			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %v", addr.Bytes(), err))
+			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %w", addr.Bytes(), err))
 			return nil
 		}
 		if len(enc) == 0 {
@@ -595,7 +621,6 @@ func (s *StateDB) setStateObjectFromEncoding(addr common.Address, enc []byte) er
 	if err := rlp.DecodeBytes(accData, data); err != nil {
 		// If it's not account RLP, nothing is set (in stateObjects) - this is to prevent
 		// the need of checking whether enc is account RLP or something else (like branch RLP).
-		fmt.Println("failed to decode account")
 		return nil
 	}
 
@@ -686,7 +711,6 @@ func (db *StateDB) ForEachStorage(addr common.Address, cb func(key, value common
 			}
 		}
 	}*/
-	fmt.Println("ForEachStorage is BROKEN!!")
 	return nil
 }
 
@@ -952,11 +976,6 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 
 	for addr := range s.stateObjectsDirty {
 		if obj := s.stateObjects[addr]; !obj.deleted {
-			fmt.Println("dirty state object", addr)
-			// Write any contract code associated with the state object
-			if obj.code != nil && obj.dirtyCode {
-				fmt.Println("write code", common.BytesToHash(obj.CodeHash()))
-			}
 			// Write any storage changes in the state object to its storage trie
 			if err := obj.CommitTrie(s.Db); err != nil {
 				return common.Hash{}, err
@@ -2,6 +2,7 @@ package trie
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math/big"
 	"sync"
@@ -29,17 +30,20 @@ func (n rawNode) EncodeRLP(w io.Writer) error {
 type Database struct {
 	BlockNumber *big.Int
 	Root        common.Hash
+	Oracle      *oracle.Oracle
 	lock        sync.RWMutex
 }
 
-func NewDatabase(header types.Header) Database {
-	triedb := Database{BlockNumber: header.Number, Root: header.Root}
+func NewDatabase(header types.Header, orc *oracle.Oracle) (*Database, error) {
+	triedb := &Database{BlockNumber: header.Number, Root: header.Root, Oracle: orc}
 	//triedb.preimages = make(map[common.Hash][]byte)
 	//fmt.Println("init database")
-	oracle.PrefetchAccount(header.Number, common.Address{}, nil)
+	if _, err := orc.PrefetchAccount(header.Number, common.Address{}, nil); err != nil {
+		return nil, err
+	}
 
 	//panic("preseed")
-	return triedb
+	return triedb, nil
 }
 
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
@@ -48,14 +52,19 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	panic("no Node function")
 }
 
-// node retrieves a cached trie node from memory, or returns nil if none can be
-// found in the memory cache.
-func (db *Database) node(hash common.Hash) Node {
+// node retrieves a trie node from the oracle, or returns nil if the oracle doesn't
+// have it (the caller reports it as MissingNodeError). The other oracle errors
+// (a corrupt preimage, a failed source request) are returned as they are.
+func (db *Database) node(hash common.Hash) (Node, error) {
 	//fmt.Println("node", hash)
-	if val := oracle.Preimage(hash); val != nil {
-		return mustDecodeNode(hash[:], val)
+	val, err := db.Oracle.Preimage(hash)
+	var missing *oracle.MissingPreimageError
+	if errors.As(err, &missing) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return nil
+	return DecodeNode(hash[:], val)
 }
 
 // insert inserts a collapsed trie node into the memory database.
@@ -16,8 +16,6 @@
 
 package trie
 
-import "fmt"
-
 // Trie keys are dealt with in three distinct encodings:
 //
 // KEYBYTES encoding contains the actual key and nothing else. This encoding is the
@@ -41,8 +39,6 @@ func hexToCompact(hex []byte) []byte {
 	if hasTerm(hex) {
 		terminator = 1
 		hex = hex[:len(hex)-1]
-	} else {
-		fmt.Println("extension" )
 	}
 
 	buf := make([]byte, len(hex)/2+1)
@@ -126,6 +126,25 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) (
 	return neighbourNodeRLP, extNibbles, nil
 }
 
+// ResolveNeighbour returns the RLP of the neighbour node returned by Prove. The
+// neighbour node of a trie loaded from the database is not resolved yet, Prove
+// returns its hash, which is resolved here. The neighbour is only needed when the
+// proved key is deleted and the branch turns into the neighbour.
+func (t *Trie) ResolveNeighbour(neighbourNode []byte) ([]byte, error) {
+	if len(neighbourNode) != 1+common.HashLength || neighbourNode[0] != 0x80+common.HashLength {
+		// Not a hash (a list is the RLP of a node).
+		return neighbourNode, nil
+	}
+	n, err := t.resolveHash(HashNode(neighbourNode[1:]), nil)
+	if err != nil {
+		return nil, err
+	}
+	hasher := NewHasher(false)
+	defer returnHasherToPool(hasher)
+	collapsed, _ := hasher.ProofHash(n)
+	return rlp.EncodeToBytes(collapsed)
+}
+
 func (t *Trie) GetNodeByNibbles(key []byte) ([]byte, error) {
 	tn := t.root
 	// var node Node
@@ -175,6 +194,10 @@ func (t *SecureTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWri
 	return t.trie.Prove(key, fromLevel, proofDb)
 }
 
+func (t *SecureTrie) ResolveNeighbour(neighbourNode []byte) ([]byte, error) {
+	return t.trie.ResolveNeighbour(neighbourNode)
+}
+
 func (t *SecureTrie) GetNodeByNibbles(key []byte) ([]byte, error) {
 	return t.trie.GetNodeByNibbles(key)
 }
@@ -310,10 +310,6 @@ func (t *Trie) insert(n Node, prefix, key []byte, value Node) (bool, Node, error
 		}
 		// Otherwise, replace it with a short node leading up to the branch.
 		// (this is extension node)
-		if matchlen > 2 {
-			fmt.Println(matchlen)
-			fmt.Println("====")
-		}
 		return true, &ShortNode{key[:matchlen], branch, t.newFlag()}, nil
 
 	case *FullNode:
@@ -473,7 +469,6 @@ func (t *Trie) delete(n Node, prefix, key []byte) (bool, Node, error) {
 		return false, nil, nil
 
 	case HashNode:
-		fmt.Println("delete hashNode", prefix, key)
 		// We've hit a part of the trie that isn't loaded yet. Load
 		// the node and delete from it. This leaves all child nodes on
 		// the path to the value in the trie.
@@ -508,7 +503,11 @@ func (t *Trie) resolve(n Node, prefix []byte) (Node, error) {
 
 func (t *Trie) resolveHash(n HashNode, prefix []byte) (Node, error) {
 	hash := common.BytesToHash(n)
-	if node := t.db.node(hash); node != nil {
+	node, err := t.db.node(hash)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
 		return node, nil
 	}
 	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
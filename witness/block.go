@@ -0,0 +1,241 @@
+package witness
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// accountChange is the change of an account over all the transactions of a block.
+type accountChange struct {
+	pre       *oracle.DiffAccount // state before the block, nil if the account didn't exist
+	post      oracle.DiffAccount  // fields changed by the block
+	deleted   bool                // the account doesn't exist after the block
+	recreated bool                // the account was deleted and created again
+}
+
+// mergeStateDiffs merges the transaction diffs into the change of each account
+// over the whole block.
+func mergeStateDiffs(diffs []*oracle.StateDiff) map[common.Address]*accountChange {
+	changes := make(map[common.Address]*accountChange)
+	for _, diff := range diffs {
+		for addr, pre := range diff.Pre {
+			c, ok := changes[addr]
+			if !ok {
+				c = &accountChange{pre: &oracle.DiffAccount{Storage: make(map[common.Hash]common.Hash)}}
+				changes[addr] = c
+			}
+			// Values before the block are the values before the first transaction
+			// changing them.
+			if c.pre != nil && !c.recreated {
+				if c.pre.Balance == nil && c.post.Balance == nil {
+					c.pre.Balance = pre.Balance
+				}
+				if c.pre.Nonce == nil && c.post.Nonce == nil {
+					c.pre.Nonce = pre.Nonce
+				}
+				if c.pre.Code == nil && c.post.Code == nil {
+					c.pre.Code = pre.Code
+				}
+				for key, value := range pre.Storage {
+					_, inPre := c.pre.Storage[key]
+					_, inPost := c.post.Storage[key]
+					if !inPre && !inPost {
+						c.pre.Storage[key] = value
+					}
+				}
+			}
+			if _, ok := diff.Post[addr]; !ok {
+				c.deleted = true
+				c.post = oracle.DiffAccount{}
+			}
+		}
+		for addr, post := range diff.Post {
+			c, ok := changes[addr]
+			if !ok {
+				c = &accountChange{}
+				changes[addr] = c
+			}
+			if c.deleted {
+				c.deleted = false
+				c.recreated = c.pre != nil
+			}
+			if post.Balance != nil {
+				c.post.Balance = post.Balance
+			}
+			if post.Nonce != nil {
+				c.post.Nonce = post.Nonce
+			}
+			if post.Code != nil {
+				c.post.Code = post.Code
+			}
+			if c.post.Storage == nil {
+				c.post.Storage = make(map[common.Hash]common.Hash)
+			}
+			for key, value := range post.Storage {
+				c.post.Storage[key] = value
+			}
+			if pre := diff.Pre[addr]; pre != nil {
+				for key := range pre.Storage {
+					if _, ok := post.Storage[key]; !ok {
+						c.post.Storage[key] = common.Hash{}
+					}
+				}
+			}
+		}
+	}
+
+	return changes
+}
+
+// ModificationsFromStateDiffs returns the modifications that turn the state before
+// the transactions into the state after them. The accounts are ordered by address,
+// for each account the modifications are: DeleteAccount (if the account is deleted),
+// CreateAccount (if created), AccountMod with the changed nonce, balance and code,
+// and StorageMod for each changed slot ordered by key.
+func ModificationsFromStateDiffs(diffs []*oracle.StateDiff) []TrieModification {
+	changes := mergeStateDiffs(diffs)
+	addrs := make([]common.Address, 0, len(changes))
+	for addr := range changes {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+
+	var mods []TrieModification
+	for _, addr := range addrs {
+		c := changes[addr]
+		pre := c.pre
+		if pre != nil && (c.deleted || c.recreated) {
+			mods = append(mods, TrieModification{Type: DeleteAccount, Address: addr})
+			pre = nil
+		}
+		if c.deleted {
+			continue
+		}
+		if pre == nil {
+			mods = append(mods, TrieModification{Type: CreateAccount, Address: addr})
+			pre = &oracle.DiffAccount{}
+		}
+
+		post := c.post
+		update := &AccountUpdate{}
+		if post.Nonce != nil {
+			var nonce uint64
+			if pre.Nonce != nil {
+				nonce = *pre.Nonce
+			}
+			if nonce != *post.Nonce {
+				n := *post.Nonce
+				update.Nonce = &n
+			}
+		}
+		if post.Balance != nil {
+			balance := new(big.Int)
+			if pre.Balance != nil {
+				balance = pre.Balance.ToInt()
+			}
+			if balance.Cmp(post.Balance.ToInt()) != 0 {
+				update.Balance = new(big.Int).Set(post.Balance.ToInt())
+			}
+		}
+		if post.Code != nil && !bytes.Equal(pre.Code, post.Code) {
+			update.CodeHash = common.CopyBytes(post.Code)
+		}
+		if update.fields() != 0 {
+			mods = append(mods, TrieModification{Type: AccountMod, Address: addr, Account: update})
+		}
+
+		keys := make([]common.Hash, 0, len(post.Storage))
+		for key := range post.Storage {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i][:], keys[j][:]) < 0
+		})
+		for _, key := range keys {
+			if pre.Storage[key] != post.Storage[key] {
+				mods = append(mods, TrieModification{Type: StorageMod, Address: addr, Key: key, Value: post.Storage[key]})
+			}
+		}
+	}
+
+	return mods
+}
+
+// ParseStateDiffModifications returns the modifications (see
+// ModificationsFromStateDiffs) of the prestateTracer state diffs in data, a
+// debug_traceBlockByNumber dump or the diff of one transaction (see
+// oracle.ParseStateDiffs).
+func ParseStateDiffModifications(data []byte) ([]TrieModification, error) {
+	diffs, err := oracle.ParseStateDiffs(data)
+	if err != nil {
+		return nil, err
+	}
+	return ModificationsFromStateDiffs(diffs), nil
+}
+
+// GetBlockProofs generates the witness for all the state changes of the block: the
+// modifications are derived from the state diffs of the block transactions (see
+// ModificationsFromStateDiffs) and applied on the state of the parent block.
+// The state root after the modifications must be the state root in the block
+// header, otherwise a StateRootMismatchError with the first account (and slot)
+// that differs is returned. The state diffs don't include the block and uncle
+// rewards, they are appended as BalanceMods (see blockRewards) according to the
+// chain config, nil means mainnet. The modifications are returned too (they are
+// needed to verify the witness).
+func GetBlockProofs(src oracle.NodeSource, diffs oracle.DiffSource, blockNum int, config *params.ChainConfig) ([][]byte, []TrieModification, error) {
+	return GetBlockProofsWithOracle(oracle.NewOracle(src), diffs, blockNum, config)
+}
+
+// GetBlockProofsWithOracle is like GetBlockProofs, but the state is obtained
+// through orc (see GetParallelProofsWithOracle).
+func GetBlockProofsWithOracle(orc *oracle.Oracle, diffs oracle.DiffSource, blockNum int, config *params.ChainConfig) ([][]byte, []TrieModification, error) {
+	if config == nil {
+		config = params.MainnetChainConfig
+	}
+	txDiffs, err := diffs.BlockStateDiffs(big.NewInt(int64(blockNum)))
+	if err != nil {
+		return nil, nil, &oracle.SourceError{Method: "debug_traceBlockByNumber", Err: err}
+	}
+	trieModifications := ModificationsFromStateDiffs(txDiffs)
+
+	statedb, err := newStateDB(orc, blockNum-1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	src := orc.Source()
+	block, err := src.GetBlockByNumber(big.NewInt(int64(blockNum)))
+	if err != nil {
+		return nil, nil, &oracle.SourceError{Method: "eth_getBlockByNumber", Err: err}
+	}
+	uncles, err := blockUncles(src, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := block.ToHeader()
+	trieModifications = appendRewards(trieModifications, blockRewards(config, &header, uncles), statedb.GetBalance)
+
+	if err := prefetchProofs(trieModifications, statedb); err != nil {
+		return nil, nil, err
+	}
+	if err := loadStorage(trieModifications, statedb); err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := getParallelProofs(trieModifications, statedb)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkStateRoot(orc.Source(), statedb, blockNum, trieModifications); err != nil {
+		return nil, nil, err
+	}
+
+	return proof, trieModifications, nil
+}
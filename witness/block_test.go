@@ -0,0 +1,284 @@
+package witness
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// testHeader returns a header with all the fields eth_getBlockByNumber returns set.
+func testHeader(number int64, root common.Hash) *oracle.Header {
+	return oracle.NewHeader(uint64(number), root)
+}
+
+func diffBalance(b int64) *hexutil.Big {
+	return (*hexutil.Big)(big.NewInt(b))
+}
+
+func diffNonce(n uint64) *uint64 {
+	return &n
+}
+
+func TestModificationsFromStateDiffs(t *testing.T) {
+	a := common.HexToAddress("0xa")
+	b := common.HexToAddress("0xb")
+	c := common.HexToAddress("0xc")
+	k1 := common.HexToHash("0x1")
+	k2 := common.HexToHash("0x2")
+	diffs := []*oracle.StateDiff{
+		{
+			Pre: map[common.Address]*oracle.DiffAccount{
+				a: {Balance: diffBalance(10), Nonce: diffNonce(1), Storage: map[common.Hash]common.Hash{k1: common.HexToHash("0x11")}},
+				b: {Balance: diffBalance(5)},
+			},
+			Post: map[common.Address]*oracle.DiffAccount{
+				a: {Balance: diffBalance(8), Nonce: diffNonce(2), Storage: map[common.Hash]common.Hash{k1: common.HexToHash("0x12")}},
+				// b is deleted
+			},
+		},
+		{
+			Pre: map[common.Address]*oracle.DiffAccount{
+				a: {Balance: diffBalance(8), Nonce: diffNonce(2), Storage: map[common.Hash]common.Hash{k1: common.HexToHash("0x12")}},
+			},
+			Post: map[common.Address]*oracle.DiffAccount{
+				// k1 is cleared, the balance is set back
+				a: {Balance: diffBalance(10), Storage: map[common.Hash]common.Hash{k2: common.HexToHash("0x22")}},
+				c: {Nonce: diffNonce(1), Code: []byte{0x60, 0x00}, Storage: map[common.Hash]common.Hash{k1: common.HexToHash("0x33")}},
+			},
+		},
+	}
+
+	got := ModificationsFromStateDiffs(diffs)
+	want := []TrieModification{
+		{Type: AccountMod, Address: a, Account: &AccountUpdate{Nonce: diffNonce(2)}},
+		{Type: StorageMod, Address: a, Key: k1, Value: common.Hash{}},
+		{Type: StorageMod, Address: a, Key: k2, Value: common.HexToHash("0x22")},
+		{Type: DeleteAccount, Address: b},
+		{Type: CreateAccount, Address: c},
+		{Type: AccountMod, Address: c, Account: &AccountUpdate{Nonce: diffNonce(1), CodeHash: []byte{0x60, 0x00}}},
+		{Type: StorageMod, Address: c, Key: k1, Value: common.HexToHash("0x33")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got modifications\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+var (
+	blockA = common.HexToAddress("0x50efbf12580138bc263c95757826df4e24eb81c9")
+	blockB = common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
+)
+
+// blockSource returns the empty state at block 0 and the state diffs of block 1,
+// the state of block 1 is post.
+func blockSource(t *testing.T, post oracle.GenesisAlloc) *oracle.MemorySource {
+	src := oracle.NewMemorySource()
+	src.AddHeader(testHeader(0, types.EmptyRootHash))
+	if err := post.AddToSource(src, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	src.AddStateDiffs(1, []*oracle.StateDiff{
+		{
+			Pre: map[common.Address]*oracle.DiffAccount{},
+			Post: map[common.Address]*oracle.DiffAccount{
+				blockA: {Balance: diffBalance(100), Storage: map[common.Hash]common.Hash{
+					common.HexToHash("0x12"): common.HexToHash("0x1"),
+					common.HexToHash("0x21"): common.HexToHash("0x2"),
+				}},
+			},
+		},
+		{
+			Pre: map[common.Address]*oracle.DiffAccount{
+				blockA: {Balance: diffBalance(100), Storage: map[common.Hash]common.Hash{common.HexToHash("0x12"): common.HexToHash("0x1")}},
+			},
+			Post: map[common.Address]*oracle.DiffAccount{
+				blockA: {Balance: diffBalance(90), Storage: map[common.Hash]common.Hash{common.HexToHash("0x12"): common.HexToHash("0x3")}},
+				blockB: {Balance: diffBalance(10), Nonce: diffNonce(1)},
+			},
+		},
+	})
+	return src
+}
+
+// blockPostState returns the state after the state diffs of blockSource.
+func blockPostState() oracle.GenesisAlloc {
+	return oracle.GenesisAlloc{
+		blockA: {Balance: math.NewHexOrDecimal256(90), Storage: map[common.Hash]common.Hash{
+			common.HexToHash("0x12"): common.HexToHash("0x3"),
+			common.HexToHash("0x21"): common.HexToHash("0x2"),
+		}},
+		blockB: {Balance: math.NewHexOrDecimal256(10), Nonce: 1},
+	}
+}
+
+func TestGetBlockProofs(t *testing.T) {
+	src := blockSource(t, blockPostState())
+	proof, mods, err := GetBlockProofs(src, src, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mods) != 6 {
+		t.Fatalf("expected 6 modifications, got %d: %+v", len(mods), mods)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Fatal(err)
+	}
+	if w.Rows[0].SRoot != types.EmptyRootHash {
+		t.Errorf("witness doesn't start at the parent block root")
+	}
+}
+
+func TestGetBlockProofsStateRootMismatch(t *testing.T) {
+	slot := common.HexToHash("0x21")
+	tests := []struct {
+		name    string
+		change  func(oracle.GenesisAlloc)
+		address common.Address
+		slot    *common.Hash
+	}{
+		{"storage", func(post oracle.GenesisAlloc) {
+			post[blockA].Storage[slot] = common.HexToHash("0x4")
+		}, blockA, &slot},
+		{"balance", func(post oracle.GenesisAlloc) {
+			post[blockB] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(11), Nonce: 1}
+		}, blockB, nil},
+		{"missing account", func(post oracle.GenesisAlloc) {
+			delete(post, blockB)
+		}, blockB, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			post := blockPostState()
+			test.change(post)
+			src := blockSource(t, post)
+			_, _, err := GetBlockProofs(src, src, 1, nil)
+			var mismatch *StateRootMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected a state root mismatch, got %v", err)
+			}
+			if ErrorKind(err) != ErrKindStateRoot {
+				t.Errorf("error kind %s", ErrorKind(err))
+			}
+			if mismatch.Address == nil || *mismatch.Address != test.address {
+				t.Errorf("expected the difference at %s: %v", test.address.Hex(), err)
+			}
+			if !reflect.DeepEqual(mismatch.Slot, test.slot) {
+				t.Errorf("expected the difference at slot %v: %v", test.slot, err)
+			}
+		})
+	}
+}
+
+func TestGetBlockProofsRewards(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	coinbase := common.HexToAddress("0xc0ffee")
+	alloc := oracle.GenesisAlloc{
+		sender:   {Balance: math.NewHexOrDecimal256(1e18)},
+		coinbase: {Balance: math.NewHexOrDecimal256(1)},
+	}
+	src, err := alloc.Source(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gasPrice *big.Int
+	tip := big.NewInt(10)
+	addGethBlock(t, src, alloc, func(b *core.BlockGen) {
+		b.SetCoinbase(coinbase)
+		gasPrice = new(big.Int).Add(b.BaseFee(), tip)
+		tx, err := types.SignTx(types.NewTransaction(0, blockA, big.NewInt(1000), 21000, gasPrice, nil),
+			types.MakeSigner(params.AllEthashProtocolChanges, b.Number()), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.AddTx(tx)
+		b.AddUncle(&types.Header{Number: big.NewInt(0), Coinbase: blockB, Difficulty: big.NewInt(1)})
+	})
+
+	// The state diff of the transfer, the rewards are not part of it.
+	senderPost := new(big.Int).Mul(gasPrice, big.NewInt(21000))
+	senderPost.Sub(big.NewInt(1e18), senderPost.Add(senderPost, big.NewInt(1000)))
+	coinbasePost := new(big.Int).Add(big.NewInt(1), new(big.Int).Mul(tip, big.NewInt(21000)))
+	src.AddStateDiffs(1, []*oracle.StateDiff{{
+		Pre: map[common.Address]*oracle.DiffAccount{
+			sender:   {Balance: diffBalance(1e18)},
+			coinbase: {Balance: diffBalance(1)},
+		},
+		Post: map[common.Address]*oracle.DiffAccount{
+			sender:   {Balance: (*hexutil.Big)(senderPost), Nonce: diffNonce(1)},
+			blockA:   {Balance: diffBalance(1000)},
+			coinbase: {Balance: (*hexutil.Big)(coinbasePost)},
+		},
+	}})
+
+	// The state root geth computed is checked.
+	proof, mods, err := GetBlockProofs(src, src, 1, params.AllEthashProtocolChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reward := ethash.ConstantinopleBlockReward
+	uncleReward := new(big.Int).Div(new(big.Int).Mul(reward, big.NewInt(7)), big.NewInt(8))
+	minerReward := new(big.Int).Add(reward, new(big.Int).Div(reward, big.NewInt(32)))
+	want := []TrieModification{
+		{Type: BalanceMod, Address: blockB, Balance: uncleReward},
+		{Type: BalanceMod, Address: coinbase, Balance: minerReward.Add(minerReward, coinbasePost)},
+	}
+	if got := mods[len(mods)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rewards\n%+v\nwant\n%+v", got, want)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStateDiffModifications(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/trace_block_1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods, err := ParseStateDiffModifications(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := blockSource(t, blockPostState())
+	diffs, err := src.BlockStateDiffs(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ModificationsFromStateDiffs(diffs); !reflect.DeepEqual(mods, want) {
+		t.Fatalf("got modifications\n%+v\nwant\n%+v", mods, want)
+	}
+
+	// The witness of the dump ends at the state root of block 1.
+	proof, _, err := GetBlockProofs(src, oracle.StateDiffFile("testdata/trace_block_1.json"), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,147 @@
+package witness
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/trie"
+)
+
+// MalformedProofError is returned when a proof node doesn't have the RLP layout
+// the witness generator expects.
+type MalformedProofError struct {
+	Msg string
+}
+
+func (err *MalformedProofError) Error() string {
+	return "malformed proof: " + err.Msg
+}
+
+// UnsupportedNodeError is returned for node shapes the witness can't present
+// (for example a branch with a value or a node embedded in its parent).
+type UnsupportedNodeError struct {
+	Msg string
+}
+
+func (err *UnsupportedNodeError) Error() string {
+	return "unsupported node: " + err.Msg
+}
+
+func malformedProof(format string, a ...interface{}) error {
+	return &MalformedProofError{Msg: fmt.Sprintf(format, a...)}
+}
+
+func unsupportedNode(format string, a ...interface{}) error {
+	return &UnsupportedNodeError{Msg: fmt.Sprintf(format, a...)}
+}
+
+// Error kinds as reported by ErrorKind.
+const (
+	ErrKindMissingNode     = "missing_node"
+	ErrKindRPC             = "rpc"
+	ErrKindMalformedProof  = "malformed_proof"
+	ErrKindUnsupportedNode = "unsupported_node"
+	ErrKindInvalidWitness  = "invalid_witness"
+	ErrKindStateRoot       = "state_root_mismatch"
+	ErrKindReadMismatch    = "read_mismatch"
+	ErrKindInternal        = "internal"
+)
+
+// ErrorKind classifies an error returned by the witness generator, it is used
+// when the error needs to be passed on as a structured object (for example to Rust).
+func ErrorKind(err error) string {
+	var missingNode *trie.MissingNodeError
+	var missingPreimage *oracle.MissingPreimageError
+	var sourceErr *oracle.SourceError
+	var malformed *MalformedProofError
+	var unsupported *UnsupportedNodeError
+	var invalid *InvalidWitnessError
+	var version *WitnessVersionError
+	var stateRoot *StateRootMismatchError
+	var readMismatch *ReadMismatchError
+	switch {
+	case errors.As(err, &missingNode), errors.As(err, &missingPreimage), errors.Is(err, oracle.ErrNotFound):
+		return ErrKindMissingNode
+	case errors.As(err, &sourceErr):
+		return ErrKindRPC
+	case errors.As(err, &malformed):
+		return ErrKindMalformedProof
+	case errors.As(err, &unsupported):
+		return ErrKindUnsupportedNode
+	case errors.As(err, &invalid), errors.As(err, &version):
+		return ErrKindInvalidWitness
+	case errors.As(err, &stateRoot):
+		return ErrKindStateRoot
+	case errors.As(err, &readMismatch):
+		return ErrKindReadMismatch
+	}
+	return ErrKindInternal
+}
+
+// InvalidWitnessError is returned by Witness.Verify for a witness that doesn't
+// satisfy the constraints.
+type InvalidWitnessError struct {
+	Row int
+	Msg string
+}
+
+func (err *InvalidWitnessError) Error() string {
+	return fmt.Sprintf("invalid witness at row %d: %s", err.Row, err.Msg)
+}
+
+// WitnessVersionError is returned when parsing a witness of a version other than
+// WitnessVersion. MetaLen is the length of the meta info for a legacy matrix, 0
+// for a witness in JSON.
+type WitnessVersionError struct {
+	Version int
+	MetaLen int
+}
+
+func (err *WitnessVersionError) Error() string {
+	if err.MetaLen != 0 {
+		return fmt.Sprintf("witness version %d (meta info of %d bytes) is not supported, regenerate it with version %d",
+			err.Version, err.MetaLen, WitnessVersion)
+	}
+	return fmt.Sprintf("witness version %d is not supported, regenerate it with version %d", err.Version, WitnessVersion)
+}
+
+// StateRootMismatchError is returned when the state root after the modifications
+// of a block doesn't match the state root in the block header. Address and Slot
+// are the first account and storage slot (ordered by the hash) that differ, nil if
+// the difference couldn't be located (for example because the header state is not
+// available beyond the proofs of the modified keys).
+type StateRootMismatchError struct {
+	Block   int
+	Header  common.Hash // state root in the block header
+	Root    common.Hash // state root after the modifications
+	Address *common.Address
+	Slot    *common.Hash
+	Msg     string
+}
+
+func (err *StateRootMismatchError) Error() string {
+	return fmt.Sprintf("state root %s after the modifications doesn't match the root %s in the header of block %d: %s",
+		err.Root.Hex(), err.Header.Hex(), err.Block, err.Msg)
+}
+
+// ReadMismatchError is returned by the generator for a read modification
+// (StorageRead, NonceRead, BalanceRead, CodeHashRead) whose value is not the value
+// in the state or whose account doesn't exist, the witness of the read would be
+// invalid.
+type ReadMismatchError struct {
+	Type    ModType
+	Address common.Address
+	Key     common.Hash // StorageRead only
+	Read    string      // value of the modification
+	State   string      // value in the state
+}
+
+func (err *ReadMismatchError) Error() string {
+	field := err.Address.Hex()
+	if err.Type == StorageRead {
+		field = fmt.Sprintf("%s storage %s", err.Address.Hex(), err.Key.Hex())
+	}
+	return fmt.Sprintf("%s of %s reads %s, but the state has %s", err.Type, field, err.Read, err.State)
+}
@@ -0,0 +1,430 @@
+package witness
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miha-stopar/mpt/state"
+)
+
+var (
+	fuzzSeed  = flag.Int64("fuzz.seed", 1, "seed of the random cases of TestFuzzWitness (0 means a random seed)")
+	fuzzCases = flag.Int("fuzz.cases", 30, "number of random cases TestFuzzWitness checks")
+)
+
+// fuzzCase is a random state (accounts with a balance and the storage of
+// verifyAddr, which always exists) and random modifications applied on it.
+type fuzzCase struct {
+	Accounts []common.Address
+	Keys     []common.Hash
+	Mods     []TrieModification
+}
+
+// TestFuzzWitness generates the witnesses of random modifications of random
+// tries and verifies them. A failing case is shrunk to a minimal one. Run for
+// example with -fuzz.seed 0 -fuzz.cases 1000 to check more cases.
+func TestFuzzWitness(t *testing.T) {
+	seed := *fuzzSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	skipped := 0
+	for i := 0; i < *fuzzCases; i++ {
+		c := randomFuzzCase(rnd)
+		switch err := c.run(); err {
+		case nil:
+		case errExtensionModified:
+			skipped++
+		default:
+			min := shrinkFuzzCase(c)
+			t.Fatalf("case %d of seed %d: %v\nminimal failing case (%v):\n%s", i, seed, err, min.run(), min)
+		}
+	}
+	t.Logf("%d of %d cases skipped: %v", skipped, *fuzzCases, errExtensionModified)
+}
+
+// TestFuzzWitnessRegressions checks the shrunk cases TestFuzzWitness found.
+func TestFuzzWitnessRegressions(t *testing.T) {
+	hexKeys := func(keys ...string) []common.Hash {
+		hashes := make([]common.Hash, len(keys))
+		for i, key := range keys {
+			hashes[i] = common.HexToHash(key)
+		}
+		return hashes
+	}
+	tests := []struct {
+		name string
+		c    fuzzCase
+		want error
+	}{
+		{
+			// The extension rows were repeated in the branch below the branch
+			// the extension node points to.
+			name: "update below an extension node",
+			c: fuzzCase{
+				Keys: hexKeys("0xb8b1", "0x7b88", "0x2193"),
+				Mods: []TrieModification{{Type: StorageMod, Address: verifyAddr, Key: common.HexToHash("0x7b88"), Value: common.HexToHash("0x76")}},
+			},
+		},
+		{
+			// The deletion turns the branch into an extension node.
+			name: "deletion creates an extension node",
+			c: fuzzCase{
+				Keys: hexKeys("0xf446", "0x2e54", "0xd9dc"),
+				Mods: []TrieModification{{Type: StorageMod, Address: verifyAddr, Key: common.HexToHash("0xf446")}},
+			},
+			want: errExtensionModified,
+		},
+	}
+	for _, test := range tests {
+		if err := test.c.run(); err != test.want {
+			t.Errorf("%s: got %v, want %v\n%s", test.name, err, test.want, &test.c)
+		}
+	}
+}
+
+// errExtensionModified is returned by fuzzCase.run for the cases the witness
+// doesn't support (yet): a modification splits, creates or removes an extension
+// node on the path of the modified key. The generator needs to reject them with
+// UnsupportedNodeError, any other shape it rejects fails the test.
+var errExtensionModified = errors.New("modification changes an extension node")
+
+// run generates and verifies the witness of the case.
+func (c *fuzzCase) run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	statedb, err := c.state()
+	if err != nil {
+		return err
+	}
+	proof, err := getParallelProofs(c.Mods, statedb)
+	var unsupported *UnsupportedNodeError
+	if errors.As(err, &unsupported) {
+		if modified, merr := c.modifiesExtension(); merr != nil || !modified {
+			return fmt.Errorf("%v (the case doesn't modify an extension node)", err)
+		}
+		return errExtensionModified
+	}
+	if err != nil {
+		return err
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		return err
+	}
+	return w.Verify(c.Mods)
+}
+
+// state returns the state before the modifications.
+func (c *fuzzCase) state() (*state.StateDB, error) {
+	statedb, err := newMemoryStateDB()
+	if err != nil {
+		return nil, err
+	}
+	for i, addr := range c.Accounts {
+		statedb.SetBalance(addr, big.NewInt(int64(i+1)))
+	}
+	// The storage can only be modified in an existing account.
+	statedb.SetBalance(verifyAddr, big.NewInt(1))
+	for i, key := range c.Keys {
+		statedb.SetState(verifyAddr, key, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+	statedb.IntermediateRoot(false)
+
+	return statedb, statedb.Error()
+}
+
+// modifiesExtension applies the modifications and reports whether the proof of
+// a modified key ends in an extension node before or after the modification:
+// the key is inserted into (or deleted from) the middle of an extension node,
+// or a deletion turns a branch into an extension node.
+func (c *fuzzCase) modifiesExtension() (bool, error) {
+	statedb, err := c.state()
+	if err != nil {
+		return false, err
+	}
+	endsInExtension := func(mod TrieModification) (bool, error) {
+		var proof [][]byte
+		var err error
+		if mod.Type == StorageMod {
+			proof, _, _, err = statedb.GetStorageProof(mod.Address, mod.Key)
+		} else {
+			proof, _, _, err = statedb.GetProof(mod.Address)
+		}
+		if err != nil || len(proof) == 0 {
+			return false, err
+		}
+		return isExtensionNode(proof[len(proof)-1]), nil
+	}
+
+	for _, mod := range c.Mods {
+		if ext, err := endsInExtension(mod); ext || err != nil {
+			return ext, err
+		}
+		switch mod.Type {
+		case StorageMod:
+			statedb.SetState(mod.Address, mod.Key, mod.Value)
+		case BalanceMod:
+			statedb.SetBalance(mod.Address, mod.Balance)
+		case NonceMod:
+			statedb.SetNonce(mod.Address, mod.Nonce)
+		case DeleteAccount:
+			statedb.DeleteAccount(mod.Address)
+		}
+		statedb.IntermediateRoot(false)
+		if ext, err := endsInExtension(mod); ext || err != nil {
+			return ext, err
+		}
+	}
+	return false, statedb.Error()
+}
+
+// shrinkFuzzCase removes accounts, keys and modifications from the failing case
+// as long as it keeps failing (with any error but errExtensionModified).
+func shrinkFuzzCase(c *fuzzCase) *fuzzCase {
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for _, smaller := range c.smaller() {
+			if err := smaller.run(); smaller.valid() && err != nil && err != errExtensionModified {
+				c, shrunk = smaller, true
+				break
+			}
+		}
+	}
+	return c
+}
+
+// smaller returns the cases with one account, key or modification removed.
+func (c *fuzzCase) smaller() []*fuzzCase {
+	var cases []*fuzzCase
+	for i := range c.Accounts {
+		s := *c
+		s.Accounts = append(append([]common.Address{}, c.Accounts[:i]...), c.Accounts[i+1:]...)
+		cases = append(cases, &s)
+	}
+	for i := range c.Keys {
+		s := *c
+		s.Keys = append(append([]common.Hash{}, c.Keys[:i]...), c.Keys[i+1:]...)
+		cases = append(cases, &s)
+	}
+	if len(c.Mods) > 1 {
+		for i := range c.Mods {
+			s := *c
+			s.Mods = append(append([]TrieModification{}, c.Mods[:i]...), c.Mods[i+1:]...)
+			cases = append(cases, &s)
+		}
+	}
+	return cases
+}
+
+// valid reports whether the accounts and storage slots the modifications delete
+// exist (removing an account or a key from a case can make it invalid).
+func (c *fuzzCase) valid() bool {
+	accounts := make(map[common.Address]bool)
+	for _, addr := range c.Accounts {
+		accounts[addr] = true
+	}
+	keys := make(map[common.Hash]bool)
+	for _, key := range c.Keys {
+		keys[key] = true
+	}
+	for _, mod := range c.Mods {
+		switch mod.Type {
+		case StorageMod:
+			if mod.Value == (common.Hash{}) && !keys[mod.Key] {
+				return false
+			}
+			keys[mod.Key] = mod.Value != (common.Hash{})
+		case BalanceMod, NonceMod:
+			accounts[mod.Address] = true
+		case DeleteAccount:
+			if !accounts[mod.Address] {
+				return false
+			}
+			delete(accounts, mod.Address)
+		}
+	}
+	return true
+}
+
+func (c *fuzzCase) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "accounts (balance i+1):")
+	for _, addr := range c.Accounts {
+		fmt.Fprintf(&b, " %s", addr.Hex())
+	}
+	fmt.Fprintf(&b, "\nstorage of %s (value i+1):", verifyAddr.Hex())
+	for _, key := range c.Keys {
+		fmt.Fprintf(&b, " %s", trimmedHex(key.Bytes()))
+	}
+	b.WriteString("\nmodifications:\n")
+	for _, mod := range c.Mods {
+		switch mod.Type {
+		case StorageMod:
+			fmt.Fprintf(&b, "  %s %s key %s value %s\n", mod.Type, mod.Address.Hex(), trimmedHex(mod.Key.Bytes()), trimmedHex(mod.Value.Bytes()))
+		case BalanceMod:
+			fmt.Fprintf(&b, "  %s %s balance %s\n", mod.Type, mod.Address.Hex(), mod.Balance)
+		case NonceMod:
+			fmt.Fprintf(&b, "  %s %s nonce %d\n", mod.Type, mod.Address.Hex(), mod.Nonce)
+		default:
+			fmt.Fprintf(&b, "  %s %s\n", mod.Type, mod.Address.Hex())
+		}
+	}
+	return b.String()
+}
+
+// randomFuzzCase returns a state with up to 64 accounts and 64 storage keys and
+// up to 4 modifications inserting, updating and deleting storage slots and
+// accounts.
+func randomFuzzCase(rnd *rand.Rand) *fuzzCase {
+	c := new(fuzzCase)
+	for i, n := 0, rnd.Intn(64); i < n; i++ {
+		c.Accounts = append(c.Accounts, randomAddress(rnd, c.Accounts))
+	}
+	for i, n := 0, rnd.Intn(64); i < n; i++ {
+		c.Keys = append(c.Keys, randomKey(rnd, c.Keys))
+	}
+
+	// The accounts and keys that exist when the next modification is applied.
+	accounts := append([]common.Address{}, c.Accounts...)
+	keys := append([]common.Hash{}, c.Keys...)
+	for i, n := 0, 1+rnd.Intn(4); i < n; i++ {
+		mod := TrieModification{Type: StorageMod, Address: verifyAddr}
+		switch r := rnd.Intn(6); {
+		case r == 0 || len(keys) == 0:
+			mod.Key = randomKey(rnd, keys)
+			mod.Value = randomValue(rnd)
+			keys = append(keys, mod.Key)
+		case r == 1:
+			mod.Key = keys[rnd.Intn(len(keys))]
+			mod.Value = randomValue(rnd)
+		case r == 2:
+			j := rnd.Intn(len(keys))
+			mod.Key = keys[j]
+			keys = append(keys[:j], keys[j+1:]...)
+		case r == 3 || len(accounts) == 0:
+			mod.Type = BalanceMod
+			mod.Address = randomAddress(rnd, accounts)
+			mod.Balance = big.NewInt(rnd.Int63())
+			accounts = append(accounts, mod.Address)
+		case r == 4:
+			mod.Type = NonceMod
+			mod.Address = accounts[rnd.Intn(len(accounts))]
+			mod.Nonce = uint64(rnd.Intn(300))
+		default:
+			j := rnd.Intn(len(accounts))
+			mod.Type = DeleteAccount
+			mod.Address = accounts[j]
+			accounts = append(accounts[:j], accounts[j+1:]...)
+		}
+		c.Mods = append(c.Mods, mod)
+	}
+
+	return c
+}
+
+// randomKey returns a new storage key, either a random small one or a key
+// whose hash shares the first 1 to 3 nibbles with the hash of one of the keys
+// (to get extension nodes and placeholder branches).
+func randomKey(rnd *rand.Rand, keys []common.Hash) common.Hash {
+	existing := func(key common.Hash) bool {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	var base []byte
+	if len(keys) > 0 && rnd.Intn(2) == 0 {
+		base = crypto.Keccak256(keys[rnd.Intn(len(keys))].Bytes())
+	}
+	nibbles := 1 + rnd.Intn(3)
+	for i := rnd.Int63n(1 << 16); ; i++ {
+		key := common.BigToHash(big.NewInt(i))
+		if !existing(key) && (base == nil || sharedNibbles(base, crypto.Keccak256(key.Bytes())) == nibbles) {
+			return key
+		}
+	}
+}
+
+// randomAddress is randomKey for accounts.
+func randomAddress(rnd *rand.Rand, accounts []common.Address) common.Address {
+	existing := func(addr common.Address) bool {
+		for _, a := range accounts {
+			if a == addr {
+				return true
+			}
+		}
+		return addr == verifyAddr
+	}
+	var base []byte
+	if len(accounts) > 0 && rnd.Intn(2) == 0 {
+		base = crypto.Keccak256(accounts[rnd.Intn(len(accounts))].Bytes())
+	}
+	nibbles := 1 + rnd.Intn(3)
+	for i := rnd.Int63n(1 << 16); ; i++ {
+		addr := common.BigToAddress(big.NewInt(i))
+		if !existing(addr) && (base == nil || sharedNibbles(base, crypto.Keccak256(addr.Bytes())) == nibbles) {
+			return addr
+		}
+	}
+}
+
+// randomValue returns a non-zero storage value, short or long (the RLP of a
+// long leaf is longer than 55 bytes).
+func randomValue(rnd *rand.Rand) common.Hash {
+	var value common.Hash
+	if rnd.Intn(2) == 0 {
+		value[31] = byte(1 + rnd.Intn(255))
+	} else {
+		rnd.Read(value[:])
+		value[0] |= 1
+	}
+	return value
+}
+
+// sharedNibbles returns the number of leading nibbles a and b have in common.
+func sharedNibbles(a, b []byte) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			n += 2
+			continue
+		}
+		if a[i]>>4 == b[i]>>4 {
+			n++
+		}
+		break
+	}
+	return n
+}
+
+func TestSharedNibbles(t *testing.T) {
+	for _, test := range []struct {
+		a, b []byte
+		n    int
+	}{
+		{[]byte{0x12, 0x34}, []byte{0x12, 0x34}, 4},
+		{[]byte{0x12, 0x34}, []byte{0x12, 0x35}, 3},
+		{[]byte{0x12, 0x34}, []byte{0x13, 0x34}, 1},
+		{[]byte{0x12}, []byte{0x22}, 0},
+	} {
+		if n := sharedNibbles(test.a, test.b); n != test.n {
+			t.Errorf("%x %x: %d shared nibbles, want %d", test.a, test.b, n, test.n)
+		}
+	}
+}
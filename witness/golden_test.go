@@ -0,0 +1,149 @@
+package witness
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write the witnesses of the tests into generated_witnesses instead of comparing them")
+
+// maxDiffRows is the number of differing rows witnessDiff describes.
+const maxDiffRows = 10
+
+// checkWitness compares the witness with the golden file generated_witnesses/<name>.json,
+// or writes the file if the tests run with -update.
+func checkWitness(t *testing.T, name string, proof [][]byte) {
+	t.Helper()
+	if *update {
+		if err := writeWitness(name, proof); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	file := filepath.Join("..", "generated_witnesses", name+".json")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v (run the test with -update to create it)", err)
+	}
+	golden, err := ParseWitness(data)
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	if diff := witnessDiff(golden.Matrix(), proof); diff != "" {
+		t.Errorf("witness differs from %s (run the test with -update if the change is intended):\n%s", file, diff)
+	}
+}
+
+// witnessDiff describes the rows in which got differs from want, decoded as
+// witness rows (see WitnessFromMatrix) if both witnesses can be decoded. It
+// returns an empty string if the witnesses are equal.
+func witnessDiff(want, got [][]byte) string {
+	var b strings.Builder
+	if len(got) != len(want) {
+		fmt.Fprintf(&b, "%d rows, want %d\n", len(got), len(want))
+	}
+	wantW, wantErr := WitnessFromMatrix(want)
+	gotW, gotErr := WitnessFromMatrix(got)
+	decoded := wantErr == nil && gotErr == nil
+
+	diffs := 0
+	for i := 0; i < len(want) || i < len(got); i++ {
+		if i < len(want) && i < len(got) && bytes.Equal(want[i], got[i]) {
+			continue
+		}
+		if diffs == maxDiffRows {
+			b.WriteString("...\n")
+			break
+		}
+		diffs++
+		switch {
+		case i >= len(got):
+			fmt.Fprintf(&b, "row %d: missing\n", i)
+		case i >= len(want):
+			fmt.Fprintf(&b, "row %d: unexpected\n", i)
+		case decoded:
+			fmt.Fprintf(&b, "row %d (%s):\n", i, rowName(&wantW.Rows[i]))
+			rowDiff(&b, &wantW.Rows[i], &gotW.Rows[i])
+		default:
+			fmt.Fprintf(&b, "row %d: bytes %s differ\n", i, bytesDiff(want[i], got[i]))
+		}
+	}
+	if !decoded && b.Len() > 0 {
+		fmt.Fprintf(&b, "(rows not decoded: want %v, got %v)\n", wantErr, gotErr)
+	}
+
+	return b.String()
+}
+
+func rowName(r *WitnessRow) string {
+	if r.Kind == RowHash {
+		return r.Kind.String()
+	}
+	return fmt.Sprintf("%s of modification %d (%s)", r.Kind, r.Counter, r.Modification)
+}
+
+// rowDiff writes the fields in which got differs from want.
+func rowDiff(b *strings.Builder, want, got *WitnessRow) {
+	field := func(name string, w, g interface{}) {
+		if ws, gs := fmt.Sprint(w), fmt.Sprint(g); ws != gs {
+			fmt.Fprintf(b, "  %s: %s, want %s\n", name, gs, ws)
+		}
+	}
+	field("kind", want.Kind, got.Kind)
+	field("S", fmt.Sprintf("%x", want.S), fmt.Sprintf("%x", got.S))
+	if want.Kind == RowBranchInit && got.Kind == RowBranchInit {
+		field("branch", fmt.Sprintf("%+v", want.Branch()), fmt.Sprintf("%+v", got.Branch()))
+	}
+	field("C", fmt.Sprintf("%x", want.C), fmt.Sprintf("%x", got.C))
+	field("RLP", fmt.Sprintf("%x", want.RLP), fmt.Sprintf("%x", got.RLP))
+	field("S root", want.SRoot.Hex(), got.SRoot.Hex())
+	field("C root", want.CRoot.Hex(), got.CRoot.Hex())
+	field("address hash", want.AddressHash.Hex(), got.AddressHash.Hex())
+	field("counter", want.Counter, got.Counter)
+	field("public root", want.PublicRoot.Hex(), got.PublicRoot.Hex())
+	field("not first level", want.NotFirstLevel, got.NotFirstLevel)
+	field("modification", want.Modification, got.Modification)
+	field("fields", want.Fields, got.Fields)
+}
+
+// bytesDiff returns the positions in which the rows differ.
+func bytesDiff(want, got []byte) string {
+	var pos []string
+	for i := 0; i < len(want) || i < len(got); i++ {
+		if i >= len(want) || i >= len(got) || want[i] != got[i] {
+			pos = append(pos, fmt.Sprint(i))
+		}
+	}
+	return strings.Join(pos, ",")
+}
+
+func TestWitnessDiff(t *testing.T) {
+	want := testMatrix()
+	if diff := witnessDiff(want, testMatrix()); diff != "" {
+		t.Errorf("equal witnesses differ:\n%s", diff)
+	}
+
+	got := testMatrix()
+	got[0][keyPos] = 5
+	got[3][2] = 77
+	diff := witnessDiff(want, got)
+	for _, s := range []string{"row 0 (branch_init", "ModifiedIndex:5", "row 3 (branch_child", "  S: "} {
+		if !strings.Contains(diff, s) {
+			t.Errorf("%q not in the diff:\n%s", s, diff)
+		}
+	}
+	if strings.Contains(diff, "row 1 ") {
+		t.Errorf("equal row in the diff:\n%s", diff)
+	}
+
+	diff = witnessDiff(want, got[:len(got)-1])
+	if !strings.Contains(diff, fmt.Sprintf("%d rows, want %d", len(got)-1, len(want))) {
+		t.Errorf("missing row not reported:\n%s", diff)
+	}
+}
@@ -0,0 +1,171 @@
+package witness
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Print writes the witness as a human-readable tree: for each modification the
+// roots, the branches (with extension nodes) and leaf rows of the account and
+// storage proof, followed by the rows to be hashed.
+func (w *Witness) Print(out io.Writer) error {
+	bw := bufio.NewWriter(out)
+	p := func(format string, a ...interface{}) {
+		fmt.Fprintf(bw, format, a...)
+	}
+
+	var toBeHashed []WitnessRow
+	counter := -1
+	inStorage := false
+	for i := 0; i < len(w.Rows); i++ {
+		r := w.Rows[i]
+		if r.Kind == RowHash {
+			toBeHashed = append(toBeHashed, r)
+			continue
+		}
+		if int(r.Counter) != counter {
+			counter = int(r.Counter)
+			inStorage = false
+			if r.Modification == AccountMod {
+				p("modification %d: %s (%s)\n", r.Counter, r.Modification, r.Fields)
+			} else {
+				p("modification %d: %s\n", r.Counter, r.Modification)
+			}
+			p("  address hash %s\n", r.AddressHash.Hex())
+			p("  S root %s\n", r.SRoot.Hex())
+			p("  C root %s\n", r.CRoot.Hex())
+			if r.PublicRoot != (common.Hash{}) {
+				p("  public root %s\n", r.PublicRoot.Hex())
+			}
+			p("  account proof\n")
+		}
+
+		switch r.Kind {
+		case RowBranchInit:
+			i = printBranch(p, w.Rows, i)
+		case RowAccountLeafNeighbouringLeaf, RowNeighbouringStorageLeaf:
+			if isZero(r.S) && isZero(r.C) {
+				p("    %s: placeholder\n", r.Kind)
+			} else {
+				p("    %s: %s (drifted leaf)\n", r.Kind, trimmedHex(r.S))
+			}
+			if r.Kind == RowAccountLeafNeighbouringLeaf && i+1 < len(w.Rows) &&
+				w.Rows[i+1].Kind != RowHash && int(w.Rows[i+1].Counter) == counter && !inStorage {
+				inStorage = true
+				p("  storage proof\n")
+			}
+		default:
+			p("    %s: S %s C %s\n", r.Kind, trimmedHex(r.S), trimmedHex(r.C))
+		}
+	}
+
+	p("to be hashed (%d rows)\n", len(toBeHashed))
+	for _, r := range toBeHashed {
+		p("  %s (%d bytes)\n", crypto.Keccak256Hash(r.RLP).Hex(), len(r.RLP))
+	}
+
+	return bw.Flush()
+}
+
+// printBranch prints the branch starting with the init row at rows[i] and returns
+// the index of its last row (including extension rows).
+func printBranch(p func(string, ...interface{}), rows []WitnessRow, i int) int {
+	init := rows[i]
+	flags := init.Branch()
+
+	info := fmt.Sprintf("modified nibble %d", flags.ModifiedIndex)
+	if flags.IsSPlaceholder {
+		info += ", S placeholder"
+	}
+	if flags.IsCPlaceholder {
+		info += ", C placeholder"
+	}
+	if flags.IsSPlaceholder || flags.IsCPlaceholder {
+		info += fmt.Sprintf(", drifted nibble %d", flags.DriftedIndex)
+	}
+	if flags.IsC16 {
+		info += ", c16"
+	} else if flags.IsC1 {
+		info += ", c1"
+	}
+	if !init.NotFirstLevel {
+		info += ", first level"
+	}
+	p("    branch (%s)\n", info)
+	p("      RLP S %v C %v\n", branchRLP(init.S, 0, 4), branchRLP(init.S, 2, 7))
+
+	j := i + 1
+	for ; j < len(rows) && j <= i+16 && rows[j].Kind == RowBranchChild; j++ {
+		s, c := branchChild(rows[j].S), branchChild(rows[j].C)
+		if s == "nil" && c == "nil" {
+			continue
+		}
+		mark := " "
+		if j-i-1 == int(flags.ModifiedIndex) {
+			mark = "*"
+		}
+		if s == c {
+			p("     %s%2d: %s\n", mark, j-i-1, s)
+		} else {
+			p("     %s%2d: S %s C %s\n", mark, j-i-1, s, c)
+		}
+	}
+
+	// Extension rows follow the branch children (they are empty when there is no extension node).
+	for ; j < len(rows) && (rows[j].Kind == RowExtensionNodeS || rows[j].Kind == RowExtensionNodeC); j++ {
+		if !flags.IsExtension {
+			continue
+		}
+		ext := rows[j]
+		child := common.BytesToHash(ext.C[branchNodeRLPLen : branchNodeRLPLen+32]).Hex()
+		if ext.Kind == RowExtensionNodeS {
+			ty := "long"
+			if flags.IsExtShortC16 || flags.IsExtShortC1 {
+				ty = "short"
+			} else if flags.IsExtLongEvenC16 || flags.IsExtLongEvenC1 {
+				ty = "long even"
+			} else if flags.IsExtLongOddC16 || flags.IsExtLongOddC1 {
+				ty = "long odd"
+			}
+			p("      extension S (%s): key %s child %s\n", ty, trimmedHex(ext.S), child)
+		} else {
+			p("      extension C: nibbles %s child %s\n", trimmedHex(ext.S[branchNodeRLPLen:]), child)
+		}
+	}
+
+	return j - 1
+}
+
+// branchRLP returns the RLP meta bytes of the S (or C) branch as stored in the
+// branch init row: two bytes telling whether there are 2 or 3 RLP bytes at
+// flagPos and the RLP bytes at rlpPos.
+func branchRLP(s []byte, flagPos, rlpPos int) []byte {
+	if s[flagPos+1] == 1 {
+		return s[rlpPos : rlpPos+3]
+	}
+	return s[rlpPos : rlpPos+2]
+}
+
+func branchChild(part []byte) string {
+	if part[1] == 160 {
+		return common.BytesToHash(part[branchNodeRLPLen : branchNodeRLPLen+32]).Hex()
+	}
+	return "nil"
+}
+
+func isZero(b []byte) bool {
+	return len(bytes.TrimRight(b, "\x00")) == 0
+}
+
+func trimmedHex(b []byte) string {
+	b = bytes.TrimRight(b, "\x00")
+	if len(b) == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,333 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+JSON encoding of a modification (a list of them is a modification file, see
+ParseModifications):
+
+	{
+		"type": "storage",        // see modTypeNames
+		"address": "0x...",
+		"key": "0x...",           // storage, storage_read, non_existing_storage
+		"value": "0x...",         // storage, storage_read
+		"nonce": "0x1",           // nonce, nonce_read
+		"balance": "0x...",       // balance, balance_read
+		"code": "0x...",          // codehash, codehash_read (the code, see TrieModification.CodeHash)
+		"account": {              // account, only the changed fields
+			"nonce": "0x1",
+			"balance": "0x...",
+			"code": "0x...",
+			"storage_root": "0x..."
+		}
+	}
+
+The numbers are decoded from JSON numbers or strings (hex with the 0x prefix or
+decimal), the keys and values can be shorter than 32 bytes. A field the type
+doesn't use is an error. The same layout is read from YAML.
+*/
+
+type jsonModification struct {
+	Type    *ModType           `json:"type" yaml:"type"`
+	Address modValue           `json:"address" yaml:"address"`
+	Key     modValue           `json:"key,omitempty" yaml:"key"`
+	Value   modValue           `json:"value,omitempty" yaml:"value"`
+	Nonce   modValue           `json:"nonce,omitempty" yaml:"nonce"`
+	Balance modValue           `json:"balance,omitempty" yaml:"balance"`
+	Code    modValue           `json:"code,omitempty" yaml:"code"`
+	Account *jsonAccountUpdate `json:"account,omitempty" yaml:"account"`
+}
+
+type jsonAccountUpdate struct {
+	Nonce       modValue `json:"nonce,omitempty" yaml:"nonce"`
+	Balance     modValue `json:"balance,omitempty" yaml:"balance"`
+	Code        modValue `json:"code,omitempty" yaml:"code"`
+	StorageRoot modValue `json:"storage_root,omitempty" yaml:"storage_root"`
+}
+
+// modFields are the fields of each modification type (besides type and address).
+var modFields = map[ModType][]string{
+	StorageMod:         {"key", "value"},
+	NonceMod:           {"nonce"},
+	BalanceMod:         {"balance"},
+	CodeHashMod:        {"code"},
+	CreateAccount:      {},
+	DeleteAccount:      {},
+	NonExistingAccount: {},
+	NonExistingStorage: {"key"},
+	StorageRead:        {"key", "value"},
+	NonceRead:          {"nonce"},
+	BalanceRead:        {"balance"},
+	CodeHashRead:       {"code"},
+	AccountMod:         {"account"},
+}
+
+// modValue is a number, hash or bytes in the text form of the file: a hex string
+// with the 0x prefix, or a decimal number.
+type modValue string
+
+func (v *modValue) UnmarshalJSON(input []byte) error {
+	if len(input) > 0 && input[0] == '"' {
+		var s string
+		if err := json.Unmarshal(input, &s); err != nil {
+			return err
+		}
+		*v = modValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(input, &n); err != nil {
+		return fmt.Errorf("%s is neither a string nor a number", input)
+	}
+	*v = modValue(n)
+	return nil
+}
+
+// UnmarshalYAML keeps the text of the scalar (YAML would read 0x12 as an integer).
+func (v *modValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*v = modValue(s)
+	return nil
+}
+
+func (v modValue) bigInt(name string) (*big.Int, error) {
+	n, ok := math.ParseBig256(string(v))
+	if !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("invalid %s %q", name, string(v))
+	}
+	return n, nil
+}
+
+func (v modValue) hash(name string) (common.Hash, error) {
+	n, err := v.bigInt(name)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.BigToHash(n), nil
+}
+
+func (v modValue) address() (common.Address, error) {
+	n, err := v.bigInt("address")
+	if err != nil || n.BitLen() > 8*common.AddressLength {
+		return common.Address{}, fmt.Errorf("invalid address %q", string(v))
+	}
+	return common.BigToAddress(n), nil
+}
+
+func (v modValue) uint64(name string) (uint64, error) {
+	n, ok := math.ParseUint64(string(v))
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %q", name, string(v))
+	}
+	return n, nil
+}
+
+func (v modValue) bytes(name string) ([]byte, error) {
+	b, err := hexutil.Decode(string(v))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", name, string(v), err)
+	}
+	return b, nil
+}
+
+func (m TrieModification) MarshalJSON() ([]byte, error) {
+	if _, ok := modTypeNames[m.Type]; !ok {
+		return nil, fmt.Errorf("unknown modification type %d", int64(m.Type))
+	}
+	enc := jsonModification{Type: &m.Type, Address: modValue(m.Address.Hex())}
+	for _, field := range modFields[m.Type] {
+		switch field {
+		case "key":
+			enc.Key = modValue(m.Key.Hex())
+		case "value":
+			enc.Value = modValue(m.Value.Hex())
+		case "nonce":
+			enc.Nonce = modValue(hexutil.EncodeUint64(m.Nonce))
+		case "balance":
+			enc.Balance = modValue(hexutil.EncodeBig(bigOrZero(m.Balance)))
+		case "code":
+			enc.Code = modValue(hexutil.Encode(m.CodeHash))
+		case "account":
+			enc.Account = &jsonAccountUpdate{}
+			if m.Account == nil {
+				break
+			}
+			if m.Account.Nonce != nil {
+				enc.Account.Nonce = modValue(hexutil.EncodeUint64(*m.Account.Nonce))
+			}
+			if m.Account.Balance != nil {
+				enc.Account.Balance = modValue(hexutil.EncodeBig(m.Account.Balance))
+			}
+			if m.Account.CodeHash != nil {
+				enc.Account.Code = modValue(hexutil.Encode(m.Account.CodeHash))
+			}
+			if m.Account.StorageRoot != nil {
+				enc.Account.StorageRoot = modValue(m.Account.StorageRoot.Hex())
+			}
+		}
+	}
+	return json.Marshal(enc)
+}
+
+func bigOrZero(n *big.Int) *big.Int {
+	if n == nil {
+		return new(big.Int)
+	}
+	return n
+}
+
+func (m *TrieModification) UnmarshalJSON(input []byte) error {
+	var dec jsonModification
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&dec); err != nil {
+		return err
+	}
+	return m.decode(&dec)
+}
+
+func (m *TrieModification) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var dec jsonModification
+	if err := unmarshal(&dec); err != nil {
+		return err
+	}
+	return m.decode(&dec)
+}
+
+func (m *TrieModification) decode(dec *jsonModification) error {
+	if dec.Type == nil {
+		return fmt.Errorf("modification without type")
+	}
+	typ := *dec.Type
+	fields, ok := modFields[typ]
+	if !ok {
+		return fmt.Errorf("unknown modification type %d", int64(typ))
+	}
+	if dec.Address == "" {
+		return fmt.Errorf("%s modification without address", typ)
+	}
+	set := map[string]bool{
+		"key":     dec.Key != "",
+		"value":   dec.Value != "",
+		"nonce":   dec.Nonce != "",
+		"balance": dec.Balance != "",
+		"code":    dec.Code != "",
+		"account": dec.Account != nil,
+	}
+	for _, field := range fields {
+		// A missing storage value is zero (the slot is cleared).
+		if !set[field] && field != "value" {
+			return fmt.Errorf("%s modification without %s", typ, field)
+		}
+		delete(set, field)
+	}
+	for _, field := range []string{"key", "value", "nonce", "balance", "code", "account"} {
+		if set[field] {
+			return fmt.Errorf("%s modification with %s", typ, field)
+		}
+	}
+
+	mod := TrieModification{Type: typ}
+	var err error
+	if mod.Address, err = dec.Address.address(); err != nil {
+		return err
+	}
+	if dec.Key != "" {
+		if mod.Key, err = dec.Key.hash("key"); err != nil {
+			return err
+		}
+	}
+	if dec.Value != "" {
+		if mod.Value, err = dec.Value.hash("value"); err != nil {
+			return err
+		}
+	}
+	if dec.Nonce != "" {
+		if mod.Nonce, err = dec.Nonce.uint64("nonce"); err != nil {
+			return err
+		}
+	}
+	if dec.Balance != "" {
+		if mod.Balance, err = dec.Balance.bigInt("balance"); err != nil {
+			return err
+		}
+	}
+	if dec.Code != "" {
+		if mod.CodeHash, err = dec.Code.bytes("code"); err != nil {
+			return err
+		}
+	}
+	if dec.Account != nil {
+		if mod.Account, err = dec.Account.decode(); err != nil {
+			return err
+		}
+	}
+	*m = mod
+	return nil
+}
+
+func (dec *jsonAccountUpdate) decode() (*AccountUpdate, error) {
+	update := &AccountUpdate{}
+	if dec.Nonce != "" {
+		nonce, err := dec.Nonce.uint64("nonce")
+		if err != nil {
+			return nil, err
+		}
+		update.Nonce = &nonce
+	}
+	if dec.Balance != "" {
+		balance, err := dec.Balance.bigInt("balance")
+		if err != nil {
+			return nil, err
+		}
+		update.Balance = balance
+	}
+	if dec.Code != "" {
+		code, err := dec.Code.bytes("code")
+		if err != nil {
+			return nil, err
+		}
+		update.CodeHash = code
+	}
+	if dec.StorageRoot != "" {
+		root, err := dec.StorageRoot.hash("storage root")
+		if err != nil {
+			return nil, err
+		}
+		update.StorageRoot = &root
+	}
+	if update.fields() == 0 {
+		return nil, fmt.Errorf("account modification without fields")
+	}
+	return update, nil
+}
+
+// ParseModifications parses a list of modifications in JSON or YAML (see the
+// JSON encoding of a modification above).
+func ParseModifications(input []byte) ([]TrieModification, error) {
+	var mods []TrieModification
+	input = bytes.TrimSpace(input)
+	if len(input) > 0 && input[0] == '[' {
+		if err := json.Unmarshal(input, &mods); err != nil {
+			return nil, err
+		}
+		return mods, nil
+	}
+	if err := yaml.UnmarshalStrict(input, &mods); err != nil {
+		return nil, err
+	}
+	return mods, nil
+}
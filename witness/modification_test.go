@@ -0,0 +1,84 @@
+package witness
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestModificationJSON(t *testing.T) {
+	nonce := uint64(3)
+	root := common.HexToHash("0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+	mods := []TrieModification{
+		{Type: StorageMod, Address: synthAddr, Key: common.HexToHash("0x12"), Value: common.HexToHash("0x1")},
+		{Type: NonExistingStorage, Address: synthAddr, Key: common.HexToHash("0x21")},
+		{Type: NonceMod, Address: synthAddr, Nonce: 2},
+		{Type: BalanceMod, Address: synthAddr, Balance: big.NewInt(1e18)},
+		{Type: CodeHashMod, Address: synthAddr, CodeHash: []byte{0x60, 0x00}},
+		{Type: DeleteAccount, Address: synthAddr},
+		{Type: AccountMod, Address: synthAddr, Account: &AccountUpdate{Nonce: &nonce, Balance: big.NewInt(7), StorageRoot: &root}},
+	}
+	enc, err := json.Marshal(mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := ParseModifications(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dec, mods) {
+		t.Errorf("got\n%+v\nwant\n%+v", dec, mods)
+	}
+}
+
+func TestParseModificationsYAML(t *testing.T) {
+	yamlMods := `
+- type: storage
+  address: 0x50efbf12580138bc263c95757826df4e24eb81c9
+  key: 0x12
+  value: 1
+- type: storage
+  address: 0x50efbf12580138bc263c95757826df4e24eb81c9
+  key: 0x0021
+- type: account
+  address: 0x00000000000000000000000000000000000000aa
+  account:
+    nonce: 0x2
+    balance: 1000
+`
+	mods, err := ParseModifications([]byte(yamlMods))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := uint64(2)
+	want := []TrieModification{
+		{Type: StorageMod, Address: synthAddr, Key: common.HexToHash("0x12"), Value: common.HexToHash("0x1")},
+		{Type: StorageMod, Address: synthAddr, Key: common.HexToHash("0x21")},
+		{Type: AccountMod, Address: common.HexToAddress("0xaa"), Account: &AccountUpdate{Nonce: &nonce, Balance: big.NewInt(1000)}},
+	}
+	if !reflect.DeepEqual(mods, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", mods, want)
+	}
+}
+
+func TestParseModificationsErrors(t *testing.T) {
+	for _, input := range []string{
+		`[{"address": "0xaa", "key": "0x1"}]`,
+		`[{"type": "storage", "key": "0x1"}]`,
+		`[{"type": "unknown", "address": "0xaa"}]`,
+		`[{"type": "storage", "address": "0xaa"}]`,
+		`[{"type": "nonce", "address": "0xaa", "nonce": 1, "key": "0x1"}]`,
+		`[{"type": "storage", "address": "0xaa", "key": "0x1", "vaule": "0x2"}]`,
+		`[{"type": "balance", "address": "0xaa", "balance": "-1"}]`,
+		`[{"type": "account", "address": "0xaa", "account": {}}]`,
+		`[{"type": "storage", "address": "0x50efbf12580138bc263c95757826df4e24eb81c9ff", "key": "0x1"}]`,
+		"- type: storage\n  address: 0xaa\n  key: 0x1\n  vaule: 0x2\n",
+	} {
+		if _, err := ParseModifications([]byte(input)); err == nil {
+			t.Errorf("no error for %s", input)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/miha-stopar/mpt/internal/oracletest"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// prestateSource returns a MemorySource holding the state with the given storage
+// (and some other accounts) at block blockNum. The tries are built independently of
+// the generator, so the nodes are available only through the source.
+func prestateSource(t *testing.T, blockNum int64, storage map[common.Address]map[common.Hash]common.Hash) (*oracle.MemorySource, common.Hash) {
+	alloc := make(oracle.GenesisAlloc)
+	for i := 0; i < 50; i++ {
+		storage[common.BigToAddress(big.NewInt(int64(i*7919+1)))] = nil
+	}
+	for addr, slots := range storage {
+		alloc[addr] = oracle.GenesisAccount{
+			Nonce:   1,
+			Balance: (*math.HexOrDecimal256)(big.NewInt(100)),
+			Storage: slots,
+		}
+	}
+	src, err := alloc.Source(uint64(blockNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := src.GetBlockByNumber(big.NewInt(blockNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return src, *header.Root
+}
+
+func TestGetParallelProofsPrestate(t *testing.T) {
+	addr := common.HexToAddress("0x40efbf12580138bc263c95757826df4e24eb81c9")
+	slots := make(map[common.Hash]common.Hash)
+	for i := 1; i <= 20; i++ {
+		slots[common.BigToHash(big.NewInt(int64(i)))] = common.BigToHash(big.NewInt(int64(100 + i)))
+	}
+	emptyAddr := common.HexToAddress("0x41efbf12580138bc263c95757826df4e24eb81c9")
+
+	tests := []struct {
+		name string
+		mods []TrieModification
+	}{
+		{"Update", []TrieModification{{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(3)), Value: common.HexToHash("0x5")}}},
+		{"Delete", []TrieModification{{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(3))}}},
+		{"Insert", []TrieModification{{Type: StorageMod, Address: addr, Key: common.HexToHash("0x1234"), Value: common.HexToHash("0x5")}}},
+		{"NonExisting", []TrieModification{{Type: StorageMod, Address: addr, Key: common.HexToHash("0x1234")}}},
+		{"NonExistingStorage", []TrieModification{{Type: NonExistingStorage, Address: addr, Key: common.HexToHash("0x1234")}}},
+		{"NonExistingStorageInEmpty", []TrieModification{{Type: NonExistingStorage, Address: emptyAddr, Key: common.HexToHash("0x1")}}},
+		{"StorageRead", []TrieModification{{Type: StorageRead, Address: addr, Key: common.BigToHash(big.NewInt(3)), Value: common.BigToHash(big.NewInt(103))}}},
+		{"BalanceRead", []TrieModification{{Type: BalanceRead, Address: addr, Balance: big.NewInt(100)}}},
+		{"InsertIntoEmpty", []TrieModification{{Type: StorageMod, Address: emptyAddr, Key: common.HexToHash("0x1"), Value: common.HexToHash("0x5")}}},
+		{"More", []TrieModification{
+			{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(7)), Value: common.HexToHash("0x5")},
+			{Type: StorageMod, Address: addr, Key: common.HexToHash("0x1234"), Value: common.HexToHash("0x6")},
+			{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(11)), Value: common.HexToHash("0x7")},
+		}},
+	}
+	for i, test := range tests {
+		blockNum := int64(1000 + i)
+		src, root := prestateSource(t, blockNum, map[common.Address]map[common.Hash]common.Hash{
+			addr:      slots,
+			emptyAddr: nil,
+		})
+		proof, err := GetParallelProofsFromSource(src, int(blockNum), test.mods)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		w, err := WitnessFromMatrix(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Verify(test.mods); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if w.Rows[0].SRoot != root {
+			t.Errorf("%s: witness doesn't start at the block state root", test.name)
+		}
+	}
+}
+
+// Different states at the same block number are proved concurrently, each with
+// its own oracle.
+func TestGetParallelProofsConcurrent(t *testing.T) {
+	const n = 4
+	blockNum := int64(2000)
+	key := common.BigToHash(big.NewInt(3))
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(0x1000 + i)))
+		slots := make(map[common.Hash]common.Hash)
+		for j := 1; j <= 10*(i+1); j++ {
+			slots[common.BigToHash(big.NewInt(int64(j)))] = common.BigToHash(big.NewInt(int64(i*100 + j)))
+		}
+		src, root := prestateSource(t, blockNum, map[common.Address]map[common.Hash]common.Hash{addr: slots})
+		mods := []TrieModification{
+			{Type: StorageRead, Address: addr, Key: key, Value: slots[key]},
+			{Type: StorageMod, Address: addr, Key: key, Value: common.HexToHash("0x5")},
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			proof, err := GetParallelProofsFromSource(src, int(blockNum), mods)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			w, err := WitnessFromMatrix(proof)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if err := w.Verify(mods); err != nil {
+				errs[i] = err
+				return
+			}
+			if w.Rows[0].SRoot != root {
+				errs[i] = fmt.Errorf("witness doesn't start at the block state root")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("state %d: %v", i, err)
+		}
+	}
+}
+
+func TestPrefetchProofs(t *testing.T) {
+	blockNum := int64(3000)
+	storage := make(map[common.Address]map[common.Hash]common.Hash)
+	var mods []TrieModification
+	for i := 0; i < 12; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(0x2000 + i)))
+		storage[addr] = make(map[common.Hash]common.Hash)
+		for j := 1; j <= 5; j++ {
+			key := common.BigToHash(big.NewInt(int64(j)))
+			storage[addr][key] = common.BigToHash(big.NewInt(int64(j)))
+			mods = append(mods, TrieModification{Type: StorageMod, Address: addr, Key: key, Value: common.BigToHash(big.NewInt(int64(10 + j)))})
+		}
+	}
+	memSrc, _ := prestateSource(t, blockNum, storage)
+	src := oracletest.NewCountingSource(memSrc)
+	src.Delay = 5 * time.Millisecond
+
+	statedb, err := newStateDB(oracle.NewOracle(src), int(blockNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := src.Calls(uint64(blockNum))
+	if err := prefetchProofs(mods, statedb); err != nil {
+		t.Fatal(err)
+	}
+	prefetched := src.Calls(uint64(blockNum))
+	// One request for each account with all its keys.
+	if prefetched-before != 12 {
+		t.Errorf("expected 12 eth_getProof calls, got %d", prefetched-before)
+	}
+	if src.MaxActive() > oracle.DefaultPrefetchWorkers {
+		t.Errorf("%d concurrent calls, at most %d expected", src.MaxActive(), oracle.DefaultPrefetchWorkers)
+	}
+
+	if err := loadStorage(mods, statedb); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := getParallelProofs(mods, statedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Calls(uint64(blockNum)) != prefetched {
+		t.Errorf("%d eth_getProof calls after the prefetch", src.Calls(uint64(blockNum))-prefetched)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Error(err)
+	}
+}
+
+// rpcServer serves eth_getBlockByNumber and eth_getProof (also in JSON-RPC batches)
+// from a MemorySource and records the number of eth_getProof calls of each batch.
+type rpcServer struct {
+	src     *oracle.MemorySource
+	lock    sync.Mutex
+	batches []int
+}
+
+type rpcRequest struct {
+	Id     uint64            `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+func (s *rpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var reqs []rpcRequest
+	batch := bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+	if batch {
+		err = json.Unmarshal(body, &reqs)
+	} else {
+		reqs = make([]rpcRequest, 1)
+		err = json.Unmarshal(body, &reqs[0])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resps := make([]map[string]interface{}, len(reqs))
+	proofs := 0
+	for i, req := range reqs {
+		if req.Method == "eth_getProof" {
+			proofs++
+		}
+		resps[i] = map[string]interface{}{"jsonrpc": "2.0", "id": req.Id, "result": s.result(req)}
+	}
+	if batch {
+		s.lock.Lock()
+		s.batches = append(s.batches, proofs)
+		s.lock.Unlock()
+		json.NewEncoder(w).Encode(resps)
+	} else {
+		json.NewEncoder(w).Encode(resps[0])
+	}
+}
+
+func (s *rpcServer) result(req rpcRequest) interface{} {
+	var number hexutil.Big
+	switch req.Method {
+	case "eth_getBlockByNumber":
+		if err := json.Unmarshal(req.Params[0], &number); err != nil {
+			return nil
+		}
+		header, err := s.src.GetBlockByNumber(number.ToInt())
+		if err != nil {
+			return nil
+		}
+		return header
+	case "eth_getProof":
+		var addr common.Address
+		var keys []common.Hash
+		if json.Unmarshal(req.Params[0], &addr) != nil || json.Unmarshal(req.Params[1], &keys) != nil ||
+			json.Unmarshal(req.Params[2], &number) != nil {
+			return nil
+		}
+		result, err := s.src.GetProof(number.ToInt(), addr, keys)
+		if err != nil {
+			return nil
+		}
+		return result
+	}
+	return nil
+}
+
+func TestGetParallelProofsRPC(t *testing.T) {
+	blockNum := int64(5000)
+	storage := make(map[common.Address]map[common.Hash]common.Hash)
+	var mods []TrieModification
+	for i := 0; i < 12; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(0x3000 + i)))
+		storage[addr] = make(map[common.Hash]common.Hash)
+		for j := 1; j <= 3; j++ {
+			key := common.BigToHash(big.NewInt(int64(j)))
+			storage[addr][key] = common.BigToHash(big.NewInt(int64(j)))
+			if j != 3 {
+				mods = append(mods, TrieModification{Type: StorageMod, Address: addr, Key: key, Value: common.BigToHash(big.NewInt(int64(10 + j)))})
+			}
+		}
+	}
+	src, root := prestateSource(t, blockNum, storage)
+	server := &rpcServer{src: src}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	rpcSrc := oracle.NewRPCSourceWithConfig(ts.URL, oracle.RPCConfig{CacheDir: t.TempDir()})
+	proof, err := GetParallelProofsFromSource(rpcSrc, int(blockNum), mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Error(err)
+	}
+	if w.Rows[0].SRoot != root {
+		t.Errorf("witness doesn't start at the block state root")
+	}
+	// All the accounts (with both keys) are fetched in one batch.
+	if len(server.batches) != 1 || server.batches[0] != 12 {
+		t.Errorf("expected one batch of 12 eth_getProof calls, got %v", server.batches)
+	}
+}
+
+// The bundle of a witness generation regenerates the same witness without the
+// original source.
+func TestBundle(t *testing.T) {
+	blockNum := int64(4000)
+	addr := common.HexToAddress("0x40efbf12580138bc263c95757826df4e24eb81c9")
+	slots := make(map[common.Hash]common.Hash)
+	for i := 1; i <= 20; i++ {
+		slots[common.BigToHash(big.NewInt(int64(i)))] = common.BigToHash(big.NewInt(int64(100 + i)))
+	}
+	src, root := prestateSource(t, blockNum, map[common.Address]map[common.Hash]common.Hash{addr: slots})
+	// The deletion fetches the proofs of the next block too.
+	src.AddHeader(testHeader(blockNum+1, root))
+
+	mods := []TrieModification{
+		{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(3))},
+		{Type: StorageMod, Address: addr, Key: common.BigToHash(big.NewInt(5)), Value: common.HexToHash("0x7")},
+		{Type: BalanceMod, Address: addr, Balance: big.NewInt(5)},
+	}
+	orc := oracle.NewOracle(src)
+	proof, err := GetParallelProofsWithOracle(orc, int(blockNum), mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := orc.Bundle().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := oracle.ReadBundle(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := bundle.Roots[uint64(blockNum+1)]; !ok || r != root {
+		t.Errorf("state root of the next block not in the bundle")
+	}
+	var again bytes.Buffer
+	if err := bundle.Write(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Errorf("bundle encoding changed after reading it")
+	}
+
+	proof2, err := GetParallelProofsFromSource(bundle.Source(), int(blockNum), mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if MatrixToJson(proof) != MatrixToJson(proof2) {
+		t.Errorf("witness from the bundle differs")
+	}
+}
+
+// truncatedSource returns account proofs with only the root node, the other
+// nodes are requested with Preimage, which returns preimageErr.
+type truncatedSource struct {
+	*oracle.MemorySource
+	preimageErr error
+	corrupt     bool
+}
+
+func (s *truncatedSource) GetProof(blockNumber *big.Int, addr common.Address, keys []common.Hash) (*oracle.AccountResult, error) {
+	result, err := s.MemorySource.GetProof(blockNumber, addr, keys)
+	if err == nil && len(result.AccountProof) > 1 {
+		result.AccountProof = result.AccountProof[:1]
+	}
+	return result, err
+}
+
+func (s *truncatedSource) Preimage(hash common.Hash) ([]byte, error) {
+	if s.corrupt {
+		return []byte{0xc0}, nil
+	}
+	return nil, s.preimageErr
+}
+
+// The errors of the oracle are passed on by the trie database, only a missing
+// preimage is a missing node.
+func TestTrieNodeErrorKinds(t *testing.T) {
+	addr := common.HexToAddress("0x40efbf12580138bc263c95757826df4e24eb81c9")
+	mods := []TrieModification{{Type: BalanceMod, Address: addr, Balance: big.NewInt(5)}}
+	tests := []struct {
+		name string
+		src  func(*oracle.MemorySource) oracle.NodeSource
+		kind string
+	}{
+		{"missing", func(m *oracle.MemorySource) oracle.NodeSource {
+			return &truncatedSource{MemorySource: m, preimageErr: oracle.ErrNotFound}
+		}, ErrKindMissingNode},
+		{"source error", func(m *oracle.MemorySource) oracle.NodeSource {
+			return &truncatedSource{MemorySource: m, preimageErr: errors.New("connection refused")}
+		}, ErrKindRPC},
+		{"corrupt", func(m *oracle.MemorySource) oracle.NodeSource {
+			return &truncatedSource{MemorySource: m, corrupt: true}
+		}, ErrKindInternal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem, _ := prestateSource(t, 1, map[common.Address]map[common.Hash]common.Hash{addr: nil})
+			_, err := GetParallelProofsFromSource(test.src(mem), 1, mods)
+			if err == nil {
+				t.Fatal("no error with a missing trie node")
+			}
+			if kind := ErrorKind(err); kind != test.kind {
+				t.Errorf("error kind %s, want %s: %v", kind, test.kind, err)
+			}
+			var corrupt *oracle.CorruptPreimageError
+			if test.name == "corrupt" && !errors.As(err, &corrupt) {
+				t.Errorf("expected a CorruptPreimageError, got %v", err)
+			}
+		})
+	}
+}
+
+// noPreimageSource doesn't serve the nodes that are not in the proofs.
+type noPreimageSource struct {
+	*oracle.MemorySource
+	err error
+}
+
+func (s *noPreimageSource) Preimage(hash common.Hash) ([]byte, error) {
+	return nil, s.err
+}
+
+// The neighbour node of the deleted key is only in the proofs as a hash, it is
+// resolved when the branch turns into it.
+func TestDeleteNeighbourNode(t *testing.T) {
+	addr := common.HexToAddress("0x40efbf12580138bc263c95757826df4e24eb81c9")
+	value := common.HexToHash("0x1111111111111111111111111111111111111111111111111111111111111111")
+	storage := map[common.Address]map[common.Hash]common.Hash{
+		addr: {common.HexToHash("0x1"): value, common.HexToHash("0x2"): value},
+	}
+	mods := []TrieModification{{Type: StorageMod, Address: addr, Key: common.HexToHash("0x1")}}
+	mem, _ := prestateSource(t, 1, storage)
+
+	proof, err := GetParallelProofsFromSource(mem, 1, mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Error(err)
+	}
+
+	src := &noPreimageSource{MemorySource: mem, err: errors.New("connection refused")}
+	_, err = GetParallelProofsFromSource(src, 1, mods)
+	if kind := ErrorKind(err); kind != ErrKindRPC {
+		t.Errorf("error kind %s with the neighbour node unavailable, want %s: %v", kind, ErrKindRPC, err)
+	}
+}
@@ -0,0 +1,291 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/state"
+)
+
+// recordingStateDB is the StateDB the EVM executes the transactions on: it
+// records the storage reads and writes and the changes of the account fields as
+// modifications, in the order of the execution. The modifications recorded
+// after a snapshot are dropped when the EVM reverts to it.
+type recordingStateDB struct {
+	*state.StateDB
+
+	mods      []TrieModification
+	txStart   int         // index of the first modification of the current transaction
+	snapshots map[int]int // snapshot id -> number of modifications at the snapshot
+
+	// Accounts changed by the current transaction and whether they existed
+	// before the transaction.
+	touched map[common.Address]bool
+}
+
+func newRecordingStateDB(statedb *state.StateDB) *recordingStateDB {
+	return &recordingStateDB{
+		StateDB:   statedb,
+		snapshots: make(map[int]int),
+		touched:   make(map[common.Address]bool),
+	}
+}
+
+// touch remembers whether the account existed before the transaction changed it.
+func (s *recordingStateDB) touch(addr common.Address) {
+	if _, ok := s.touched[addr]; !ok {
+		s.touched[addr] = s.StateDB.Exist(addr)
+	}
+}
+
+func (s *recordingStateDB) record(mod TrieModification) {
+	s.mods = append(s.mods, mod)
+}
+
+// GetState records the storage read (NonExistingStorage if the slot is empty).
+// Reading the slot is the first step of SSTORE too, such a read is removed by
+// SetState.
+func (s *recordingStateDB) GetState(addr common.Address, key common.Hash) common.Hash {
+	value := s.StateDB.GetState(addr, key)
+	if !s.StateDB.Exist(addr) {
+		return value
+	}
+	if value == (common.Hash{}) {
+		s.record(TrieModification{Type: NonExistingStorage, Address: addr, Key: key})
+	} else {
+		s.record(TrieModification{Type: StorageRead, Address: addr, Key: key, Value: value})
+	}
+	return value
+}
+
+func (s *recordingStateDB) SetState(addr common.Address, key, value common.Hash) {
+	s.touch(addr)
+	if n := len(s.mods); n > 0 && s.mods[n-1].Address == addr && s.mods[n-1].Key == key &&
+		(s.mods[n-1].Type == StorageRead || s.mods[n-1].Type == NonExistingStorage) {
+		s.mods = s.mods[:n-1]
+	}
+	s.StateDB.SetState(addr, key, value)
+	s.record(TrieModification{Type: StorageMod, Address: addr, Key: key, Value: value})
+}
+
+func (s *recordingStateDB) CreateAccount(addr common.Address) {
+	s.touch(addr)
+	s.StateDB.CreateAccount(addr)
+	s.record(TrieModification{Type: CreateAccount, Address: addr})
+}
+
+func (s *recordingStateDB) SetNonce(addr common.Address, nonce uint64) {
+	s.touch(addr)
+	s.StateDB.SetNonce(addr, nonce)
+	s.record(TrieModification{Type: NonceMod, Address: addr, Nonce: nonce})
+}
+
+func (s *recordingStateDB) AddBalance(addr common.Address, amount *big.Int) {
+	s.touch(addr)
+	s.StateDB.AddBalance(addr, amount)
+	if amount.Sign() != 0 {
+		s.record(TrieModification{Type: BalanceMod, Address: addr, Balance: s.StateDB.GetBalance(addr)})
+	}
+}
+
+func (s *recordingStateDB) SubBalance(addr common.Address, amount *big.Int) {
+	s.touch(addr)
+	s.StateDB.SubBalance(addr, amount)
+	if amount.Sign() != 0 {
+		s.record(TrieModification{Type: BalanceMod, Address: addr, Balance: s.StateDB.GetBalance(addr)})
+	}
+}
+
+func (s *recordingStateDB) SetCode(addr common.Address, code []byte) {
+	s.touch(addr)
+	s.StateDB.SetCode(addr, code)
+	s.record(TrieModification{Type: CodeHashMod, Address: addr, CodeHash: code})
+}
+
+// Suicide clears the balance, the account is deleted at the end of the
+// transaction (see finalise).
+func (s *recordingStateDB) Suicide(addr common.Address) bool {
+	s.touch(addr)
+	if !s.StateDB.Suicide(addr) {
+		return false
+	}
+	s.record(TrieModification{Type: BalanceMod, Address: addr, Balance: new(big.Int)})
+	return true
+}
+
+func (s *recordingStateDB) Snapshot() int {
+	id := s.StateDB.Snapshot()
+	s.snapshots[id] = len(s.mods)
+	return id
+}
+
+func (s *recordingStateDB) RevertToSnapshot(id int) {
+	s.StateDB.RevertToSnapshot(id)
+	s.mods = s.mods[:s.snapshots[id]]
+}
+
+// finalise ends the transaction: the destructed accounts (and the empty touched
+// accounts if deleteEmpty is set) are deleted.
+func (s *recordingStateDB) finalise(deleteEmpty bool) {
+	// The modifications only create an account, they never delete one, so an
+	// account exists after the modifications if it existed before or was changed.
+	exists := make(map[common.Address]bool)
+	for addr, existed := range s.touched {
+		exists[addr] = existed
+	}
+	for _, mod := range s.mods[s.txStart:] {
+		if mod.Type != StorageRead && mod.Type != NonExistingStorage {
+			exists[mod.Address] = true
+		}
+	}
+
+	s.StateDB.Finalise(deleteEmpty)
+	addrs := make([]common.Address, 0, len(exists))
+	for addr := range exists {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	for _, addr := range addrs {
+		if exists[addr] && !s.StateDB.Exist(addr) {
+			s.record(TrieModification{Type: DeleteAccount, Address: addr})
+		}
+	}
+
+	s.touched = make(map[common.Address]bool)
+	s.snapshots = make(map[int]int)
+	s.txStart = len(s.mods)
+}
+
+// ReplayBlock executes the transactions of block blockNum with the EVM on the
+// state of the parent block and returns the modifications in the order of the
+// execution, together with the state root after the transactions: for each
+// SLOAD a StorageRead (NonExistingStorage for an empty slot), for each SSTORE a
+// StorageMod, NonceMod, BalanceMod, CodeHashMod and CreateAccount for the
+// changes of the account fields, and DeleteAccount for the accounts deleted at
+// the end of a transaction. The modifications of the reverted calls are
+// dropped. The block and uncle rewards (see blockRewards) are BalanceMods at the
+// end. A nil config means mainnet.
+func ReplayBlock(src oracle.NodeSource, blockNum int, config *params.ChainConfig) ([]TrieModification, common.Hash, error) {
+	return replayBlock(oracle.NewOracle(src), blockNum, config)
+}
+
+// replayBlock is ReplayBlock with the state obtained through orc.
+func replayBlock(orc *oracle.Oracle, blockNum int, config *params.ChainConfig) ([]TrieModification, common.Hash, error) {
+	if config == nil {
+		config = params.MainnetChainConfig
+	}
+	src := orc.Source()
+	block, err := src.GetBlockByNumber(big.NewInt(int64(blockNum)))
+	if err != nil {
+		return nil, common.Hash{}, &oracle.SourceError{Method: "eth_getBlockByNumber", Err: err}
+	}
+	header := block.ToHeader()
+
+	statedb, err := newStateDB(orc, blockNum-1)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	recorder := newRecordingStateDB(statedb)
+
+	blockCtx := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		GetHash: func(n uint64) common.Hash {
+			h, err := src.GetBlockByNumber(new(big.Int).SetUint64(n))
+			if err != nil {
+				return common.Hash{}
+			}
+			hh := h.ToHeader()
+			return hh.Hash()
+		},
+		Coinbase:    header.Coinbase,
+		GasLimit:    header.GasLimit,
+		BlockNumber: new(big.Int).Set(header.Number),
+		Time:        new(big.Int).SetUint64(header.Time),
+		Difficulty:  header.Difficulty,
+		BaseFee:     header.BaseFee,
+	}
+	signer := types.MakeSigner(config, header.Number)
+	gp := new(core.GasPool).AddGas(header.GasLimit)
+	for i, args := range block.Transactions {
+		tx := args.ToTransaction()
+		msg, err := tx.AsMessage(signer, header.BaseFee)
+		if err != nil {
+			return nil, common.Hash{}, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		statedb.Prepare(tx.Hash(), i)
+		evm := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), recorder, config, vm.Config{})
+		if _, err := core.ApplyMessage(evm, msg, gp); err != nil {
+			return nil, common.Hash{}, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		recorder.finalise(config.IsEIP158(header.Number))
+		if err := statedb.Error(); err != nil {
+			return nil, common.Hash{}, err
+		}
+	}
+
+	uncles, err := blockUncles(src, block)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	for _, r := range blockRewards(config, &header, uncles) {
+		recorder.AddBalance(r.Address, r.Amount)
+	}
+	recorder.finalise(config.IsEIP158(header.Number))
+
+	return recorder.mods, statedb.IntermediateRoot(config.IsEIP158(header.Number)), nil
+}
+
+// GetReplayProofs generates the witness for the modifications of the block
+// obtained by executing its transactions (see ReplayBlock). As in
+// GetBlockProofs, the state root after the modifications is checked against the
+// block header. The modifications are returned too (they are needed to verify
+// the witness).
+func GetReplayProofs(src oracle.NodeSource, blockNum int, config *params.ChainConfig) ([][]byte, []TrieModification, error) {
+	return GetReplayProofsWithOracle(oracle.NewOracle(src), blockNum, config)
+}
+
+// GetReplayProofsWithOracle is like GetReplayProofs, but the state is obtained
+// through orc (see GetParallelProofsWithOracle). The replay and the witness
+// generation share the preimages of orc.
+func GetReplayProofsWithOracle(orc *oracle.Oracle, blockNum int, config *params.ChainConfig) ([][]byte, []TrieModification, error) {
+	trieModifications, replayRoot, err := replayBlock(orc, blockNum, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	statedb, err := newStateDB(orc, blockNum-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := prefetchProofs(trieModifications, statedb); err != nil {
+		return nil, nil, err
+	}
+	if err := loadStorage(trieModifications, statedb); err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := getParallelProofs(trieModifications, statedb)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The modifications need to lead to the state the transactions left.
+	if root := statedb.GetTrie().Hash(); root != replayRoot {
+		return nil, nil, fmt.Errorf("state root %s after the modifications doesn't match the root %s after the replay", root.Hex(), replayRoot.Hex())
+	}
+	if err := checkStateRoot(orc.Source(), statedb, blockNum, trieModifications); err != nil {
+		return nil, nil, err
+	}
+
+	return proof, trieModifications, nil
+}
@@ -0,0 +1,233 @@
+package witness
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/miha-stopar/mpt/internal/oracletest"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// replayCode increments slot 0 and clears slot 1:
+// PUSH1 0 SLOAD PUSH1 1 ADD PUSH1 0 SSTORE PUSH1 0 PUSH1 1 SSTORE STOP
+var replayCode = common.FromHex("0x600054600101600055600060015500")
+
+// txArgs returns the transaction as eth_getBlockByNumber returns it.
+func txArgs(tx *types.Transaction, from common.Address) oracle.SendTxArgs {
+	v, r, s := tx.RawSignatureValues()
+	to := common.NewMixedcaseAddress(*tx.To())
+	input := hexutil.Bytes(tx.Data())
+	return oracle.SendTxArgs{
+		From:     common.NewMixedcaseAddress(from),
+		To:       &to,
+		Gas:      hexutil.Uint64(tx.Gas()),
+		GasPrice: (*hexutil.Big)(tx.GasPrice()),
+		Value:    hexutil.Big(*tx.Value()),
+		Nonce:    hexutil.Uint64(tx.Nonce()),
+		Input:    &input,
+		V:        (*hexutil.Big)(v),
+		R:        (*hexutil.Big)(r),
+		S:        (*hexutil.Big)(s),
+	}
+}
+
+// rpcHeader returns the header as eth_getBlockByNumber returns it.
+func rpcHeader(h *types.Header) *oracle.Header {
+	gasLimit, gasUsed, time := hexutil.Uint64(h.GasLimit), hexutil.Uint64(h.GasUsed), hexutil.Uint64(h.Time)
+	extra := hexutil.Bytes(h.Extra)
+	return &oracle.Header{
+		ParentHash: &h.ParentHash, UncleHash: &h.UncleHash, Coinbase: &h.Coinbase, Root: &h.Root,
+		TxHash: &h.TxHash, ReceiptHash: &h.ReceiptHash, Bloom: &h.Bloom, Difficulty: (*hexutil.Big)(h.Difficulty),
+		Number: (*hexutil.Big)(h.Number), GasLimit: &gasLimit, GasUsed: &gasUsed, Time: &time, Extra: &extra,
+		MixDigest: &h.MixDigest, Nonce: &h.Nonce, BaseFee: (*hexutil.Big)(h.BaseFee),
+	}
+}
+
+// addGethBlock builds block 1 on the state of alloc with the chain maker of geth
+// and adds its header (with the state root geth computed) and its uncles to src,
+// which holds the state of alloc at block 0. The blocks are finalized by ethash
+// without the proof of work check, so the block and uncle rewards are paid. gen
+// adds the transactions and uncles of the block.
+func addGethBlock(t *testing.T, src *oracle.MemorySource, alloc oracle.GenesisAlloc, gen func(*core.BlockGen)) *types.Block {
+	config := params.AllEthashProtocolChanges
+	gethAlloc := make(core.GenesisAlloc)
+	for addr, account := range alloc {
+		balance := new(big.Int)
+		if account.Balance != nil {
+			balance = (*big.Int)(account.Balance)
+		}
+		gethAlloc[addr] = core.GenesisAccount{Code: account.Code, Storage: account.Storage, Balance: balance, Nonce: uint64(account.Nonce)}
+	}
+	db := rawdb.NewMemoryDatabase()
+	genesis := (&core.Genesis{Config: config, Alloc: gethAlloc}).MustCommit(db)
+	parent, err := src.GetBlockByNumber(big.NewInt(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.Root() != *parent.Root {
+		t.Fatalf("geth genesis root %s, the source has %s", genesis.Root().Hex(), parent.Root.Hex())
+	}
+
+	blocks, _ := core.GenerateChain(config, genesis, ethash.NewFaker(), db, 1, func(i int, b *core.BlockGen) {
+		gen(b)
+	})
+	block := blocks[0]
+	header := rpcHeader(block.Header())
+	signer := types.MakeSigner(config, block.Number())
+	for _, tx := range block.Transactions() {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header.Transactions = append(header.Transactions, txArgs(tx, from))
+	}
+	for _, uncle := range block.Uncles() {
+		header.Uncles = append(header.Uncles, uncle.Hash())
+		src.AddUncle(1, rpcHeader(uncle))
+	}
+	src.AddHeader(header)
+	return block
+}
+
+// replaySource returns the state with a sender and the replayCode contract at
+// block 0 and block 1 (built by geth) with a transfer to a new account, a call of
+// the contract and an uncle.
+func replaySource(t *testing.T) (*oracle.MemorySource, *types.Block, common.Address, common.Address) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+	contract := common.HexToAddress("0xc0de")
+	recipient := common.HexToAddress("0x50efbf12580138bc263c95757826df4e24eb81c9")
+
+	alloc := oracle.GenesisAlloc{
+		sender: {Balance: math.NewHexOrDecimal256(1e18)},
+		contract: {Code: replayCode, Storage: map[common.Hash]common.Hash{
+			common.HexToHash("0x0"): common.HexToHash("0x5"),
+			common.HexToHash("0x1"): common.HexToHash("0x7"),
+		}},
+	}
+	for i := 0; i < 16; i++ {
+		alloc[common.BigToAddress(big.NewInt(int64(0x1000+i)))] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(1)}
+	}
+	src, err := alloc.Source(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := addGethBlock(t, src, alloc, func(b *core.BlockGen) {
+		b.SetCoinbase(common.HexToAddress("0xc0ffee"))
+		signer := types.MakeSigner(params.AllEthashProtocolChanges, b.Number())
+		gasPrice := new(big.Int).Add(b.BaseFee(), big.NewInt(10))
+		txs := []*types.Transaction{
+			types.NewTransaction(0, recipient, big.NewInt(1000), 21000, gasPrice, nil),
+			types.NewTransaction(1, contract, nil, 100000, gasPrice, nil),
+		}
+		for _, tx := range txs {
+			signed, err := types.SignTx(tx, signer, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.AddTx(signed)
+		}
+		b.AddUncle(&types.Header{Number: big.NewInt(0), Coinbase: common.HexToAddress("0xaaaa"), Difficulty: big.NewInt(1)})
+	})
+
+	return src, block, contract, recipient
+}
+
+func TestReplayBlock(t *testing.T) {
+	src, block, contract, recipient := replaySource(t)
+	mods, root, err := ReplayBlock(src, 1, params.AllEthashProtocolChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != block.Root() {
+		t.Errorf("replay root %s, geth computed %s", root.Hex(), block.Root().Hex())
+	}
+
+	var storage []TrieModification
+	created := false
+	for _, mod := range mods {
+		if mod.Address == contract && mod.Type != BalanceMod && mod.Type != NonceMod {
+			storage = append(storage, mod)
+		}
+		if mod.Type == CreateAccount && mod.Address == recipient {
+			created = true
+		}
+	}
+	want := []TrieModification{
+		{Type: StorageRead, Address: contract, Key: common.HexToHash("0x0"), Value: common.HexToHash("0x5")},
+		{Type: StorageMod, Address: contract, Key: common.HexToHash("0x0"), Value: common.HexToHash("0x6")},
+		{Type: StorageMod, Address: contract, Key: common.HexToHash("0x1")},
+	}
+	if !reflect.DeepEqual(storage, want) {
+		t.Errorf("got storage modifications\n%+v\nwant\n%+v", storage, want)
+	}
+	if !created {
+		t.Errorf("recipient not created: %+v", mods)
+	}
+
+	// The uncle is needed for its reward.
+	var sourceErr *oracle.SourceError
+	if _, _, err := ReplayBlock(struct{ oracle.NodeSource }{src}, 1, params.AllEthashProtocolChanges); !errors.As(err, &sourceErr) || sourceErr.Method != "eth_getUncleByBlockNumberAndIndex" {
+		t.Errorf("replay without the uncle source: expected an uncle error, got %v", err)
+	}
+
+	header, err := src.GetBlockByNumber(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := *header
+	wrong.Root = &common.Hash{}
+	src.AddHeader(&wrong)
+	var mismatch *StateRootMismatchError
+	if _, _, err := GetReplayProofs(src, 1, params.AllEthashProtocolChanges); !errors.As(err, &mismatch) {
+		t.Fatalf("expected a state root mismatch, got %v", err)
+	}
+	src.AddHeader(header)
+
+	// The replay and the witness generation share the oracle, the state of the
+	// parent block is fetched only once.
+	counting := oracletest.NewCountingSource(src)
+	if _, _, err := ReplayBlock(counting, 1, params.AllEthashProtocolChanges); err != nil {
+		t.Fatal(err)
+	}
+	replayCalls := counting.Calls(0)
+	counting.Reset()
+	proof, proofMods, err := GetReplayProofs(counting, 1, params.AllEthashProtocolChanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counting.Calls(0) != replayCalls {
+		t.Errorf("%d eth_getProof calls for the parent block, the replay alone needs %d", counting.Calls(0), replayCalls)
+	}
+	if !reflect.DeepEqual(proofMods, mods) {
+		t.Errorf("GetReplayProofs modifications differ from ReplayBlock")
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(mods); err != nil {
+		t.Fatal(err)
+	}
+	var last WitnessRow
+	for _, row := range w.Rows {
+		if row.Kind != RowHash {
+			last = row
+		}
+	}
+	if last.CRoot != root {
+		t.Errorf("witness ends at root %s, the replay at %s", last.CRoot.Hex(), root.Hex())
+	}
+}
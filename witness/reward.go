@@ -0,0 +1,100 @@
+package witness
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// blockReward is a balance increase paid by ethash after the transactions of the
+// block.
+type blockReward struct {
+	Address common.Address
+	Amount  *big.Int
+}
+
+// blockRewards returns the rewards ethash pays for the block, in the order
+// geth adds them: the miner of each uncle first, then the miner of the block. There
+// are no rewards if the chain doesn't use ethash or the difficulty is 0 (the proof
+// of stake blocks and the test headers of oracle.NewHeader).
+func blockRewards(config *params.ChainConfig, header *types.Header, uncles []*types.Header) []blockReward {
+	if config.Ethash == nil || header.Difficulty == nil || header.Difficulty.Sign() == 0 || config.IsCatalyst(header.Number) {
+		return nil
+	}
+	reward := ethash.FrontierBlockReward
+	if config.IsByzantium(header.Number) {
+		reward = ethash.ByzantiumBlockReward
+	}
+	if config.IsConstantinople(header.Number) {
+		reward = ethash.ConstantinopleBlockReward
+	}
+
+	var rewards []blockReward
+	minerReward := new(big.Int).Set(reward)
+	for _, uncle := range uncles {
+		r := new(big.Int).Add(uncle.Number, big.NewInt(8))
+		r.Sub(r, header.Number)
+		r.Mul(r, reward)
+		r.Div(r, big.NewInt(8))
+		rewards = append(rewards, blockReward{uncle.Coinbase, r})
+
+		minerReward.Add(minerReward, new(big.Int).Div(reward, big.NewInt(32)))
+	}
+	return append(rewards, blockReward{header.Coinbase, minerReward})
+}
+
+// blockUncles returns the uncle headers of the block, each is checked against
+// the hash in the block.
+func blockUncles(src oracle.NodeSource, block *oracle.Header) ([]*types.Header, error) {
+	if len(block.Uncles) == 0 {
+		return nil, nil
+	}
+	uncleSrc, ok := src.(oracle.UncleSource)
+	if !ok {
+		return nil, &oracle.SourceError{Method: "eth_getUncleByBlockNumberAndIndex", Err: fmt.Errorf("the source doesn't provide the uncles")}
+	}
+	uncles := make([]*types.Header, len(block.Uncles))
+	for i, hash := range block.Uncles {
+		uncle, err := uncleSrc.GetUncleByBlockNumberAndIndex(block.Number.ToInt(), i)
+		if err != nil {
+			return nil, &oracle.SourceError{Method: "eth_getUncleByBlockNumberAndIndex", Err: err}
+		}
+		header := uncle.ToHeader()
+		if header.Hash() != hash {
+			return nil, &oracle.SourceError{Method: "eth_getUncleByBlockNumberAndIndex", Err: fmt.Errorf("uncle %d has the hash %s, the block has %s", i, header.Hash().Hex(), hash.Hex())}
+		}
+		uncles[i] = &header
+	}
+	return uncles, nil
+}
+
+// appendRewards appends a BalanceMod for each block reward to the modifications of
+// the state diffs. The balance before the reward is the balance the modifications
+// left, or the balance in the parent state if they don't change it.
+func appendRewards(trieModifications []TrieModification, rewards []blockReward, balance func(common.Address) *big.Int) []TrieModification {
+	for _, r := range rewards {
+		base := balance(r.Address)
+		for _, mod := range trieModifications {
+			if mod.Address != r.Address {
+				continue
+			}
+			switch {
+			case mod.Type == BalanceMod:
+				base = mod.Balance
+			case mod.Type == AccountMod && mod.Account.Balance != nil:
+				base = mod.Account.Balance
+			case mod.Type == DeleteAccount || mod.Type == CreateAccount:
+				base = new(big.Int)
+			}
+		}
+		trieModifications = append(trieModifications, TrieModification{
+			Type: BalanceMod, Address: r.Address, Balance: new(big.Int).Add(base, r.Amount),
+		})
+	}
+	return trieModifications
+}
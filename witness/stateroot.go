@@ -0,0 +1,182 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/state"
+	"github.com/miha-stopar/mpt/trie"
+)
+
+// checkStateRoot compares the state root of statedb (with the modifications
+// applied) with the state root in the header of block blockNum.
+func checkStateRoot(src oracle.NodeSource, statedb *state.StateDB, blockNum int, trieModifications []TrieModification) error {
+	header, err := src.GetBlockByNumber(big.NewInt(int64(blockNum)))
+	if err != nil {
+		return &oracle.SourceError{Method: "eth_getBlockByNumber", Err: err}
+	}
+	root := statedb.GetTrie().Hash()
+	if root == *header.Root {
+		return nil
+	}
+
+	mismatch := &StateRootMismatchError{Block: blockNum, Header: *header.Root, Root: root}
+	if err := locateStateDifference(mismatch, statedb, blockNum, trieModifications); err != nil {
+		mismatch.Msg = fmt.Sprintf("the difference couldn't be located: %v", err)
+	}
+	return mismatch
+}
+
+// locateStateDifference finds the first account (and storage slot) in which the
+// state of statedb differs from the state of the header root. The proofs of the
+// modified accounts and slots in the header state are fetched first, so that the
+// difference is found if it is on their path.
+func locateStateDifference(mismatch *StateRootMismatchError, statedb *state.StateDB, blockNum int, trieModifications []TrieModification) error {
+	addresses := make(map[common.Hash]common.Address)
+	keys := make(map[common.Hash]common.Hash)
+	var reqs []oracle.ProofRequest
+	for _, tMod := range trieModifications {
+		addresses[crypto.Keccak256Hash(tMod.Address[:])] = tMod.Address
+		req := oracle.ProofRequest{BlockNumber: big.NewInt(int64(blockNum)), Address: tMod.Address}
+		if tMod.Type == StorageMod || tMod.Type == NonExistingStorage || tMod.Type == StorageRead {
+			keys[crypto.Keccak256Hash(tMod.Key[:])] = tMod.Key
+			req.Keys = []common.Hash{tMod.Key}
+		}
+		reqs = append(reqs, req)
+	}
+	if err := statedb.Db.Oracle.Prefetch(reqs, 0); err != nil {
+		return err
+	}
+
+	expected, err := statedb.Db.OpenTrie(mismatch.Header)
+	if err != nil {
+		return err
+	}
+	key, want, got, err := firstLeafDifference(expected.(*trie.SecureTrie), statedb.GetTrie().(*trie.SecureTrie))
+	if err != nil {
+		return err
+	}
+	addr, ok := addresses[common.BytesToHash(key)]
+	if !ok {
+		mismatch.Msg = fmt.Sprintf("account with the hash %x differs", key)
+		return nil
+	}
+	mismatch.Address = &addr
+	switch {
+	case want == nil:
+		mismatch.Msg = fmt.Sprintf("account %s is not in the header state", addr.Hex())
+		return nil
+	case got == nil:
+		mismatch.Msg = fmt.Sprintf("account %s is missing", addr.Hex())
+		return nil
+	}
+
+	var wantAccount, gotAccount oracle.Account
+	if err := rlp.DecodeBytes(want, &wantAccount); err != nil {
+		return err
+	}
+	if err := rlp.DecodeBytes(got, &gotAccount); err != nil {
+		return err
+	}
+	var diffs []string
+	if gotAccount.Nonce != wantAccount.Nonce {
+		diffs = append(diffs, fmt.Sprintf("nonce %d, the header state has %d", gotAccount.Nonce, wantAccount.Nonce))
+	}
+	if gotAccount.Balance.Cmp(wantAccount.Balance) != 0 {
+		diffs = append(diffs, fmt.Sprintf("balance %v, the header state has %v", gotAccount.Balance, wantAccount.Balance))
+	}
+	if !bytes.Equal(gotAccount.CodeHash, wantAccount.CodeHash) {
+		diffs = append(diffs, fmt.Sprintf("code hash %x, the header state has %x", gotAccount.CodeHash, wantAccount.CodeHash))
+	}
+	if gotAccount.Root != wantAccount.Root {
+		diffs = append(diffs, fmt.Sprintf("storage root %s, the header state has %s", gotAccount.Root.Hex(), wantAccount.Root.Hex()))
+	}
+	mismatch.Msg = fmt.Sprintf("account %s: %s", addr.Hex(), joinDiffs(diffs))
+	if gotAccount.Root == wantAccount.Root {
+		return nil
+	}
+
+	expectedStorage, err := statedb.Db.OpenStorageTrie(common.BytesToHash(key), wantAccount.Root)
+	if err != nil {
+		return err
+	}
+	gotStorage := statedb.StorageTrie(addr)
+	if gotStorage == nil {
+		return nil
+	}
+	key, want, got, err = firstLeafDifference(expectedStorage.(*trie.SecureTrie), gotStorage.(*trie.SecureTrie))
+	if err != nil {
+		return err
+	}
+	slot, ok := keys[common.BytesToHash(key)]
+	if !ok {
+		mismatch.Msg = fmt.Sprintf("account %s: storage slot with the hash %x differs", addr.Hex(), key)
+		return nil
+	}
+	mismatch.Slot = &slot
+	mismatch.Msg = fmt.Sprintf("account %s, storage slot %s: value %s, the header state has %s",
+		addr.Hex(), slot.Hex(), storageValue(got).Hex(), storageValue(want).Hex())
+	return nil
+}
+
+func joinDiffs(diffs []string) string {
+	var b bytes.Buffer
+	for i, d := range diffs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(d)
+	}
+	return b.String()
+}
+
+// storageValue decodes the value of a storage leaf, nil is an empty slot.
+func storageValue(leaf []byte) common.Hash {
+	if leaf == nil {
+		return common.Hash{}
+	}
+	_, content, _, err := rlp.Split(leaf)
+	if err != nil {
+		return common.Hash{}
+	}
+	return common.BytesToHash(content)
+}
+
+// firstLeafDifference returns the (hashed) key of the first leaf in which the
+// tries differ, with the leaf values (nil if the trie doesn't have the key). The
+// tries are walked with difference iterators, so only the subtrees that differ are
+// resolved.
+func firstLeafDifference(expected, got *trie.SecureTrie) ([]byte, []byte, []byte, error) {
+	first := func(a, b trie.NodeIterator) ([]byte, []byte, error) {
+		it, _ := trie.NewDifferenceIterator(a, b)
+		for it.Next(true) {
+			if it.Leaf() {
+				return common.CopyBytes(it.LeafKey()), common.CopyBytes(it.LeafBlob()), nil
+			}
+		}
+		return nil, nil, it.Error()
+	}
+	gotKey, gotLeaf, err := first(expected.NodeIterator(nil), got.NodeIterator(nil))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wantKey, wantLeaf, err := first(got.NodeIterator(nil), expected.NodeIterator(nil))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	switch {
+	case gotKey == nil && wantKey == nil:
+		return nil, nil, nil, fmt.Errorf("no leaf differs")
+	case wantKey == nil || gotKey != nil && bytes.Compare(gotKey, wantKey) < 0:
+		return gotKey, nil, gotLeaf, nil
+	case gotKey == nil || bytes.Compare(wantKey, gotKey) < 0:
+		return wantKey, wantLeaf, nil, nil
+	}
+	return gotKey, wantLeaf, gotLeaf, nil
+}
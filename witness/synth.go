@@ -0,0 +1,416 @@
+package witness
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/trie"
+)
+
+// maxShapeNibble is the deepest nibble at which the keys of a synthesized trie
+// can diverge: finding a key whose hash has a given prefix of n nibbles takes
+// about 16^n hashes.
+const maxShapeNibble = 5
+
+// ShapeModification is the modification of the key of a TrieShape.
+type ShapeModification int
+
+const (
+	ShapeUpdate ShapeModification = iota // the key exists before and after the modification
+	ShapeInsert                          // the key is added
+	ShapeDelete                          // the key is removed
+)
+
+func (m ShapeModification) String() string {
+	switch m {
+	case ShapeUpdate:
+		return "update"
+	case ShapeInsert:
+		return "insert"
+	case ShapeDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// TrieShape is the shape of the trie on the path of a modified key, as the
+// witness sees it in the proof of the key. SynthesizeTrie finds the keys that
+// give the shape.
+type TrieShape struct {
+	Modification ShapeModification
+
+	// Account selects the account trie (the key is an address, modified by
+	// BalanceMod or DeleteAccount), otherwise the key is a storage key of
+	// Address (modified by StorageMod).
+	Account bool
+	Address common.Address
+
+	// Branches is the number of branches above the leaf of the key (not
+	// counting the placeholder branch).
+	Branches int
+
+	// ExtensionNibbles, if not 0, puts an extension node with this number of
+	// nibbles (an odd number gives an odd key) above the branch ExtensionDepth
+	// (0 is the first branch).
+	ExtensionNibbles int
+	ExtensionDepth   int
+
+	// Placeholder makes the inserted (deleted) key turn the leaf at its position
+	// into a branch (the branch into a leaf): the leaf drifts into the branch
+	// which is a placeholder on the other side. With DriftedNibbles the new
+	// branch is below an extension node with this number of nibbles.
+	Placeholder    bool
+	DriftedNibbles int
+
+	// LongLeaf makes the RLP of the storage leaf longer than 55 bytes (a 32 bytes
+	// value), the account leaves are always long.
+	LongLeaf bool
+}
+
+// SynthesizedTrie is a state with the shape of a TrieShape and the modification
+// of the shape.
+type SynthesizedTrie struct {
+	// Alloc is the state before the modification, it contains only the keys
+	// needed for the shape (for a storage shape, in the storage of the only
+	// account).
+	Alloc oracle.GenesisAlloc
+	Mods  []TrieModification
+}
+
+// Source returns the state before the modification at block blockNumber.
+func (s *SynthesizedTrie) Source(blockNumber uint64) (*oracle.MemorySource, error) {
+	return s.Alloc.Source(blockNumber)
+}
+
+func (shape TrieShape) validate() error {
+	switch {
+	case shape.Modification < ShapeUpdate || shape.Modification > ShapeDelete:
+		return fmt.Errorf("invalid modification %v", shape.Modification)
+	case shape.Branches < 0 || shape.ExtensionNibbles < 0 || shape.DriftedNibbles < 0:
+		return fmt.Errorf("negative number of branches or nibbles")
+	case shape.ExtensionNibbles > 0 && (shape.ExtensionDepth < 0 || shape.ExtensionDepth >= shape.Branches):
+		return fmt.Errorf("extension node above branch %d, but there are %d branches", shape.ExtensionDepth, shape.Branches)
+	case shape.Placeholder && shape.Modification == ShapeUpdate:
+		return fmt.Errorf("an update doesn't add or remove a placeholder branch")
+	case shape.DriftedNibbles > 0 && !shape.Placeholder:
+		return fmt.Errorf("drifted nibbles without a placeholder branch")
+	}
+	if n := shape.deepestNibble(); n > maxShapeNibble {
+		return fmt.Errorf("the keys need to diverge at nibble %d, at most %d is supported", n, maxShapeNibble)
+	}
+	return nil
+}
+
+// branchNibbles returns the positions (in the key nibbles) of the branches above
+// the leaf of the key and the position of the leaf.
+func (shape TrieShape) branchNibbles() ([]int, int) {
+	var branches []int
+	pos := 0
+	for i := 0; i < shape.Branches; i++ {
+		if shape.ExtensionNibbles > 0 && i == shape.ExtensionDepth {
+			pos += shape.ExtensionNibbles
+		}
+		branches = append(branches, pos)
+		pos++
+	}
+	return branches, pos
+}
+
+// deepestNibble returns the position of the deepest nibble at which two keys
+// diverge, -1 if there is only one key.
+func (shape TrieShape) deepestNibble() int {
+	branches, leaf := shape.branchNibbles()
+	if shape.Placeholder {
+		return leaf + shape.DriftedNibbles
+	}
+	if len(branches) == 0 {
+		return -1
+	}
+	return branches[len(branches)-1]
+}
+
+// nodes returns the nodes of the proof of the key in the trie with the key
+// (full) or without it, see proofShape.
+func (shape TrieShape) nodes(full bool) string {
+	branches, _ := shape.branchNibbles()
+	var nodes []string
+	for i := range branches {
+		if shape.ExtensionNibbles > 0 && i == shape.ExtensionDepth {
+			nodes = append(nodes, fmt.Sprintf("E%d", shape.ExtensionNibbles))
+		}
+		nodes = append(nodes, "B")
+	}
+	switch {
+	case full && shape.Placeholder:
+		if shape.DriftedNibbles > 0 {
+			nodes = append(nodes, fmt.Sprintf("E%d", shape.DriftedNibbles))
+		}
+		nodes = append(nodes, "B", "L")
+	case full || shape.Placeholder:
+		// Without the key, the proof ends in the leaf that drifts.
+		nodes = append(nodes, "L")
+	}
+	return strings.Join(nodes, " ")
+}
+
+// proofShape describes the nodes of the proof: B for a branch, E<n> for an
+// extension node with n nibbles and L for a leaf.
+func proofShape(proof [][]byte) (string, error) {
+	var nodes []string
+	for _, node := range proof {
+		elems, _, err := rlp.SplitList(node)
+		if err != nil {
+			return "", err
+		}
+		switch n, _ := rlp.CountValues(elems); n {
+		case 17:
+			nodes = append(nodes, "B")
+		case 2:
+			compact, _, err := rlp.SplitString(elems)
+			if err != nil {
+				return "", err
+			}
+			nibbles, isLeaf := oracle.CompactToNibbles(compact)
+			if isLeaf {
+				nodes = append(nodes, "L")
+			} else {
+				nodes = append(nodes, fmt.Sprintf("E%d", len(nibbles)))
+			}
+		default:
+			return "", fmt.Errorf("node with %d items", n)
+		}
+	}
+	return strings.Join(nodes, " "), nil
+}
+
+// keySearch finds keys (storage keys or addresses) with a given prefix of the
+// hash nibbles. The keys are small numbers, the search starts at 1 each time, so
+// the same shape always gives the same keys.
+type keySearch struct {
+	account bool
+	used    map[uint64]bool
+}
+
+func (s *keySearch) key(i uint64) []byte {
+	if s.account {
+		return common.BigToAddress(new(big.Int).SetUint64(i)).Bytes()
+	}
+	return common.BigToHash(new(big.Int).SetUint64(i)).Bytes()
+}
+
+// find returns an unused key whose hash starts with the nibbles prefix followed
+// by a nibble that is not in exclude.
+func (s *keySearch) find(prefix []byte, exclude ...byte) uint64 {
+	for i := uint64(1); ; i++ {
+		if s.used[i] {
+			continue
+		}
+		nibbles := hashNibbles(s.key(i))
+		if !bytesHavePrefix(nibbles, prefix) || bytesContain(exclude, nibbles[len(prefix)]) {
+			continue
+		}
+		s.used[i] = true
+		return i
+	}
+}
+
+// hashNibbles returns the nibbles of the hash of the key.
+func hashNibbles(key []byte) []byte {
+	hash := crypto.Keccak256(key)
+	nibbles := make([]byte, 2*len(hash))
+	for i, b := range hash {
+		nibbles[2*i], nibbles[2*i+1] = b/16, b%16
+	}
+	return nibbles
+}
+
+func bytesHavePrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+func bytesContain(b []byte, c byte) bool {
+	for _, x := range b {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// SynthesizeTrie searches the keys that give the shape and returns the state
+// and the modification. For the tries with and without the modified key, it
+// checks that the proof of the key has the shape.
+func SynthesizeTrie(shape TrieShape) (*SynthesizedTrie, error) {
+	if err := shape.validate(); err != nil {
+		return nil, fmt.Errorf("invalid trie shape: %w", err)
+	}
+
+	s := &keySearch{account: shape.Account, used: make(map[uint64]bool)}
+	modified := s.find(nil)
+	path := hashNibbles(s.key(modified))
+
+	var others []uint64
+	branches, leaf := shape.branchNibbles()
+	for i, pos := range branches {
+		sibling := s.find(path[:pos], path[pos])
+		others = append(others, sibling)
+		if i == len(branches)-1 && !shape.Placeholder && shape.Modification != ShapeUpdate {
+			// The last branch needs another child when the key is not in it.
+			others = append(others, s.find(path[:pos], path[pos], hashNibbles(s.key(sibling))[pos]))
+		}
+	}
+	if shape.Placeholder {
+		pos := leaf + shape.DriftedNibbles
+		others = append(others, s.find(path[:pos], path[pos]))
+	}
+
+	value := func(i int) common.Hash {
+		v := common.BigToHash(big.NewInt(int64(i)))
+		if shape.LongLeaf {
+			v[0] = 0xff
+		}
+		return v
+	}
+
+	synth := &SynthesizedTrie{Alloc: make(oracle.GenesisAlloc)}
+	var storage map[common.Hash]common.Hash
+	if !shape.Account {
+		storage = make(map[common.Hash]common.Hash)
+		synth.Alloc[shape.Address] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(1), Storage: storage}
+	}
+	set := func(key uint64, i int) {
+		if shape.Account {
+			synth.Alloc[common.BytesToAddress(s.key(key))] = oracle.GenesisAccount{Balance: math.NewHexOrDecimal256(int64(i))}
+		} else {
+			storage[common.BytesToHash(s.key(key))] = value(i)
+		}
+	}
+	for i, key := range others {
+		set(key, i+1)
+	}
+	if shape.Modification != ShapeInsert {
+		set(modified, len(others)+1)
+	}
+
+	mod := TrieModification{Address: shape.Address}
+	switch {
+	case shape.Account && shape.Modification == ShapeDelete:
+		mod.Type = DeleteAccount
+		mod.Address = common.BytesToAddress(s.key(modified))
+	case shape.Account:
+		mod.Type = BalanceMod
+		mod.Address = common.BytesToAddress(s.key(modified))
+		mod.Balance = big.NewInt(23)
+	default:
+		mod.Type = StorageMod
+		mod.Key = common.BytesToHash(s.key(modified))
+		if shape.Modification != ShapeDelete {
+			mod.Value = value(17)
+		}
+	}
+	synth.Mods = []TrieModification{mod}
+
+	if err := synth.checkShape(shape, s.key(modified)); err != nil {
+		return nil, err
+	}
+	return synth, nil
+}
+
+// checkShape builds the trie before and after the modification and compares the
+// proofs of the key with the shape.
+func (s *SynthesizedTrie) checkShape(shape TrieShape, key []byte) error {
+	src := oracle.NewMemorySource()
+	root := types.EmptyRootHash
+	src.AddHeader(&oracle.Header{Number: (*hexutil.Big)(big.NewInt(0)), Root: &root})
+	db, err := trie.NewDatabase(types.Header{Number: big.NewInt(0), Root: types.EmptyRootHash}, oracle.NewOracle(src))
+	if err != nil {
+		return err
+	}
+	t, err := trie.New(common.Hash{}, db)
+	if err != nil {
+		return err
+	}
+
+	hashedKey := crypto.Keccak256(key)
+	leafValue := func(account oracle.GenesisAccount) ([]byte, error) {
+		return rlp.EncodeToBytes(&oracle.Account{
+			Balance: (*big.Int)(account.Balance), Root: types.EmptyRootHash, CodeHash: crypto.Keccak256(nil),
+		})
+	}
+	for addr, account := range s.Alloc {
+		if !shape.Account {
+			for k, v := range account.Storage {
+				enc, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(v[:]))
+				if err := t.TryUpdate(crypto.Keccak256(k[:]), enc); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		enc, err := leafValue(account)
+		if err != nil {
+			return err
+		}
+		if err := t.TryUpdate(crypto.Keccak256(addr[:]), enc); err != nil {
+			return err
+		}
+	}
+
+	check := func(side string, full bool) error {
+		t.Hash()
+		var proof proofList
+		if _, _, err := t.Prove(hashedKey, 0, &proof); err != nil {
+			return err
+		}
+		got, err := proofShape(proof)
+		if err != nil {
+			return err
+		}
+		if want := shape.nodes(full); got != want {
+			return fmt.Errorf("proof of the key %s the modification is %q, want %q", side, got, want)
+		}
+		return nil
+	}
+	if err := check("before", shape.Modification != ShapeInsert); err != nil {
+		return err
+	}
+
+	mod := s.Mods[0]
+	switch {
+	case mod.Type == DeleteAccount || mod.Type == StorageMod && mod.Value == (common.Hash{}):
+		err = t.TryDelete(hashedKey)
+	case mod.Type == BalanceMod:
+		var enc []byte
+		enc, err = leafValue(oracle.GenesisAccount{Balance: (*math.HexOrDecimal256)(mod.Balance)})
+		if err == nil {
+			err = t.TryUpdate(hashedKey, enc)
+		}
+	default:
+		enc, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(mod.Value[:]))
+		err = t.TryUpdate(hashedKey, enc)
+	}
+	if err != nil {
+		return err
+	}
+	return check("after", shape.Modification != ShapeDelete)
+}
+
+// proofList collects the nodes of a proof (see trie.Trie.Prove) in order.
+type proofList [][]byte
+
+func (n *proofList) Put(key []byte, value []byte) error {
+	*n = append(*n, value)
+	return nil
+}
+
+func (n *proofList) Delete(key []byte) error {
+	return fmt.Errorf("deleting from a proof is not supported")
+}
@@ -0,0 +1,77 @@
+package witness
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var synthAddr = common.HexToAddress("0x50efbf12580138bc263c95757826df4e24eb81c9")
+
+// synthesizedWitness returns the verified witness of the modification of the
+// synthesized trie with the shape.
+func synthesizedWitness(t *testing.T, shape TrieShape) *Witness {
+	t.Helper()
+	synth, err := SynthesizeTrie(shape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := synth.Source(testBlockNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := updateStateAndGetProofs(src, testBlockNum, nil, nil, nil, synth.Mods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Verify(synth.Mods); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestSynthesizeTrie(t *testing.T) {
+	shapes := []TrieShape{
+		{Modification: ShapeUpdate, Branches: 2},
+		{Modification: ShapeUpdate, Branches: 3, LongLeaf: true},
+		{Modification: ShapeInsert, Branches: 2},
+		{Modification: ShapeDelete, Branches: 2, LongLeaf: true},
+		{Modification: ShapeUpdate, Branches: 2, ExtensionNibbles: 1, ExtensionDepth: 1},
+		{Modification: ShapeUpdate, Branches: 2, ExtensionNibbles: 2, ExtensionDepth: 1},
+		{Modification: ShapeUpdate, Branches: 2, ExtensionNibbles: 3, ExtensionDepth: 1},
+		{Modification: ShapeInsert, Branches: 3, ExtensionNibbles: 2, ExtensionDepth: 0},
+		// Extension nodes with three key bytes (even and odd number of nibbles).
+		{Modification: ShapeUpdate, Branches: 2, ExtensionNibbles: 4, ExtensionDepth: 1},
+		{Modification: ShapeUpdate, Branches: 1, ExtensionNibbles: 5, ExtensionDepth: 0, LongLeaf: true},
+		{Modification: ShapeInsert, Branches: 2, Placeholder: true},
+		{Modification: ShapeDelete, Branches: 2, Placeholder: true, LongLeaf: true},
+		{Modification: ShapeInsert, Branches: 1, Placeholder: true, DriftedNibbles: 2},
+		{Modification: ShapeUpdate, Account: true, Branches: 3},
+		{Modification: ShapeInsert, Account: true, Branches: 2, Placeholder: true},
+		{Modification: ShapeDelete, Account: true, Branches: 2},
+	}
+	for _, shape := range shapes {
+		shape.Address = synthAddr
+		t.Run(fmt.Sprintf("%+v", shape), func(t *testing.T) {
+			synthesizedWitness(t, shape)
+		})
+	}
+}
+
+func TestSynthesizeTrieInvalidShape(t *testing.T) {
+	for _, shape := range []TrieShape{
+		{Modification: ShapeUpdate, Placeholder: true},
+		{Modification: ShapeUpdate, Branches: 1, ExtensionNibbles: 2, ExtensionDepth: 1},
+		{Modification: ShapeInsert, DriftedNibbles: 1},
+		{Modification: ShapeUpdate, Branches: 7},
+	} {
+		if _, err := SynthesizeTrie(shape); err == nil {
+			t.Errorf("no error for %+v", shape)
+		}
+	}
+}
@@ -0,0 +1,898 @@
+package witness
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/miha-stopar/mpt/oracle"
+)
+
+// Verify checks the witness independently of the circuit: the hash of every node
+// (branch, extension node, leaf) matches the child in its parent (or the S / C root)
+// and is among the rows to be hashed, the S and C branches differ only at the
+// modified position, the key path (branch positions, extension node nibbles, leaf
+// key) is the path of the account (and of the storage key if mods are given),
+// placeholder branches and drifted leaves are consistent, and the intermediate
+// and public roots are chained properly.
+//
+// mods are the modifications the witness was generated for, they can be nil - in
+// this case the storage key paths and the new values are not checked.
+func (w *Witness) Verify(mods []TrieModification) error {
+	v := &verifier{w: w, hashes: make(map[common.Hash][]byte)}
+
+	proofRows := 0
+	for i, r := range w.Rows {
+		if r.Kind == RowHash {
+			v.hashes[crypto.Keccak256Hash(r.RLP)] = r.RLP
+		} else if proofRows != i {
+			return v.fail(i, "proof row after the rows to be hashed")
+		} else {
+			proofRows++
+		}
+	}
+	if proofRows == 0 {
+		return v.fail(0, "no proof rows")
+	}
+
+	var starts []int
+	for i := 0; i < proofRows; i++ {
+		if i == 0 || w.Rows[i].Counter != w.Rows[i-1].Counter {
+			starts = append(starts, i)
+		}
+	}
+	if mods != nil && len(mods) != len(starts) {
+		return fmt.Errorf("witness has %d modifications, %d given", len(starts), len(mods))
+	}
+	for m, start := range starts {
+		end := proofRows
+		if m+1 < len(starts) {
+			end = starts[m+1]
+		}
+		if w.Rows[start].Counter != uint32(m) {
+			return v.fail(start, "counter %d, expected %d", w.Rows[start].Counter, m)
+		}
+		if m > 0 && w.Rows[start].SRoot != w.Rows[starts[m-1]].CRoot {
+			return v.fail(start, "S root is not the C root of the previous modification")
+		}
+		var mod *TrieModification
+		if mods != nil {
+			mod = &mods[m]
+		}
+		if err := v.verifyModification(start, end, mod); err != nil {
+			return err
+		}
+	}
+
+	// The first row holds the root before all the modifications, the others the root after them.
+	startRoot := w.Rows[0].SRoot
+	finalRoot := w.Rows[starts[len(starts)-1]].CRoot
+	for i := 0; i < proofRows; i++ {
+		want := finalRoot
+		if i == 0 {
+			want = startRoot
+		}
+		if w.Rows[i].PublicRoot != want {
+			return v.fail(i, "public root %s, expected %s", w.Rows[i].PublicRoot.Hex(), want.Hex())
+		}
+	}
+
+	return nil
+}
+
+type verifier struct {
+	w      *Witness
+	hashes map[common.Hash][]byte // rows to be hashed by their hash
+}
+
+func (v *verifier) fail(row int, format string, a ...interface{}) error {
+	return &InvalidWitnessError{Row: row, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (v *verifier) verifyModification(start, end int, mod *TrieModification) error {
+	rows := v.w.Rows
+	first := rows[start]
+
+	firstLevelBoundary := start + branchRows
+	if first.Kind == RowAccountLeafKeyS {
+		firstLevelBoundary = start + accountLeafRows
+	}
+	for i := start; i < end; i++ {
+		r := rows[i]
+		if r.SRoot != first.SRoot || r.CRoot != first.CRoot || r.AddressHash != first.AddressHash ||
+			r.Modification != first.Modification || r.Fields != first.Fields {
+			return v.fail(i, "meta info differs from the first row of the modification")
+		}
+		if r.NotFirstLevel != (i >= firstLevelBoundary) {
+			return v.fail(i, "wrong first level flag")
+		}
+	}
+	if mod != nil {
+		if typ, fields := mod.flags(); typ != first.Modification || fields != first.Fields {
+			return v.fail(start, "modification %s, expected %s", first.Modification, mod.Type)
+		}
+		if crypto.Keccak256Hash(mod.Address.Bytes()) != first.AddressHash {
+			return v.fail(start, "address hash doesn't match the address %s", mod.Address.Hex())
+		}
+	}
+	if (first.Modification == NonExistingAccount || first.Modification == NonExistingStorage) && first.SRoot != first.CRoot {
+		return v.fail(start, "state changed by %s proof", first.Modification)
+	}
+	if mod != nil && isRead(mod.Type) && first.SRoot != first.CRoot {
+		return v.fail(start, "state changed by %s", mod.Type)
+	}
+
+	account := &trieWalk{
+		v:       v,
+		i:       start,
+		end:     end,
+		nibbles: keyNibbles(first.AddressHash[:]),
+		s:       walkSide{hash: first.SRoot, empty: first.SRoot == types.EmptyRootHash},
+		c:       walkSide{hash: first.CRoot, empty: first.CRoot == types.EmptyRootHash},
+	}
+	if err := account.branches(); err != nil {
+		return err
+	}
+	accS, accC, err := account.accountLeaf(mod)
+	if err != nil {
+		return err
+	}
+	if err := account.neighbour(RowAccountLeafNeighbouringLeaf); err != nil {
+		return err
+	}
+
+	if first.Modification != StorageMod && first.Modification != NonExistingStorage {
+		if account.i != end {
+			return v.fail(account.i, "unexpected row after the account proof")
+		}
+		return nil
+	}
+
+	storage := &trieWalk{v: v, i: account.i, end: end}
+	if mod != nil {
+		storage.nibbles = keyNibbles(crypto.Keccak256(mod.Key.Bytes()))
+	}
+	storage.s = walkSide{empty: true}
+	if accS != nil {
+		storage.s = walkSide{hash: accS.Root, empty: accS.Root == types.EmptyRootHash}
+	}
+	storage.c = walkSide{empty: true}
+	if accC != nil {
+		storage.c = walkSide{hash: accC.Root, empty: accC.Root == types.EmptyRootHash}
+	}
+	if err := storage.branches(); err != nil {
+		return err
+	}
+	if err := storage.storageLeaf(mod); err != nil {
+		return err
+	}
+	if err := storage.neighbour(RowNeighbouringStorageLeaf); err != nil {
+		return err
+	}
+	if storage.i != end {
+		return v.fail(storage.i, "unexpected row after the storage proof")
+	}
+
+	return nil
+}
+
+// walkSide is the node expected next on the S (or C) side of the proof.
+type walkSide struct {
+	hash  common.Hash
+	empty bool // no node expected (empty trie or nil child in the parent)
+}
+
+// trieWalk follows the account (or storage) proof of one modification.
+type trieWalk struct {
+	v       *verifier
+	i       int // current row
+	end     int
+	nibbles []byte // key path, nil if not known
+	pos     int    // number of nibbles consumed by branches and extension nodes
+
+	s, c walkSide
+
+	// Set when a placeholder branch is met (a leaf is turned into a branch or
+	// the other way around).
+	sPlaceholder, cPlaceholder bool
+	drifted                    byte
+	driftedExtNibbles          []byte
+	neighbourNode              []byte
+}
+
+// link checks the node against the node expected on the side and moves on.
+func (t *trieWalk) link(side *walkSide, node []byte, row int, what string) error {
+	if side.empty {
+		return t.v.fail(row, "%s where the parent has no node", what)
+	}
+	h := crypto.Keccak256Hash(node)
+	if h != side.hash {
+		return t.v.fail(row, "hash of %s %s doesn't match the parent (%s)", what, h.Hex(), side.hash.Hex())
+	}
+	if _, ok := t.v.hashes[h]; !ok {
+		return t.v.fail(row, "%s %s is not among the rows to be hashed", what, h.Hex())
+	}
+	return nil
+}
+
+// path checks the nibbles against the key path (if known).
+func (t *trieWalk) path(row int, nibbles []byte) error {
+	if t.nibbles != nil {
+		if t.pos+len(nibbles) > len(t.nibbles) || !bytes.Equal(t.nibbles[t.pos:t.pos+len(nibbles)], nibbles) {
+			return t.v.fail(row, "nibbles %x are not on the key path", nibbles)
+		}
+	}
+	t.pos += len(nibbles)
+	return nil
+}
+
+func (t *trieWalk) branches() error {
+	rows := t.v.w.Rows
+	for t.i < t.end && rows[t.i].Kind == RowBranchInit {
+		if t.sPlaceholder || t.cPlaceholder {
+			return t.v.fail(t.i, "branch below a placeholder branch")
+		}
+		i := t.i
+		if i+branchRows > t.end {
+			return t.v.fail(i, "branch needs %d rows", branchRows)
+		}
+		for j := 1; j <= 16; j++ {
+			if rows[i+j].Kind != RowBranchChild {
+				return t.v.fail(i+j, "expected branch child, got %s", rows[i+j].Kind)
+			}
+		}
+		if rows[i+17].Kind != RowExtensionNodeS || rows[i+18].Kind != RowExtensionNodeC {
+			return t.v.fail(i+17, "expected extension rows after branch children")
+		}
+		flags := rows[i].Branch()
+		if flags.IsSPlaceholder && flags.IsCPlaceholder {
+			return t.v.fail(i, "both branches are placeholders")
+		}
+		if flags.ModifiedIndex > 15 {
+			return t.v.fail(i, "invalid modified index %d", flags.ModifiedIndex)
+		}
+
+		var extNibbles []byte
+		if flags.IsExtension {
+			extS, extC, nibbles, err := extensionNodes(rows[i+17], rows[i+18])
+			if err != nil {
+				return t.v.fail(i+17, "%v", err)
+			}
+			if !flags.IsSPlaceholder {
+				if err := t.link(&t.s, extS, i+17, "extension node S"); err != nil {
+					return err
+				}
+				t.s.hash = common.BytesToHash(rows[i+17].C[branchNodeRLPLen : branchNodeRLPLen+32])
+			}
+			if !flags.IsCPlaceholder {
+				if err := t.link(&t.c, extC, i+18, "extension node C"); err != nil {
+					return err
+				}
+				t.c.hash = common.BytesToHash(rows[i+18].C[branchNodeRLPLen : branchNodeRLPLen+32])
+			}
+			if err := t.path(i+17, nibbles); err != nil {
+				return err
+			}
+			extNibbles = nibbles
+		}
+
+		sBranch, err := branchNode(rows[i:i+17], false)
+		if err != nil {
+			return t.v.fail(i, "%v", err)
+		}
+		cBranch, err := branchNode(rows[i:i+17], true)
+		if err != nil {
+			return t.v.fail(i, "%v", err)
+		}
+		if !flags.IsSPlaceholder {
+			if err := t.link(&t.s, sBranch, i, "branch S"); err != nil {
+				return err
+			}
+		}
+		if !flags.IsCPlaceholder {
+			if err := t.link(&t.c, cBranch, i, "branch C"); err != nil {
+				return err
+			}
+		}
+		if err := t.path(i, []byte{flags.ModifiedIndex}); err != nil {
+			return err
+		}
+
+		modified := int(flags.ModifiedIndex)
+		if flags.IsSPlaceholder || flags.IsCPlaceholder {
+			// The branch is only in one of the proofs, in the other one there is
+			// the leaf (at the position of the branch) which drifted into this branch.
+			if !bytes.Equal(sBranch, cBranch) {
+				return t.v.fail(i, "placeholder branch is not a copy of the branch")
+			}
+			if flags.DriftedIndex > 15 || int(flags.DriftedIndex) == modified {
+				return t.v.fail(i, "invalid drifted index %d", flags.DriftedIndex)
+			}
+			drifted := rows[i+1+int(flags.DriftedIndex)].S
+			if drifted[1] != 160 {
+				return t.v.fail(i, "no node at the drifted index %d", flags.DriftedIndex)
+			}
+			node, ok := t.v.hashes[common.BytesToHash(drifted[branchNodeRLPLen:branchNodeRLPLen+32])]
+			if !ok {
+				return t.v.fail(i, "drifted leaf is not among the rows to be hashed")
+			}
+			t.sPlaceholder, t.cPlaceholder = flags.IsSPlaceholder, flags.IsCPlaceholder
+			t.drifted = flags.DriftedIndex
+			t.driftedExtNibbles = extNibbles
+			t.neighbourNode = node
+		} else {
+			for j := 0; j < 16; j++ {
+				if j != modified && (!bytes.Equal(rows[i+1+j].S[1:], rows[i+1+j].C[1:branch2start])) {
+					return t.v.fail(i+1+j, "S and C branch differ at position %d", j)
+				}
+			}
+		}
+
+		if !flags.IsSPlaceholder {
+			t.s = childSide(rows[i+1+modified].S)
+		}
+		if !flags.IsCPlaceholder {
+			t.c = childSide(rows[i+1+modified].C)
+		}
+		t.i += branchRows
+	}
+
+	return nil
+}
+
+// leafSides links the S and C leaf and checks the leaf keys. It returns whether
+// the S and C leaf are placeholders (there is no leaf on this side).
+func (t *trieWalk) leafSides(leafS, leafC []byte, row int) (bool, bool, error) {
+	sPlaceholder := t.s.empty && !t.sPlaceholder
+	cPlaceholder := t.c.empty && !t.cPlaceholder
+	if sPlaceholder && cPlaceholder {
+		return false, false, t.v.fail(row, "leaf rows, but no leaf in S and C proof")
+	}
+
+	check := func(leaf []byte, side *walkSide, drifted bool, what string) error {
+		if err := t.link(side, leaf, row, what); err != nil {
+			return err
+		}
+		key, err := leafKey(leaf)
+		if err != nil {
+			return t.v.fail(row, "%s: %v", what, err)
+		}
+		if drifted {
+			// The leaf moved one level down (below the extension node if there is one),
+			// its key was shortened by the extension nibbles and the drifted index.
+			neighbourKey, err := leafKey(t.neighbourNode)
+			if err != nil {
+				return t.v.fail(row, "drifted leaf: %v", err)
+			}
+			want := append(append(common.CopyBytes(t.driftedExtNibbles), t.drifted), neighbourKey...)
+			if !bytes.Equal(key, want) {
+				return t.v.fail(row, "%s key doesn't match the drifted leaf key", what)
+			}
+			if !bytes.Equal(leafValue(leaf), leafValue(t.neighbourNode)) {
+				return t.v.fail(row, "%s value doesn't match the drifted leaf value", what)
+			}
+		}
+		return nil
+	}
+
+	if !sPlaceholder {
+		if err := check(leafS, &t.s, t.sPlaceholder, "leaf S"); err != nil {
+			return false, false, err
+		}
+	}
+	if !cPlaceholder {
+		if err := check(leafC, &t.c, t.cPlaceholder, "leaf C"); err != nil {
+			return false, false, err
+		}
+	}
+
+	return sPlaceholder, cPlaceholder, nil
+}
+
+// hasKey returns whether the S and C leaf are the leaf of the key (it is assumed
+// they are if the key is not known). A drifted leaf belongs to another key, as
+// does a leaf proving the key doesn't exist - the latter must not change.
+func (t *trieWalk) hasKey(leafS, leafC []byte, sPlaceholder, cPlaceholder bool, row int) (bool, bool, error) {
+	onPath := func(leaf []byte) bool {
+		if t.nibbles == nil {
+			return true
+		}
+		key, _ := leafKey(leaf)
+		return bytes.Equal(key, t.nibbles[t.pos:])
+	}
+	sHasKey := !sPlaceholder && !t.sPlaceholder && onPath(leafS)
+	cHasKey := !cPlaceholder && !t.cPlaceholder && onPath(leafC)
+	if !t.sPlaceholder && !t.cPlaceholder && ((!sPlaceholder && !sHasKey) || (!cPlaceholder && !cHasKey)) {
+		if sPlaceholder || cPlaceholder || !bytes.Equal(leafS, leafC) {
+			return false, false, t.v.fail(row, "leaf not on the path of the key is modified")
+		}
+	}
+	return sHasKey, cHasKey, nil
+}
+
+type accountFields struct {
+	Nonce    uint64
+	Balance  *big.Int
+	Root     common.Hash
+	CodeHash []byte
+}
+
+// accountLeaf checks the account leaf rows (if present) and returns the S and C
+// account, nil for a placeholder (or missing) leaf.
+func (t *trieWalk) accountLeaf(mod *TrieModification) (*accountFields, *accountFields, error) {
+	rows := t.v.w.Rows
+	i := t.i
+	if i >= t.end || rows[i].Kind != RowAccountLeafKeyS {
+		if !t.s.empty || !t.c.empty {
+			return nil, nil, t.v.fail(i, "account proof ends without a leaf")
+		}
+		if mod != nil && mod.Type != NonExistingAccount {
+			return nil, nil, t.v.fail(i, "account doesn't exist")
+		}
+		return nil, nil, nil
+	}
+	kinds := []RowKind{RowAccountLeafKeyS, RowAccountLeafKeyC, RowAccountNonExisting, RowAccountLeafNonceBalanceS,
+		RowAccountLeafNonceBalanceC, RowAccountLeafRootCodehashS, RowAccountLeafRootCodehashC}
+	if i+2 < t.end && rows[i+2].Kind != RowAccountNonExisting {
+		// Witnesses generated before the non-existing account row was added.
+		kinds = append(kinds[:2:2], kinds[3:]...)
+	}
+	if i+len(kinds) > t.end {
+		return nil, nil, t.v.fail(i, "account leaf needs %d rows", len(kinds))
+	}
+	for j, kind := range kinds {
+		if rows[i+j].Kind != kind {
+			return nil, nil, t.v.fail(i+j, "expected %s, got %s", kind, rows[i+j].Kind)
+		}
+	}
+	t.i += len(kinds)
+
+	nb := i + len(kinds) - 4 // nonce / balance S row
+	leafS, err := accountLeafNode(rows[i], rows[nb], rows[nb+2])
+	if err != nil {
+		return nil, nil, t.v.fail(i, "account leaf S: %v", err)
+	}
+	leafC, err := accountLeafNode(rows[i+1], rows[nb+1], rows[nb+3])
+	if err != nil {
+		return nil, nil, t.v.fail(i+1, "account leaf C: %v", err)
+	}
+	sPlaceholder, cPlaceholder, err := t.leafSides(leafS, leafC, i)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sHasKey, cHasKey, err := t.hasKey(leafS, leafC, sPlaceholder, cPlaceholder, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	var accS, accC *accountFields
+	if sHasKey {
+		if accS, err = decodeAccount(leafS); err != nil {
+			return nil, nil, t.v.fail(i, "account leaf S: %v", err)
+		}
+	}
+	if cHasKey {
+		if accC, err = decodeAccount(leafC); err != nil {
+			return nil, nil, t.v.fail(i+1, "account leaf C: %v", err)
+		}
+	}
+	if accS != nil && accC != nil {
+		if changed := accS.changed(accC) &^ flaggedFields(rows[i]); changed != 0 {
+			return nil, nil, t.v.fail(i, "account fields %s changed, but not flagged", changed)
+		}
+	}
+	if mod == nil {
+		return accS, accC, nil
+	}
+	if accS == nil && accC == nil {
+		if mod.Type != NonExistingAccount {
+			return nil, nil, t.v.fail(i, "account doesn't exist")
+		}
+		return nil, nil, nil
+	}
+
+	switch mod.Type {
+	case NonExistingAccount:
+		return nil, nil, t.v.fail(i, "account exists")
+	case CreateAccount:
+		if accC == nil {
+			return nil, nil, t.v.fail(i, "account not created")
+		}
+		if accC.Nonce != 0 || accC.Root != types.EmptyRootHash || !bytes.Equal(accC.CodeHash, crypto.Keccak256(nil)) {
+			return nil, nil, t.v.fail(i+1, "account C is not a new account")
+		}
+	case DeleteAccount:
+		if accC != nil {
+			return nil, nil, t.v.fail(i, "account not deleted")
+		}
+	default:
+		if accC == nil {
+			return nil, nil, t.v.fail(i, "account missing in C proof")
+		}
+		// The account is created implicitly if it doesn't exist.
+		want := accountFields{Balance: new(big.Int), Root: types.EmptyRootHash, CodeHash: crypto.Keccak256(nil)}
+		if accS != nil {
+			want = *accS
+		}
+		switch mod.Type {
+		case NonceMod, NonceRead:
+			want.Nonce = mod.Nonce
+		case BalanceMod, BalanceRead:
+			want.Balance = bigOrZero(mod.Balance)
+		case CodeHashMod, CodeHashRead:
+			want.CodeHash = crypto.Keccak256(mod.CodeHash)
+		case StorageMod, StorageRead:
+			want.Root = accC.Root // checked by the storage proof
+		case AccountMod:
+			if u := mod.Account; u != nil {
+				if u.Nonce != nil {
+					want.Nonce = *u.Nonce
+				}
+				if u.Balance != nil {
+					want.Balance = u.Balance
+				}
+				if u.CodeHash != nil {
+					want.CodeHash = crypto.Keccak256(u.CodeHash)
+				}
+				if u.StorageRoot != nil {
+					want.Root = *u.StorageRoot
+				}
+			}
+		}
+		if want.Nonce != accC.Nonce || want.Balance.Cmp(accC.Balance) != 0 || want.Root != accC.Root ||
+			!bytes.Equal(want.CodeHash, accC.CodeHash) {
+			return nil, nil, t.v.fail(i, "account C is not account S with the %s modification applied", mod.Type)
+		}
+	}
+
+	return accS, accC, nil
+}
+
+func (t *trieWalk) storageLeaf(mod *TrieModification) error {
+	rows := t.v.w.Rows
+	i := t.i
+	if i >= t.end || rows[i].Kind != RowStorageLeafKeyS {
+		if !t.s.empty || !t.c.empty {
+			return t.v.fail(i, "storage proof ends without a leaf")
+		}
+		if mod != nil && mod.Value != (common.Hash{}) {
+			return t.v.fail(i, "storage value not set")
+		}
+		return nil
+	}
+	kinds := []RowKind{RowStorageLeafKeyS, RowStorageLeafValueS, RowStorageLeafKeyC, RowStorageLeafValueC}
+	if i+len(kinds) > t.end {
+		return t.v.fail(i, "storage leaf needs %d rows", len(kinds))
+	}
+	for j, kind := range kinds {
+		if rows[i+j].Kind != kind {
+			return t.v.fail(i+j, "expected %s, got %s", kind, rows[i+j].Kind)
+		}
+	}
+	t.i += len(kinds)
+
+	leafS, err := storageLeafNode(rows[i], rows[i+1])
+	if err != nil {
+		return t.v.fail(i, "storage leaf S: %v", err)
+	}
+	leafC, err := storageLeafNode(rows[i+2], rows[i+3])
+	if err != nil {
+		return t.v.fail(i+2, "storage leaf C: %v", err)
+	}
+	sPlaceholder, cPlaceholder, err := t.leafSides(leafS, leafC, i)
+	if err != nil {
+		return err
+	}
+
+	sHasKey, cHasKey, err := t.hasKey(leafS, leafC, sPlaceholder, cPlaceholder, i)
+	if err != nil {
+		return err
+	}
+	if mod != nil && mod.Type == NonExistingStorage && (sHasKey || cHasKey) {
+		return t.v.fail(i, "storage key exists")
+	}
+	if mod != nil {
+		// The leaf holds the RLP of the (trimmed) value.
+		var value []byte
+		if cHasKey {
+			var enc []byte
+			if err := rlp.DecodeBytes(leafValue(leafC), &enc); err != nil {
+				return t.v.fail(i+3, "storage value: %v", err)
+			}
+			if err := rlp.DecodeBytes(enc, &value); err != nil {
+				return t.v.fail(i+3, "storage value: %v", err)
+			}
+		}
+		if !bytes.Equal(value, common.TrimLeftZeroes(mod.Value[:])) {
+			return t.v.fail(i+3, "storage value %x, expected %x", value, mod.Value)
+		}
+	}
+
+	return nil
+}
+
+// neighbour checks the row of the leaf that drifted because of a placeholder
+// branch, the row is a placeholder when there is no such leaf.
+func (t *trieWalk) neighbour(kind RowKind) error {
+	rows := t.v.w.Rows
+	if t.i >= t.end || rows[t.i].Kind != kind {
+		return t.v.fail(t.i, "expected %s row", kind)
+	}
+	r := rows[t.i]
+	t.i++
+	body := append(common.CopyBytes(r.S), r.C...)
+	if !t.sPlaceholder && !t.cPlaceholder {
+		if !isZero(body) {
+			return t.v.fail(t.i-1, "drifted leaf set, but there is no placeholder branch")
+		}
+		return nil
+	}
+	keyLen, err := leafKeyRLPLen(t.neighbourNode)
+	if err != nil {
+		return t.v.fail(t.i-1, "drifted leaf: %v", err)
+	}
+	if keyLen > len(body) || !bytes.Equal(body[:keyLen], t.neighbourNode[:keyLen]) {
+		return t.v.fail(t.i-1, "drifted leaf row doesn't match the leaf in the branch")
+	}
+	return nil
+}
+
+func childSide(part []byte) walkSide {
+	if part[1] == 160 {
+		return walkSide{hash: common.BytesToHash(part[branchNodeRLPLen : branchNodeRLPLen+32])}
+	}
+	return walkSide{empty: true}
+}
+
+// branchNode reconstructs the S (or C) branch from the branch init and child rows.
+func branchNode(rows []WitnessRow, isC bool) ([]byte, error) {
+	init := rows[0].S
+	flagPos, rlpPos := 0, 4
+	if isC {
+		flagPos, rlpPos = 2, 7
+	}
+	var node []byte
+	switch {
+	case init[flagPos] == 1 && init[flagPos+1] == 0:
+		node = append(node, init[rlpPos:rlpPos+2]...)
+	case init[flagPos] == 0 && init[flagPos+1] == 1:
+		node = append(node, init[rlpPos:rlpPos+3]...)
+	default:
+		return nil, fmt.Errorf("invalid branch RLP length flags")
+	}
+	for j := 1; j <= 16; j++ {
+		part := rows[j].S
+		if isC {
+			part = rows[j].C
+		}
+		if part[1] == 160 {
+			node = append(node, part[1:branchNodeRLPLen+32]...)
+		} else if part[branchNodeRLPLen] == 128 {
+			node = append(node, 128)
+		} else {
+			return nil, fmt.Errorf("invalid child at position %d", j-1)
+		}
+	}
+	node = append(node, 128) // value
+
+	if _, rest, err := rlp.SplitList(node); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("branch RLP length doesn't match the children")
+	}
+	return node, nil
+}
+
+// extensionNodes reconstructs the S and C extension node (they have the same key)
+// and returns the nibbles of the key.
+func extensionNodes(rowS, rowC WitnessRow) ([]byte, []byte, []byte, error) {
+	keyEnd := 2 // one byte key
+	if rowS.S[1] > 128 {
+		keyEnd = 2 + int(rowS.S[1]-128)
+	}
+	if keyEnd > len(rowS.S) {
+		return nil, nil, nil, fmt.Errorf("extension node key too long")
+	}
+	compact := rowS.S[1:keyEnd]
+	if rowS.S[1] > 128 {
+		compact = rowS.S[2:keyEnd]
+	}
+	nibbles, isLeaf := oracle.CompactToNibbles(compact)
+	if isLeaf || len(nibbles) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid extension node key")
+	}
+
+	node := func(row WitnessRow) ([]byte, error) {
+		if row.C[1] != 160 {
+			return nil, fmt.Errorf("extension node child is not a hash")
+		}
+		n := append(common.CopyBytes(rowS.S[:keyEnd]), row.C[1:branchNodeRLPLen+32]...)
+		if _, rest, err := rlp.SplitList(n); err != nil || len(rest) != 0 {
+			return nil, fmt.Errorf("extension node RLP length doesn't match")
+		}
+		return n, nil
+	}
+	extS, err := node(rowS)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	extC, err := node(rowC)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Every second nibble is stored in the C extension row (see prepareExtensionRows).
+	start := 2
+	if len(nibbles) > 1 && len(nibbles)%2 == 0 {
+		start = 1
+	}
+	k := 0
+	for j := start; j < len(nibbles); j += 2 {
+		if rowC.S[branchNodeRLPLen+k] != nibbles[j] {
+			return nil, nil, nil, fmt.Errorf("extension node nibbles don't match the key")
+		}
+		k++
+	}
+	if !isZero(rowC.S[branchNodeRLPLen+k:]) {
+		return nil, nil, nil, fmt.Errorf("extension node nibbles don't match the key")
+	}
+
+	return extS, extC, nibbles, nil
+}
+
+// accountLeafNode reconstructs the account leaf from the key, nonce / balance
+// and storage root / codehash rows (see prepareAccountLeafRows).
+func accountLeafNode(keyRow, nonceBalanceRow, storageCodeHashRow WitnessRow) ([]byte, error) {
+	key := append(common.CopyBytes(keyRow.S), keyRow.C...)
+	if key[2] < 128 || 3+int(key[2]-128) > len(key) {
+		return nil, fmt.Errorf("invalid key")
+	}
+	leaf := common.CopyBytes(key[:3+int(key[2]-128)])
+	leaf = append(leaf, nonceBalanceRow.S[:2]...)
+	leaf = append(leaf, nonceBalanceRow.C[:2]...)
+	nonce, err := rlpItem(nonceBalanceRow.S[2:])
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %v", err)
+	}
+	balance, err := rlpItem(nonceBalanceRow.C[2:])
+	if err != nil {
+		return nil, fmt.Errorf("balance: %v", err)
+	}
+	leaf = append(leaf, nonce...)
+	leaf = append(leaf, balance...)
+	leaf = append(leaf, storageCodeHashRow.S[1:branch2start]...)
+	leaf = append(leaf, storageCodeHashRow.C[1:branch2start]...)
+
+	return leaf, nil
+}
+
+// storageLeafNode reconstructs the storage leaf from the key and value row (see prepareStorageLeafRows).
+func storageLeafNode(keyRow, valueRow WitnessRow) ([]byte, error) {
+	key := append(common.CopyBytes(keyRow.S), keyRow.C...)
+	keyLen := 0
+	if key[0] == 248 {
+		keyLen = 3 + int(key[2]) - 128
+	} else {
+		keyLen = 2 + int(key[1]) - 128
+	}
+	if keyLen < 2 || keyLen > len(key) {
+		return nil, fmt.Errorf("invalid key")
+	}
+	value, err := rlpItem(append(common.CopyBytes(valueRow.S), valueRow.C...))
+	if err != nil {
+		return nil, fmt.Errorf("value: %v", err)
+	}
+
+	return append(common.CopyBytes(key[:keyLen]), value...), nil
+}
+
+func decodeAccount(leaf []byte) (*accountFields, error) {
+	var enc []byte
+	if err := rlp.DecodeBytes(leafValue(leaf), &enc); err != nil {
+		return nil, err
+	}
+	acc := new(accountFields)
+	if err := rlp.DecodeBytes(enc, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// rlpItem returns the first RLP item in b.
+func rlpItem(b []byte) ([]byte, error) {
+	_, _, rest, err := rlp.Split(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-len(rest)], nil
+}
+
+// leafKey returns the key nibbles of the leaf.
+func leafKey(leaf []byte) ([]byte, error) {
+	elems, rest, err := rlp.SplitList(leaf)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid leaf RLP")
+	}
+	if c, _ := rlp.CountValues(elems); c != 2 {
+		return nil, fmt.Errorf("leaf has %d elements", c)
+	}
+	compact, _, err := rlp.SplitString(elems)
+	if err != nil {
+		return nil, err
+	}
+	nibbles, isLeaf := oracle.CompactToNibbles(compact)
+	if !isLeaf {
+		return nil, fmt.Errorf("not a leaf")
+	}
+	return nibbles, nil
+}
+
+// leafValue returns the RLP of the value in the leaf.
+func leafValue(leaf []byte) []byte {
+	elems, _, _ := rlp.SplitList(leaf)
+	_, _, rest, _ := rlp.Split(elems)
+	return rest
+}
+
+// leafKeyRLPLen returns the number of bytes of the leaf RLP up to the end of the key.
+func leafKeyRLPLen(leaf []byte) (int, error) {
+	elems, _, err := rlp.SplitList(leaf)
+	if err != nil {
+		return 0, err
+	}
+	_, _, rest, err := rlp.Split(elems)
+	if err != nil {
+		return 0, err
+	}
+	return len(leaf) - len(rest), nil
+}
+
+func keyNibbles(key []byte) []byte {
+	nibbles := make([]byte, 2*len(key))
+	for i, b := range key {
+		nibbles[2*i] = b / 16
+		nibbles[2*i+1] = b % 16
+	}
+	return nibbles
+}
+
+// changed returns the fields that differ in c.
+func (a *accountFields) changed(c *accountFields) AccountFields {
+	var fields AccountFields
+	if a.Nonce != c.Nonce {
+		fields |= FieldNonce
+	}
+	if a.Balance.Cmp(c.Balance) != 0 {
+		fields |= FieldBalance
+	}
+	if !bytes.Equal(a.CodeHash, c.CodeHash) {
+		fields |= FieldCodeHash
+	}
+	if a.Root != c.Root {
+		fields |= FieldStorageRoot
+	}
+	return fields
+}
+
+// flaggedFields returns the account fields the modification of the row can change.
+func flaggedFields(r WitnessRow) AccountFields {
+	switch r.Modification {
+	case StorageMod:
+		return FieldStorageRoot
+	case NonceMod:
+		return FieldNonce
+	case BalanceMod:
+		return FieldBalance
+	case CodeHashMod:
+		return FieldCodeHash
+	case AccountMod:
+		return r.Fields
+	}
+	return 0
+}
+
+func isRead(t ModType) bool {
+	return t == StorageRead || t == NonceRead || t == BalanceRead || t == CodeHashRead
+}
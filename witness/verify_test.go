@@ -0,0 +1,332 @@
+package witness
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/miha-stopar/mpt/oracle"
+	"github.com/miha-stopar/mpt/state"
+)
+
+// memoryStateDB returns a StateDB with an empty state backed by a MemorySource,
+// so that witnesses can be generated without a node.
+func memoryStateDB(t *testing.T) *state.StateDB {
+	statedb, err := newMemoryStateDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statedb
+}
+
+func newMemoryStateDB() (*state.StateDB, error) {
+	src := oracle.NewMemorySource()
+	root := types.EmptyRootHash
+	src.AddHeader(&oracle.Header{Number: (*hexutil.Big)(big.NewInt(0)), Root: &root})
+	database, err := state.NewDatabase(types.Header{Number: big.NewInt(0), Root: types.EmptyRootHash}, oracle.NewOracle(src))
+	if err != nil {
+		return nil, err
+	}
+	statedb, err := state.New(types.EmptyRootHash, database, nil)
+	if err != nil {
+		return nil, err
+	}
+	statedb.DisableLoadingRemoteAccounts()
+
+	return statedb, nil
+}
+
+var verifyAddr = common.HexToAddress("0x50efbf12580138bc263c95757826df4e24eb81c9")
+
+// setVerifyState sets some accounts (to have branches in the account trie) and
+// storage of verifyAddr which has an extension node at the position of the key 0x1818.
+func setVerifyState(statedb *state.StateDB, accounts int, keys ...common.Hash) {
+	for i := 0; i < accounts; i++ {
+		statedb.SetBalance(common.BigToAddress(big.NewInt(int64(i*7919+1))), big.NewInt(int64(i+1)))
+	}
+	a, b := 1, 1
+	ks := []common.Hash{common.HexToHash(fmt.Sprintf("0x%d%d", a, b))}
+	for i := 0; i < 33; i++ {
+		if i%2 == 0 {
+			a += 1
+		} else {
+			b += 1
+		}
+		ks = append(ks, common.HexToHash(fmt.Sprintf("0x%d%d", a, b)))
+	}
+	for i, k := range append(ks, keys...) {
+		statedb.SetState(verifyAddr, k, common.BigToHash(big.NewInt(int64(i+1))))
+	}
+	statedb.IntermediateRoot(false)
+}
+
+func generateVerifyWitness(t *testing.T, accounts int, keys []common.Hash, mods []TrieModification) *Witness {
+	statedb := memoryStateDB(t)
+	setVerifyState(statedb, accounts, keys...)
+	proof, err := getParallelProofs(mods, statedb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := WitnessFromMatrix(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestVerify(t *testing.T) {
+	key := common.HexToHash("0x1818")
+	newAddr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
+	tests := []struct {
+		name     string
+		accounts int
+		keys     []common.Hash
+		mods     []TrieModification
+	}{
+		{"ExtensionAdded", 50, nil,
+			[]TrieModification{{Type: StorageMod, Key: key, Value: common.HexToHash("0x11"), Address: verifyAddr}}},
+		{"ExtensionDeleted", 50, []common.Hash{key},
+			[]TrieModification{{Type: StorageMod, Key: key, Address: verifyAddr}}},
+		{"UpdateOneLevel", 50, nil,
+			[]TrieModification{{Type: StorageMod, Key: common.HexToHash("0x12"), Value: common.HexToHash("0x5"), Address: verifyAddr}}},
+		{"SetMissingKeyToZero", 50, nil,
+			[]TrieModification{{Type: StorageMod, Key: common.HexToHash("0x1819"), Address: verifyAddr}}},
+		{"OnlyLeafInAccountTrie", 0, nil,
+			[]TrieModification{{Type: StorageMod, Key: key, Value: common.HexToHash("0x11"), Address: verifyAddr}}},
+		{"AddAccount", 50, nil,
+			[]TrieModification{{Type: CreateAccount, Address: newAddr}}},
+		{"ImplicitlyCreateAccountWithNonce", 50, nil,
+			[]TrieModification{{Type: NonceMod, Nonce: 142, Address: newAddr}}},
+		{"NonExistingStorageLeaf", 50, nil,
+			[]TrieModification{{Type: NonExistingStorage, Key: common.HexToHash("0x104"), Address: verifyAddr}}},
+		{"NonExistingStorageBranch", 50, nil,
+			[]TrieModification{{Type: NonExistingStorage, Key: common.HexToHash("0x101"), Address: verifyAddr}}},
+		{"NonExistingAccount", 50, nil,
+			[]TrieModification{{Type: NonExistingAccount, Address: newAddr}}},
+		{"StorageRead", 50, nil,
+			[]TrieModification{{Type: StorageRead, Key: common.HexToHash("0x11"), Value: common.HexToHash("0x1"), Address: verifyAddr}}},
+		{"StorageReadNonExisting", 50, nil,
+			[]TrieModification{{Type: StorageRead, Key: common.HexToHash("0x104"), Address: verifyAddr}}},
+		{"NonceRead", 50, nil,
+			[]TrieModification{{Type: NonceRead, Address: verifyAddr}}},
+		{"BalanceRead", 50, nil,
+			[]TrieModification{{Type: BalanceRead, Balance: big.NewInt(1), Address: common.BigToAddress(big.NewInt(1))}}},
+		{"CodeHashRead", 50, nil,
+			[]TrieModification{{Type: CodeHashRead, Address: verifyAddr}}},
+		// A nil balance is zero.
+		{"BalanceModNil", 50, nil,
+			[]TrieModification{{Type: BalanceMod, Address: common.BigToAddress(big.NewInt(1))}}},
+		{"BalanceReadNil", 50, nil,
+			[]TrieModification{{Type: BalanceRead, Address: verifyAddr}}},
+		{"AccountMod", 50, nil,
+			[]TrieModification{{Type: AccountMod, Address: verifyAddr, Account: &AccountUpdate{Nonce: diffNonce(3), Balance: big.NewInt(5)}}}},
+		{"AccountModStorageRoot", 50, nil,
+			[]TrieModification{{Type: AccountMod, Address: verifyAddr, Account: &AccountUpdate{StorageRoot: &types.EmptyRootHash, CodeHash: []byte{1}}}}},
+		{"ImplicitlyCreateAccountWithAccountMod", 50, nil,
+			[]TrieModification{{Type: AccountMod, Address: newAddr, Account: &AccountUpdate{Nonce: diffNonce(1), Balance: big.NewInt(5)}}}},
+		{"CodeHash", 50, nil,
+			[]TrieModification{{Type: CodeHashMod, CodeHash: []byte{1, 2, 3}, Address: verifyAddr}}},
+		{"MoreModifications", 300, nil, []TrieModification{
+			{Type: StorageMod, Key: key, Value: common.HexToHash("0x11"), Address: verifyAddr},
+			{Type: StorageMod, Key: common.HexToHash("0x12"), Value: common.HexToHash("0x12"), Address: verifyAddr},
+			{Type: BalanceMod, Balance: big.NewInt(7), Address: verifyAddr},
+			{Type: DeleteAccount, Address: verifyAddr},
+		}},
+	}
+	for _, test := range tests {
+		w := generateVerifyWitness(t, test.accounts, test.keys, test.mods)
+		if err := w.Verify(test.mods); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if err := w.Verify(nil); err != nil {
+			t.Errorf("%s without modifications: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	key := common.HexToHash("0x1818")
+	mods := []TrieModification{{Type: StorageMod, Key: key, Value: common.HexToHash("0x11"), Address: verifyAddr}}
+
+	tests := []struct {
+		name   string
+		mods   []TrieModification
+		tamper func(w *Witness)
+	}{
+		{"ChildHash", mods, func(w *Witness) {
+			for i := range w.Rows {
+				if w.Rows[i].Kind == RowBranchChild && w.Rows[i].S[1] == 160 {
+					w.Rows[i].S[10] ^= 1
+					w.Rows[i].C[10] ^= 1
+					return
+				}
+			}
+		}},
+		{"ModifiedIndex", mods, func(w *Witness) {
+			w.Rows[0].S[keyPos] = (w.Rows[0].S[keyPos] + 1) % 16
+		}},
+		{"ExtensionNibbles", mods, func(w *Witness) {
+			for i := range w.Rows {
+				if w.Rows[i].Kind == RowExtensionNodeC && w.Rows[i-18].Branch().IsExtension {
+					w.Rows[i].S[branchNodeRLPLen] ^= 1
+					return
+				}
+			}
+		}},
+		{"StorageValue", []TrieModification{{Type: StorageMod, Key: key, Value: common.HexToHash("0x12"), Address: verifyAddr}}, nil},
+		{"StorageKey", []TrieModification{{Type: StorageMod, Key: common.HexToHash("0x1819"), Value: common.HexToHash("0x11"), Address: verifyAddr}}, nil},
+		{"Address", []TrieModification{{Type: StorageMod, Key: key, Value: common.HexToHash("0x11"), Address: common.HexToAddress("0x1")}}, nil},
+		{"PublicRoot", mods, func(w *Witness) {
+			w.Rows[1].PublicRoot = w.Rows[1].SRoot
+		}},
+		{"Counter", mods, func(w *Witness) {
+			for i := range w.Rows {
+				w.Rows[i].Counter = 1
+			}
+		}},
+	}
+	for _, test := range tests {
+		w := generateVerifyWitness(t, 50, nil, mods)
+		if test.tamper != nil {
+			test.tamper(w)
+		}
+		err := w.Verify(test.mods)
+		var invalid *InvalidWitnessError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s: expected InvalidWitnessError, got %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifyNonExistingStorageKeyExists(t *testing.T) {
+	mods := []TrieModification{{Type: NonExistingStorage, Key: common.HexToHash("0x11"), Address: verifyAddr}}
+	w := generateVerifyWitness(t, 50, nil, mods)
+	err := w.Verify(mods)
+	if err == nil || !strings.Contains(err.Error(), "storage key exists") {
+		t.Errorf("expected storage key exists error, got %v", err)
+	}
+}
+
+// readTests are read modifications of the state of setVerifyState with the
+// value in the state and with another value.
+var readTests = []struct {
+	read, wrong TrieModification
+}{
+	{
+		TrieModification{Type: StorageRead, Key: common.HexToHash("0x11"), Value: common.HexToHash("0x1"), Address: verifyAddr},
+		TrieModification{Type: StorageRead, Key: common.HexToHash("0x11"), Value: common.HexToHash("0x2"), Address: verifyAddr},
+	},
+	{
+		TrieModification{Type: NonceRead, Address: verifyAddr},
+		TrieModification{Type: NonceRead, Nonce: 1, Address: verifyAddr},
+	},
+	{
+		TrieModification{Type: BalanceRead, Balance: big.NewInt(1), Address: common.BigToAddress(big.NewInt(1))},
+		TrieModification{Type: BalanceRead, Balance: big.NewInt(2), Address: common.BigToAddress(big.NewInt(1))},
+	},
+	{
+		TrieModification{Type: CodeHashRead, Address: verifyAddr},
+		TrieModification{Type: CodeHashRead, CodeHash: []byte{1}, Address: verifyAddr},
+	},
+}
+
+func TestVerifyReadValue(t *testing.T) {
+	for _, test := range readTests {
+		w := generateVerifyWitness(t, 50, nil, []TrieModification{test.read})
+		var invalid *InvalidWitnessError
+		if err := w.Verify([]TrieModification{test.wrong}); !errors.As(err, &invalid) {
+			t.Errorf("%s: expected InvalidWitnessError, got %v", test.wrong.Type, err)
+		}
+	}
+}
+
+func TestGenerateReadMismatch(t *testing.T) {
+	for _, test := range readTests {
+		statedb := memoryStateDB(t)
+		setVerifyState(statedb, 50)
+		_, err := getParallelProofs([]TrieModification{test.wrong}, statedb)
+		var mismatch *ReadMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Errorf("%s: expected ReadMismatchError, got %v", test.wrong.Type, err)
+			continue
+		}
+		if mismatch.Type != test.wrong.Type || mismatch.Address != test.wrong.Address || ErrorKind(err) != ErrKindReadMismatch {
+			t.Errorf("%s: unexpected error %v (kind %s)", test.wrong.Type, err, ErrorKind(err))
+		}
+	}
+}
+
+// The reads of a missing account can't be proved, the generator rejects them
+// instead of returning a witness Verify rejects. NonExistingAccount proves that
+// the account doesn't exist.
+func TestGenerateReadMissingAccount(t *testing.T) {
+	missing := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
+	for _, read := range []TrieModification{
+		{Type: NonceRead, Address: missing},
+		{Type: BalanceRead, Address: missing},
+		{Type: CodeHashRead, Address: missing},
+	} {
+		statedb := memoryStateDB(t)
+		setVerifyState(statedb, 50)
+		_, err := getParallelProofs([]TrieModification{read}, statedb)
+		var mismatch *ReadMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Errorf("%s: expected ReadMismatchError, got %v", read.Type, err)
+		}
+	}
+
+	mods := []TrieModification{{Type: NonExistingAccount, Address: missing}}
+	w := generateVerifyWitness(t, 50, nil, mods)
+	if err := w.Verify(mods); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyAccountModFields(t *testing.T) {
+	mods := []TrieModification{{Type: AccountMod, Address: verifyAddr, Account: &AccountUpdate{Nonce: diffNonce(3), Balance: big.NewInt(5)}}}
+	w := generateVerifyWitness(t, 50, nil, mods)
+	for i := range w.Rows {
+		if w.Rows[i].Kind != RowHash {
+			w.Rows[i].Fields = FieldNonce
+		}
+	}
+	// The flags are not checked against the modification.
+	err := w.Verify(nil)
+	if err == nil || !strings.Contains(err.Error(), "balance changed, but not flagged") {
+		t.Errorf("expected not flagged error, got %v", err)
+	}
+
+	w = generateVerifyWitness(t, 50, nil, mods)
+	mods[0].Account.Balance = big.NewInt(6)
+	var invalid *InvalidWitnessError
+	if err := w.Verify(mods); !errors.As(err, &invalid) {
+		t.Errorf("expected InvalidWitnessError, got %v", err)
+	}
+}
+
+func TestVerifyGeneratedWitnesses(t *testing.T) {
+	files, err := filepath.Glob("../generated_witnesses/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := ParseWitness(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := w.Verify(nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
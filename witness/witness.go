@@ -0,0 +1,632 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// WitnessVersion is the version of the JSON encoding of Witness and of the
+// layout of the matrix. It needs to be increased whenever the meaning of an
+// existing field or the meta info of the matrix changes.
+//
+// The witnesses before version 1 are only available as the matrix, their meta
+// info is 138 bytes long (without the public root and the account delete,
+// non-existing account, non-existing storage and account mod flags).
+const WitnessVersion = 1
+
+// RowKind is the type of a witness row, in the legacy matrix it is stored in
+// the last byte of the row.
+type RowKind byte
+
+const (
+	RowBranchInit                  RowKind = 0 // RLP info about the branch node, modified key nibble and branch flags
+	RowBranchChild                 RowKind = 1 // branch child (S and C)
+	RowStorageLeafKeyS             RowKind = 2
+	RowStorageLeafKeyC             RowKind = 3
+	RowAccountLeafKeyC             RowKind = 4
+	RowHash                        RowKind = 5 // node RLP whose hash needs to be checked in the parent
+	RowAccountLeafKeyS             RowKind = 6
+	RowAccountLeafNonceBalanceS    RowKind = 7
+	RowAccountLeafNonceBalanceC    RowKind = 8
+	RowAccountLeafRootCodehashS    RowKind = 9
+	RowAccountLeafNeighbouringLeaf RowKind = 10
+	RowAccountLeafRootCodehashC    RowKind = 11
+	RowStorageLeafValueS           RowKind = 13
+	RowStorageLeafValueC           RowKind = 14
+	RowNeighbouringStorageLeaf     RowKind = 15 // when leaf turned into branch
+	RowExtensionNodeS              RowKind = 16
+	RowExtensionNodeC              RowKind = 17
+	RowAccountNonExisting          RowKind = 18
+)
+
+var rowKindNames = map[RowKind]string{
+	RowBranchInit:                  "branch_init",
+	RowBranchChild:                 "branch_child",
+	RowStorageLeafKeyS:             "storage_leaf_key_s",
+	RowStorageLeafKeyC:             "storage_leaf_key_c",
+	RowAccountLeafKeyC:             "account_leaf_key_c",
+	RowHash:                        "hash",
+	RowAccountLeafKeyS:             "account_leaf_key_s",
+	RowAccountLeafNonceBalanceS:    "account_leaf_nonce_balance_s",
+	RowAccountLeafNonceBalanceC:    "account_leaf_nonce_balance_c",
+	RowAccountLeafRootCodehashS:    "account_leaf_root_codehash_s",
+	RowAccountLeafNeighbouringLeaf: "account_leaf_neighbouring_leaf",
+	RowAccountLeafRootCodehashC:    "account_leaf_root_codehash_c",
+	RowStorageLeafValueS:           "storage_leaf_value_s",
+	RowStorageLeafValueC:           "storage_leaf_value_c",
+	RowNeighbouringStorageLeaf:     "neighbouring_storage_leaf",
+	RowExtensionNodeS:              "extension_node_s",
+	RowExtensionNodeC:              "extension_node_c",
+	RowAccountNonExisting:          "account_non_existing",
+}
+
+func (k RowKind) String() string {
+	if name, ok := rowKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(k))
+}
+
+func (k RowKind) MarshalText() ([]byte, error) {
+	if _, ok := rowKindNames[k]; !ok {
+		return nil, fmt.Errorf("unknown row kind %d", byte(k))
+	}
+	return []byte(k.String()), nil
+}
+
+func (k *RowKind) UnmarshalText(text []byte) error {
+	for kind, name := range rowKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown row kind %q", text)
+}
+
+var modTypeNames = map[ModType]string{
+	StorageMod:         "storage",
+	NonceMod:           "nonce",
+	BalanceMod:         "balance",
+	CodeHashMod:        "codehash",
+	CreateAccount:      "create_account",
+	DeleteAccount:      "delete_account",
+	NonExistingAccount: "non_existing_account",
+	NonExistingStorage: "non_existing_storage",
+	StorageRead:        "storage_read",
+	NonceRead:          "nonce_read",
+	BalanceRead:        "balance_read",
+	CodeHashRead:       "codehash_read",
+	AccountMod:         "account",
+}
+
+func (t ModType) String() string {
+	if name, ok := modTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int64(t))
+}
+
+func (t ModType) MarshalText() ([]byte, error) {
+	if _, ok := modTypeNames[t]; !ok {
+		return nil, fmt.Errorf("unknown modification type %d", int64(t))
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *ModType) UnmarshalText(text []byte) error {
+	for typ, name := range modTypeNames {
+		if name == string(text) {
+			*t = typ
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown modification type %q", text)
+}
+
+// AccountFields is a set of account fields, the fields changed by AccountMod.
+type AccountFields byte
+
+const (
+	FieldNonce AccountFields = 1 << iota
+	FieldBalance
+	FieldCodeHash
+	FieldStorageRoot
+)
+
+var accountFieldNames = []struct {
+	field AccountFields
+	name  string
+}{
+	{FieldNonce, "nonce"},
+	{FieldBalance, "balance"},
+	{FieldCodeHash, "codehash"},
+	{FieldStorageRoot, "storage_root"},
+}
+
+func (f AccountFields) String() string {
+	var names []string
+	for _, n := range accountFieldNames {
+		if f&n.field != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (f AccountFields) MarshalJSON() ([]byte, error) {
+	names := []string{}
+	for _, n := range accountFieldNames {
+		if f&n.field != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return json.Marshal(names)
+}
+
+func (f *AccountFields) UnmarshalJSON(input []byte) error {
+	var names []string
+	if err := json.Unmarshal(input, &names); err != nil {
+		return err
+	}
+	*f = 0
+	for _, name := range names {
+		found := false
+		for _, n := range accountFieldNames {
+			if n.name == name {
+				*f |= n.field
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown account field %q", name)
+		}
+	}
+	return nil
+}
+
+// Layout of the meta info that insertMetaInfo appends to each proof row. The
+// positions of the roots, address and counter are relative to the end of the
+// row body, the flags are relative to the end of the row.
+const (
+	metaSRootOffset      = 0
+	metaCRootOffset      = 32
+	metaAddressOffset    = 64
+	metaCounterOffset    = 96
+	metaPublicRootOffset = 100
+	metaLen              = 142 // includes the row kind
+
+	accountModFlagPos         = 10
+	nonExistingStorageFlagPos = 9
+	nonExistingAccountFlagPos = 8
+	accountDeleteFlagPos      = 7
+	codeHashModFlagPos        = 6
+	balanceModFlagPos         = 5
+	nonceModFlagPos           = 4
+	storageModFlagPos         = 3
+	notFirstLevelPos          = 2
+)
+
+// modFlagPos gives the (from the end of the row) position of the flag that is
+// set for the modification type. The other modification types are flagged as
+// one of these (see TrieModification.flags).
+var modFlagPos = map[ModType]int{
+	StorageMod:         storageModFlagPos,
+	NonceMod:           nonceModFlagPos,
+	BalanceMod:         balanceModFlagPos,
+	CodeHashMod:        codeHashModFlagPos,
+	DeleteAccount:      accountDeleteFlagPos,
+	NonExistingAccount: nonExistingAccountFlagPos,
+	NonExistingStorage: nonExistingStorageFlagPos,
+	AccountMod:         accountModFlagPos,
+}
+
+// accountFieldFlagPos gives the position of the flag that is set for a field
+// changed by AccountMod.
+var accountFieldFlagPos = map[AccountFields]int{
+	FieldNonce:       nonceModFlagPos,
+	FieldBalance:     balanceModFlagPos,
+	FieldCodeHash:    codeHashModFlagPos,
+	FieldStorageRoot: storageModFlagPos,
+}
+
+// BranchFlags are the flags stored in the S part of a RowBranchInit row.
+type BranchFlags struct {
+	ModifiedIndex    byte `json:"modified_index"`
+	DriftedIndex     byte `json:"drifted_index"`
+	IsSPlaceholder   bool `json:"is_s_placeholder"`
+	IsCPlaceholder   bool `json:"is_c_placeholder"`
+	IsExtension      bool `json:"is_extension"`
+	IsC16            bool `json:"is_c16"`
+	IsC1             bool `json:"is_c1"`
+	IsExtShortC16    bool `json:"is_ext_short_c16"`
+	IsExtShortC1     bool `json:"is_ext_short_c1"`
+	IsExtLongEvenC16 bool `json:"is_ext_long_even_c16"`
+	IsExtLongEvenC1  bool `json:"is_ext_long_even_c1"`
+	IsExtLongOddC16  bool `json:"is_ext_long_odd_c16"`
+	IsExtLongOddC1   bool `json:"is_ext_long_odd_c1"`
+}
+
+// WitnessRow is a single row of the witness. Rows of kind RowHash only hold the
+// RLP of the node to be hashed, all the other rows hold the S and C part of the
+// row and the meta info.
+type WitnessRow struct {
+	Kind RowKind
+
+	// S holds the first branchNodeRLPLen+32 bytes of the row (S RLP bytes and S advices),
+	// C holds the rest of the row body (C RLP bytes and C advices). Branch rows have
+	// a body of 68 bytes, the other rows have one additional byte at the end of C.
+	S []byte
+	C []byte
+
+	// RLP is set for RowHash rows only.
+	RLP []byte
+
+	SRoot         common.Hash
+	CRoot         common.Hash
+	AddressHash   common.Hash // keccak of the account address
+	Counter       uint32      // index of the modification the row belongs to
+	PublicRoot    common.Hash
+	NotFirstLevel bool
+	Modification  ModType
+	Fields        AccountFields // the fields changed by AccountMod
+}
+
+// Branch returns the flags of a RowBranchInit row.
+func (r *WitnessRow) Branch() BranchFlags {
+	flag := func(pos int) bool {
+		return r.S[pos] == 1
+	}
+	return BranchFlags{
+		ModifiedIndex:    r.S[keyPos],
+		DriftedIndex:     r.S[driftedPos],
+		IsSPlaceholder:   flag(isBranchSPlaceholderPos),
+		IsCPlaceholder:   flag(isBranchCPlaceholderPos),
+		IsExtension:      flag(isExtensionPos),
+		IsC16:            flag(isBranchC16Pos),
+		IsC1:             flag(isBranchC1Pos),
+		IsExtShortC16:    flag(isExtShortC16Pos),
+		IsExtShortC1:     flag(isExtShortC1Pos),
+		IsExtLongEvenC16: flag(isExtLongEvenC16Pos),
+		IsExtLongEvenC1:  flag(isExtLongEvenC1Pos),
+		IsExtLongOddC16:  flag(isExtLongOddC16Pos),
+		IsExtLongOddC1:   flag(isExtLongOddC1Pos),
+	}
+}
+
+// Witness is the typed form of the matrix returned by GetParallelProofs.
+type Witness struct {
+	Rows []WitnessRow
+}
+
+// modTypesWithFlag are the modification types that have their own flag in the meta info.
+var modTypesWithFlag = []ModType{StorageMod, NonceMod, BalanceMod, CodeHashMod, DeleteAccount, NonExistingAccount, NonExistingStorage, AccountMod}
+
+// legacyMetaLen is the length of the meta info of the witnesses before version 1.
+const legacyMetaLen = 138
+
+// isLegacyRow tells whether a matrix row (other than a hash row) has the meta info
+// of the witnesses before version 1. The body of the branch rows has 68 bytes, the
+// body of the other rows 69 (70 in some neighbouring leaf rows).
+func isLegacyRow(kind RowKind, row []byte) bool {
+	bodyLen := 2*branch2start + 1
+	if kind == RowBranchInit || kind == RowBranchChild {
+		bodyLen--
+	}
+	l := len(row) - bodyLen
+	return l == legacyMetaLen || (kind == RowAccountLeafNeighbouringLeaf && l == legacyMetaLen+1)
+}
+
+// WitnessFromMatrix converts the legacy matrix (as returned by GetParallelProofs)
+// into a Witness. Witness.Matrix converts it back into exactly the same bytes.
+func WitnessFromMatrix(matrix [][]byte) (*Witness, error) {
+	// All the rows need to have the same layout, a matrix in the legacy layout is
+	// rejected with a WitnessVersionError.
+	rows, legacy := 0, 0
+	for _, row := range matrix {
+		if len(row) == 0 || RowKind(row[len(row)-1]) == RowHash {
+			continue
+		}
+		rows++
+		if isLegacyRow(RowKind(row[len(row)-1]), row) {
+			legacy++
+		}
+	}
+	if legacy > 0 {
+		if legacy != rows {
+			return nil, fmt.Errorf("%d of %d rows have the meta info of %d bytes, the layouts of the rows are mixed",
+				legacy, rows, legacyMetaLen)
+		}
+		return nil, &WitnessVersionError{Version: 0, MetaLen: legacyMetaLen}
+	}
+
+	w := &Witness{Rows: make([]WitnessRow, 0, len(matrix))}
+	for i, row := range matrix {
+		if len(row) == 0 {
+			return nil, fmt.Errorf("row %d is empty", i)
+		}
+		kind := RowKind(row[len(row)-1])
+		if _, ok := rowKindNames[kind]; !ok {
+			return nil, fmt.Errorf("row %d: unknown row kind %d", i, row[len(row)-1])
+		}
+		if kind == RowHash {
+			w.Rows = append(w.Rows, WitnessRow{Kind: kind, RLP: common.CopyBytes(row[:len(row)-1])})
+			continue
+		}
+
+		l := len(row)
+		bodyLen := l - metaLen
+		if bodyLen < 2*branch2start {
+			return nil, fmt.Errorf("row %d (%s) is too short: %d bytes", i, kind, l)
+		}
+		meta := row[bodyLen:]
+		r := WitnessRow{
+			Kind:          kind,
+			S:             common.CopyBytes(row[:branch2start]),
+			C:             common.CopyBytes(row[branch2start:bodyLen]),
+			SRoot:         common.BytesToHash(meta[metaSRootOffset : metaSRootOffset+32]),
+			CRoot:         common.BytesToHash(meta[metaCRootOffset : metaCRootOffset+32]),
+			AddressHash:   common.BytesToHash(meta[metaAddressOffset : metaAddressOffset+32]),
+			Counter:       binary.BigEndian.Uint32(meta[metaCounterOffset : metaCounterOffset+counterLen]),
+			PublicRoot:    common.BytesToHash(meta[metaPublicRootOffset : metaPublicRootOffset+32]),
+			NotFirstLevel: row[l-notFirstLevelPos] == 1,
+		}
+		if row[l-notFirstLevelPos] > 1 {
+			return nil, fmt.Errorf("row %d (%s): invalid first level flag %d", i, kind, row[l-notFirstLevelPos])
+		}
+		mod, fields, err := modificationFromFlags(row, modTypesWithFlag)
+		if err != nil {
+			return nil, fmt.Errorf("row %d (%s): %w", i, kind, err)
+		}
+		r.Modification = mod
+		r.Fields = fields
+		w.Rows = append(w.Rows, r)
+	}
+
+	return w, nil
+}
+
+func modificationFromFlags(row []byte, types []ModType) (ModType, AccountFields, error) {
+	l := len(row)
+	set := make(map[ModType]bool)
+	var mod ModType
+	for _, typ := range types {
+		switch row[l-modFlagPos[typ]] {
+		case 0:
+		case 1:
+			set[typ] = true
+			mod = typ
+		default:
+			return 0, 0, fmt.Errorf("invalid %s flag %d", typ, row[l-modFlagPos[typ]])
+		}
+	}
+	if set[AccountMod] {
+		// The flags of the changed fields are set too.
+		var fields AccountFields
+		for field, pos := range accountFieldFlagPos {
+			if row[l-pos] == 1 {
+				fields |= field
+			}
+		}
+		for typ := range set {
+			if typ != AccountMod && typ != StorageMod && typ != NonceMod && typ != BalanceMod && typ != CodeHashMod {
+				return 0, 0, fmt.Errorf("%s flag set for account modification", typ)
+			}
+		}
+		return AccountMod, fields, nil
+	}
+	if len(set) != 1 {
+		return 0, 0, fmt.Errorf("%d modification flags set", len(set))
+	}
+
+	return mod, 0, nil
+}
+
+// Matrix converts the witness into the legacy matrix format.
+func (w *Witness) Matrix() [][]byte {
+	matrix := make([][]byte, len(w.Rows))
+	for i, r := range w.Rows {
+		if r.Kind == RowHash {
+			matrix[i] = append(common.CopyBytes(r.RLP), byte(r.Kind))
+			continue
+		}
+		bodyLen := len(r.S) + len(r.C)
+		row := make([]byte, bodyLen+metaLen)
+		copy(row, r.S)
+		copy(row[len(r.S):], r.C)
+		meta := row[bodyLen:]
+		copy(meta[metaSRootOffset:], r.SRoot[:])
+		copy(meta[metaCRootOffset:], r.CRoot[:])
+		copy(meta[metaAddressOffset:], r.AddressHash[:])
+		binary.BigEndian.PutUint32(meta[metaCounterOffset:], r.Counter)
+		copy(meta[metaPublicRootOffset:], r.PublicRoot[:])
+
+		l := len(row)
+		if pos, ok := modFlagPos[r.Modification]; ok {
+			row[l-pos] = 1
+		}
+		if r.Modification == AccountMod {
+			for field, pos := range accountFieldFlagPos {
+				if r.Fields&field != 0 {
+					row[l-pos] = 1
+				}
+			}
+		}
+		if r.NotFirstLevel {
+			row[l-notFirstLevelPos] = 1
+		}
+		row[l-1] = byte(r.Kind)
+		matrix[i] = row
+	}
+
+	return matrix
+}
+
+/*
+JSON encoding of the witness (version 1):
+
+	{
+		"version": 1,
+		"rows": [
+			{
+				"kind": "branch_init",            // see rowKindNames
+				"s": "0x...",                      // S RLP bytes and S advices
+				"c": "0x...",                      // C RLP bytes and C advices
+				"branch": {...},                   // BranchFlags, branch_init rows only
+				"s_root": "0x...",
+				"c_root": "0x...",
+				"address_hash": "0x...",
+				"counter": 0,
+				"public_root": "0x...",
+				"not_first_level": false,
+				"modification": "storage",         // see modTypeNames
+				"fields": ["nonce", "balance"]     // account modification only
+			},
+			{
+				"kind": "hash",
+				"rlp": "0x..."                     // node to be hashed
+			}
+		]
+	}
+
+The branch flags are redundant (they are stored in "s"), they are checked
+against "s" when decoding.
+*/
+
+type jsonWitness struct {
+	Version int       `json:"version"`
+	Rows    []jsonRow `json:"rows"`
+}
+
+type jsonRow struct {
+	Kind          RowKind       `json:"kind"`
+	S             hexutil.Bytes `json:"s,omitempty"`
+	C             hexutil.Bytes `json:"c,omitempty"`
+	RLP           hexutil.Bytes `json:"rlp,omitempty"`
+	Branch        *BranchFlags  `json:"branch,omitempty"`
+	SRoot         *common.Hash  `json:"s_root,omitempty"`
+	CRoot         *common.Hash  `json:"c_root,omitempty"`
+	AddressHash   *common.Hash  `json:"address_hash,omitempty"`
+	Counter       *uint32       `json:"counter,omitempty"`
+	PublicRoot    *common.Hash  `json:"public_root,omitempty"`
+	NotFirstLevel *bool         `json:"not_first_level,omitempty"`
+	Modification  *ModType      `json:"modification,omitempty"`
+	Fields        AccountFields `json:"fields,omitempty"`
+}
+
+func (w *Witness) MarshalJSON() ([]byte, error) {
+	enc := jsonWitness{Version: WitnessVersion, Rows: make([]jsonRow, len(w.Rows))}
+	for i := range w.Rows {
+		r := &w.Rows[i]
+		if r.Kind == RowHash {
+			enc.Rows[i] = jsonRow{Kind: r.Kind, RLP: r.RLP}
+			continue
+		}
+		if len(r.S) != branch2start {
+			return nil, fmt.Errorf("row %d: S should have %d bytes, has %d", i, branch2start, len(r.S))
+		}
+		enc.Rows[i] = jsonRow{
+			Kind:          r.Kind,
+			S:             r.S,
+			C:             r.C,
+			SRoot:         &r.SRoot,
+			CRoot:         &r.CRoot,
+			AddressHash:   &r.AddressHash,
+			Counter:       &r.Counter,
+			PublicRoot:    &r.PublicRoot,
+			NotFirstLevel: &r.NotFirstLevel,
+			Modification:  &r.Modification,
+			Fields:        r.Fields,
+		}
+		if r.Kind == RowBranchInit {
+			flags := r.Branch()
+			enc.Rows[i].Branch = &flags
+		}
+	}
+
+	return json.Marshal(enc)
+}
+
+func (w *Witness) UnmarshalJSON(input []byte) error {
+	var dec jsonWitness
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	if dec.Version != WitnessVersion {
+		return &WitnessVersionError{Version: dec.Version}
+	}
+	rows := make([]WitnessRow, len(dec.Rows))
+	for i, d := range dec.Rows {
+		if d.Kind == RowHash {
+			if d.RLP == nil {
+				return fmt.Errorf("row %d: missing rlp", i)
+			}
+			rows[i] = WitnessRow{Kind: d.Kind, RLP: d.RLP}
+			continue
+		}
+		if len(d.S) != branch2start || len(d.C) < branch2start {
+			return fmt.Errorf("row %d (%s): invalid s or c length", i, d.Kind)
+		}
+		if d.SRoot == nil || d.CRoot == nil || d.AddressHash == nil || d.Counter == nil ||
+			d.PublicRoot == nil || d.NotFirstLevel == nil || d.Modification == nil {
+			return fmt.Errorf("row %d (%s): missing meta info", i, d.Kind)
+		}
+		r := WitnessRow{
+			Kind:          d.Kind,
+			S:             d.S,
+			C:             d.C,
+			SRoot:         *d.SRoot,
+			CRoot:         *d.CRoot,
+			AddressHash:   *d.AddressHash,
+			Counter:       *d.Counter,
+			PublicRoot:    *d.PublicRoot,
+			NotFirstLevel: *d.NotFirstLevel,
+			Modification:  *d.Modification,
+			Fields:        d.Fields,
+		}
+		if d.Branch != nil && (d.Kind != RowBranchInit || *d.Branch != r.Branch()) {
+			return fmt.Errorf("row %d (%s): branch flags don't match s", i, d.Kind)
+		}
+		rows[i] = r
+	}
+	w.Rows = rows
+
+	return nil
+}
+
+// ParseWitness parses either the matrix written by MatrixToJson (as in the files
+// in generated_witnesses) or the versioned witness JSON.
+func ParseWitness(input []byte) (*Witness, error) {
+	input = bytes.TrimSpace(input)
+	if len(input) > 0 && input[0] == '{' {
+		w := new(Witness)
+		if err := json.Unmarshal(input, w); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// json.Unmarshal expects []byte to be base64 encoded, so the rows are decoded as []int.
+	var rows [][]int
+	if err := json.Unmarshal(input, &rows); err != nil {
+		return nil, err
+	}
+	matrix := make([][]byte, len(rows))
+	for i, row := range rows {
+		matrix[i] = make([]byte, len(row))
+		for j, b := range row {
+			if b < 0 || b > 255 {
+				return nil, fmt.Errorf("row %d: %d is not a byte", i, b)
+			}
+			matrix[i][j] = byte(b)
+		}
+	}
+
+	return WitnessFromMatrix(matrix)
+}
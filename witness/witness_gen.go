@@ -3,7 +3,6 @@ package witness
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
 	"math/big"
 	"os"
 	"strconv"
@@ -42,7 +41,7 @@ const isExtLongOddC16Pos = 25
 const isExtLongOddC1Pos = 26
 
 /*
-Info about row type (given as the last element of the row):
+Info about row type (given as the last element of the row, see also RowKind in witness.go):
 0: init branch (such a row contains RLP info about the branch node; key)
 1: branch child
 2: storage leaf s key
@@ -73,6 +72,18 @@ const (
 	CreateAccount
 	DeleteAccount
 	NonExistingAccount
+	NonExistingStorage
+	// Read modifications don't change the state, the witness proves the value
+	// given in the modification (S and C proof are the same). They set the flag
+	// of the corresponding modification (StorageRead sets the storage mod flag).
+	// The generator returns ReadMismatchError if the value is not the one in the state,
+	// or if the account of an account read doesn't exist (NonExistingAccount proves that).
+	StorageRead
+	NonceRead
+	BalanceRead
+	CodeHashRead
+	// AccountMod changes the account fields set in TrieModification.Account at once.
+	AccountMod
 )
 
 type TrieModification struct {
@@ -83,12 +94,57 @@ type TrieModification struct {
 	Nonce    uint64
 	Balance  *big.Int
 	CodeHash []byte
+	Account  *AccountUpdate // AccountMod only
 }
 
-func check(err error) {
-	if err != nil {
-		log.Fatal(err)
+// AccountUpdate holds the new values of the account fields for AccountMod, nil
+// fields are not changed.
+type AccountUpdate struct {
+	Nonce       *uint64
+	Balance     *big.Int
+	CodeHash    []byte // code, as TrieModification.CodeHash
+	StorageRoot *common.Hash
+}
+
+func (u *AccountUpdate) fields() AccountFields {
+	var fields AccountFields
+	if u == nil {
+		return fields
+	}
+	if u.Nonce != nil {
+		fields |= FieldNonce
+	}
+	if u.Balance != nil {
+		fields |= FieldBalance
+	}
+	if u.CodeHash != nil {
+		fields |= FieldCodeHash
 	}
+	if u.StorageRoot != nil {
+		fields |= FieldStorageRoot
+	}
+	return fields
+}
+
+// flags returns the modification type and the changed account fields as they are
+// flagged in the witness: the read modifications set the flag of the corresponding
+// modification, CreateAccount is an AccountMod changing all the fields.
+func (m *TrieModification) flags() (ModType, AccountFields) {
+	switch m.Type {
+	case StorageRead:
+		return StorageMod, 0
+	case NonceRead:
+		return NonceMod, 0
+	case BalanceRead:
+		return BalanceMod, 0
+	case CodeHashRead:
+		return CodeHashMod, 0
+	case CreateAccount:
+		return AccountMod, FieldNonce | FieldBalance | FieldCodeHash | FieldStorageRoot
+	case AccountMod:
+		return AccountMod, m.Account.fields()
+	}
+	return m.Type, 0
 }
 
 func MatrixToJson(rows [][]byte) string {
@@ -119,13 +175,15 @@ func listToJson(row []byte) string {
 }
 
 // Equip proof with intermediate state roots, first level info, counter, address RLC,
-// modification tag (whether it is storage / nonce / balance change).
-func insertMetaInfo(stream, sRoot, cRoot, address, counter []byte, notFirstLevel, isStorageMod, isNonceMod, isBalanceMod, isCodeHashMod, isAccountDeleteMod, isNonExistingAccount byte) []byte {
+// modification tag (whether it is storage / nonce / balance change). When isAccountMod
+// is set, the storage / nonce / balance / codehash tags are set for each account
+// field that is changed (the storage tag meaning the storage root).
+func insertMetaInfo(stream, sRoot, cRoot, address, counter []byte, notFirstLevel, isStorageMod, isNonceMod, isBalanceMod, isCodeHashMod, isAccountDeleteMod, isNonExistingAccount, isNonExistingStorage, isAccountMod byte) []byte {
 	// The last byte (-1) in a row determines the type of the row.
 	// Byte -2 determines whether it's the first level or not.
 	// Bytes before that store intermediate final and end roots.
 	l := len(stream)
-	extendLen := 64 + 32 + 32 + counterLen + 1 + 6
+	extendLen := 64 + 32 + 32 + counterLen + 1 + 8
 	extended := make([]byte, l + extendLen) // make space for 32 + 32 + 32 + 1 (s hash, c hash, public_root, notFirstLevel)
 	copy(extended, stream)
 	extended[l+extendLen-1] = extended[l-1] // put selector to the last place
@@ -150,21 +208,21 @@ func insertMetaInfo(stream, sRoot, cRoot, address, counter []byte, notFirstLevel
 	extended[l+extendLen-6] = isCodeHashMod
 	extended[l+extendLen-7] = isAccountDeleteMod
 	extended[l+extendLen-8] = isNonExistingAccount
+	extended[l+extendLen-9] = isNonExistingStorage
+	extended[l+extendLen-10] = isAccountMod
 
 	return extended
 }
 
+// insertPublicRoot sets the public root of the proof rows: the first row gets the root
+// before all the modifications, the others the root after them.
 func insertPublicRoot(proof [][]byte, startRoot, finalRoot []byte) {
 	for i := 0; i < len(proof); i++ {
-		l := len(proof[i])
+		pos := len(proof[i]) - metaLen + metaPublicRootOffset
 		if i == 0 {
-			for j := 0; j < 32; j++ {
-				proof[i][l - 32 - 6 + j] = startRoot[j]
-			}
+			copy(proof[i][pos:pos+32], startRoot)
 		} else {
-			for j := 0; j < 32; j++ {
-				proof[i][l - 32 - 6 + j] = finalRoot[j]
-			}
+			copy(proof[i][pos:pos+32], finalRoot)
 		}
 	}
 }
@@ -174,13 +232,20 @@ func VerifyProof(proof [][]byte, key []byte) bool {
 	for i := 0; i < len(proof)-1; i++ {
 		parentHash := hasher.HashData(proof[i])
 		parent, err := trie.DecodeNode(parentHash, proof[i])
-		check(err)
+		if err != nil {
+			return false
+		}
 
 		childHash := hasher.HashData(proof[i+1])
 		child, err := trie.DecodeNode(childHash, proof[i+1])
-		check(err)
+		if err != nil {
+			return false
+		}
 
-		r := parent.(*trie.FullNode)
+		r, ok := parent.(*trie.FullNode)
+		if !ok {
+			return false
+		}
 		c := r.Children[key[i]] // TODO: doesn't cover all scenarios
 		u, _ := hasher.Hash(child, false)
 
@@ -192,75 +257,89 @@ func VerifyProof(proof [][]byte, key []byte) bool {
 	return true
 }
 
-func VerifyTwoProofsAndPath(proof1, proof2 [][]byte, key []byte) bool {
+// VerifyTwoProofsAndPath checks that each node of both proofs is referenced by its
+// hash in the previous branch at the position of key, and that the branches of the
+// two proofs differ only at that position. A MalformedProofError describes the
+// constraint that failed.
+func VerifyTwoProofsAndPath(proof1, proof2 [][]byte, key []byte) error {
 	if len(proof1) != len(proof2) {
-		fmt.Println("constraint failed: proofs length not the same")
-		return false
+		return malformedProof("proofs length not the same")
 	}
 	hasher := trie.NewHasher(false)
 	for i := 0; i < len(proof1)-1; i++ { // -1 because it checks current and next row
 		parentHash := hasher.HashData(proof1[i])
 		parent, err := trie.DecodeNode(parentHash, proof1[i])
-		check(err)
+		if err != nil {
+			return malformedProof("%v", err)
+		}
 
 		childHash := hasher.HashData(proof1[i+1])
 		child, err := trie.DecodeNode(childHash, proof1[i+1])
-		check(err)
+		if err != nil {
+			return malformedProof("%v", err)
+		}
 
-		r := parent.(*trie.FullNode)
+		r, ok := parent.(*trie.FullNode)
+		if !ok {
+			return malformedProof("proof node %d is not a branch", i)
+		}
 		c := r.Children[key[i]] // TODO: doesn't cover all scenarios
 		u, _ := hasher.Hash(child, false)
 
 		if fmt.Sprintf("%b", u) != fmt.Sprintf("%b", c) {
-			fmt.Println("constraint failed: proof not valid")
-			return false
+			return malformedProof("proof node %d is not in its parent", i+1)
 		}
 
 		parentHash2 := hasher.HashData(proof2[i])
 		parent2, err := trie.DecodeNode(parentHash2, proof2[i])
-		check(err)
+		if err != nil {
+			return malformedProof("%v", err)
+		}
 
 		childHash2 := hasher.HashData(proof2[i+1])
 		child2, err := trie.DecodeNode(childHash2, proof2[i+1])
-		check(err)
+		if err != nil {
+			return malformedProof("%v", err)
+		}
 
-		r2 := parent2.(*trie.FullNode)
+		r2, ok := parent2.(*trie.FullNode)
+		if !ok {
+			return malformedProof("proof node %d is not a branch", i)
+		}
 		c2 := r2.Children[key[i]] // TODO: doesn't cover all scenarios
 		u2, _ := hasher.Hash(child2, false)
 
 		if fmt.Sprintf("%b", u2) != fmt.Sprintf("%b", c2) {
-			fmt.Println("constraint failed: proof not valid")
-			return false
+			return malformedProof("proof node %d is not in its parent", i+1)
 		}
 
 		// Constraints that we are having the same path for both proofs:
 		for j := 0; j < 16; j++ {
 			if j != int(key[i]) {
 				if fmt.Sprintf("%b", r.Children[j]) != fmt.Sprintf("%b", r2.Children[j]) {
-					fmt.Println("constraint failed: path not valid")
-					return false
+					return malformedProof("branches %d differ at position %d, not only at the path", i, j)
 				}
 			}
 		}
 	}
 
-	return true
+	return nil
 }
 
-// Check that elements in a branch are all the same, except at the position exceptPos.
-func VerifyElementsInTwoBranches(b1, b2 *trie.FullNode, exceptPos byte) bool {
+// VerifyElementsInTwoBranches checks that the elements in the branches are all the
+// same, except at the position exceptPos.
+func VerifyElementsInTwoBranches(b1, b2 *trie.FullNode, exceptPos byte) error {
 	for j := 0; j < 16; j++ {
 		if j != int(exceptPos) {
 			if fmt.Sprintf("%b", b1.Children[j]) != fmt.Sprintf("%b", b2.Children[j]) {
-				fmt.Println("constraint failed: element in branch not the same")
-				return false
+				return malformedProof("element %d in branch not the same", j)
 			}
 		}
 	}
-	return true
+	return nil
 }
 
-func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchRLPOffset int) {
+func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchRLPOffset int) error {
 	// TODO: ValueNode info is currently missing
 	rowInd := 1 // start with 1 because rows[0] contains some RLP data
 	colInd := branchNodeRLPLen
@@ -297,13 +376,15 @@ func prepareBranchWitness(rows [][]byte, branch []byte, branchStart int, branchR
 			// if we are not in a child, it can only be b = 128 which presents nil (no child
 			// at this position)
 			if b != 128 {
-				panic("not 128")
+				return unsupportedNode("branch child at position %d is neither a hash nor nil (%d)", rowInd-1, b)
 			}
 			rows[rowInd][branchStart+branchNodeRLPLen] = b
 			rowInd++
 			// fmt.Println(rows[rowInd-1])
 		}
 	}
+
+	return nil
 }
 
 func prepareDriftedLeafPlaceholder(isAccount bool) [][]byte {
@@ -334,15 +415,19 @@ func prepareEmptyExtensionRows() [][]byte {
 	return [][]byte{ext_row1, ext_row2}
 }
 
-func prepareExtensionRows(extNibbles[][]byte, extensionNodeInd int, proofEl1, proofEl2 []byte) (byte, []byte, []byte) {
+func prepareExtensionRows(extNibbles[][]byte, extensionNodeInd int, proofEl1, proofEl2 []byte) (byte, []byte, []byte, error) {
 	var extensionRowS []byte
 	var extensionRowC []byte
 
 	extRows := prepareEmptyExtensionRows()
 	extensionRowS = extRows[0]
 	extensionRowC = extRows[1]
-	prepareExtensionRow(extensionRowS, proofEl1, true)
-	prepareExtensionRow(extensionRowC, proofEl2, false)
+	if err := prepareExtensionRow(extensionRowS, proofEl1, true); err != nil {
+		return 0, nil, nil, err
+	}
+	if err := prepareExtensionRow(extensionRowC, proofEl2, false); err != nil {
+		return 0, nil, nil, err
+	}
 
 	evenNumberOfNibbles := proofEl1[2] == 0
 	numberOfNibbles := byte(0)
@@ -376,7 +461,7 @@ func prepareExtensionRows(extNibbles[][]byte, extensionNodeInd int, proofEl1, pr
 		ind++
 	}
 
-	return numberOfNibbles, extensionRowS, extensionRowC
+	return numberOfNibbles, extensionRowS, extensionRowC, nil
 }
 
 func getExtensionNodeKeyLen(proofEl []byte) byte {
@@ -390,7 +475,7 @@ func getExtensionNodeKeyLen(proofEl []byte) byte {
 	}
 }
 
-func prepareExtensionRow(witnessRow, proofEl []byte, setKey bool) {
+func prepareExtensionRow(witnessRow, proofEl []byte, setKey bool) error {
 	// storageProof[i]:
 	// [228,130,0,149,160,114,253,150,133,18,192,156,19,241,162,51,210,24,1,151,16,48,7,177,42,60,49,34,230,254,242,79,132,165,90,75,249]
 	// elems:
@@ -411,7 +496,7 @@ func prepareExtensionRow(witnessRow, proofEl []byte, setKey bool) {
 
 	if !is_long {
 		if proofEl[2] != 160 {
-			panic("Extension node should be 160 S short")
+			return unsupportedNode("extension node child is not a hash")
 		}
 		for j := 0; j < 33; j++ {
 			witnessRow[branch2start+branchNodeRLPLen+j-1] = proofEl[2+j]
@@ -424,13 +509,15 @@ func prepareExtensionRow(witnessRow, proofEl []byte, setKey bool) {
 			}
 		}
 		if proofEl[2+lenK] != 160 {
-			panic("Extension node should be 160 S")
+			return unsupportedNode("extension node child is not a hash")
 		}
 		witnessRow[branch2start+branchNodeRLPLen-1] = proofEl[2+lenK]
 		for j := 0; j < 32; j++ {
 			witnessRow[branch2start+branchNodeRLPLen+j] = proofEl[3+lenK+j]
 		}
 	}
+
+	return nil
 }
 
 func prepareStorageLeafRows(row []byte, typ byte, valueIsZero bool) ([][]byte, []byte) {
@@ -468,7 +555,7 @@ func prepareStorageLeafRows(row []byte, typ byte, valueIsZero bool) ([][]byte, [
 	return [][]byte{leaf1, leaf2}, leafForHashing
 }
 
-func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte, []byte, []byte, []byte, []byte, []byte) {	
+func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte, []byte, []byte, []byte, []byte, []byte, error) {	
 	keyLenS := int(leafS[2]) - 128
 	keyLenC := int(leafC[2]) - 128
 	keyRowS := make([]byte, rowLen)
@@ -485,11 +572,11 @@ func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte
 
 	rlpStringSecondPartLenS := leafS[3+keyLenS] - 183
 	if rlpStringSecondPartLenS != 1 {
-		panic("Account leaf RLP at this position should be 1 (S)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf S: string length should take one byte")
 	}
 	rlpStringSecondPartLenC := leafC[3+keyLenC] - 183
 	if rlpStringSecondPartLenC != 1 {
-		panic("Account leaf RLP at this position should be 1 (C)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf C: string length should take one byte")
 	}
 	rlpStringLenS := leafS[3+keyLenS+1]
 	rlpStringLenC := leafC[3+keyLenC+1]
@@ -505,21 +592,21 @@ func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte
 
 	rlpListSecondPartLenS := leafS[3+keyLenS+1+1] - 247
 	if rlpListSecondPartLenS != 1 {
-		panic("Account leaf RLP 1 (S)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf S: list length should take one byte")
 	}
 	rlpListSecondPartLenC := leafC[3+keyLenC+1+1] - 247
 	if rlpListSecondPartLenC != 1 {
-		panic("Account leaf RLP 1 (C)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf C: list length should take one byte")
 	}
 
 	rlpListLenS := leafS[3+keyLenS+1+1+1]
 	if rlpStringLenS != rlpListLenS+2 {
-		panic("Account leaf RLP 2 (S)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf S: string length should be list length + 2")
 	}
 
 	rlpListLenC := leafC[3+keyLenC+1+1+1]
 	if rlpStringLenC != rlpListLenC+2 {
-		panic("Account leaf RLP 2 (C)")
+		return nil, nil, nil, nil, nil, nil, nil, malformedProof("account leaf C: string length should be list length + 2")
 	}
 
 	nonceStartS := 3 + keyLenS + 1 + 1 + 1 + 1
@@ -601,11 +688,11 @@ func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte
 	nonceBalanceRowS := getNonceBalanceRow(leafS, nonceS, keyLenS, balanceStartS, balanceRlpLenS)
 	nonceBalanceRowC := getNonceBalanceRow(leafC, nonceC, keyLenC, balanceStartC, balanceRlpLenC)
 
-	getStorageCodeHashRow := func(leaf []byte, storageStart int) []byte {
+	getStorageCodeHashRow := func(leaf []byte, storageStart int) ([]byte, error) {
 		storageCodeHashRow := make([]byte, rowLen)
 		storageRlpLen := leaf[storageStart] - 128
 		if storageRlpLen != 32 {
-			panic("Account leaf RLP 3")
+			return nil, malformedProof("account leaf storage root should be 32 bytes")
 		}
 		storage := leaf[storageStart : storageStart+32+1]
 		for i := 0; i < 33; i++ {
@@ -614,18 +701,24 @@ func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte
 		codeHashStart := storageStart + int(storageRlpLen) + 1
 		codeHashRlpLen := leaf[codeHashStart] - 128
 		if codeHashRlpLen != 32 {
-			panic("Account leaf RLP 4")
+			return nil, malformedProof("account leaf code hash should be 32 bytes")
 		}
 		codeHash := leaf[codeHashStart : codeHashStart+32+1]
 		for i := 0; i < 33; i++ {
 			storageCodeHashRow[branch2start+1+i] = codeHash[i] // start from c_rlp2
 		}
 
-		return storageCodeHashRow
+		return storageCodeHashRow, nil
 	}
 
-	storageCodeHashRowS := getStorageCodeHashRow(leafS, storageStartS)
-	storageCodeHashRowC := getStorageCodeHashRow(leafC, storageStartC)
+	storageCodeHashRowS, err := getStorageCodeHashRow(leafS, storageStartS)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, err
+	}
+	storageCodeHashRowC, err := getStorageCodeHashRow(leafC, storageStartC)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, err
+	}
 
 	keyRowS = append(keyRowS, 6)
 	keyRowC = append(keyRowC, 4)
@@ -634,10 +727,10 @@ func prepareAccountLeafRows(leafS, leafC, addressNibbles []byte) ([]byte, []byte
 	storageCodeHashRowS = append(storageCodeHashRowS, 9)
 	storageCodeHashRowC = append(storageCodeHashRowC, 11)
 
-	return keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC
+	return keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, nil
 }
 
-func prepareTwoBranchesWitness(branch1, branch2 []byte, key, branchC16, branchC1 byte, isBranchSPlaceholder, isBranchCPlaceholder bool) [][]byte {
+func prepareTwoBranchesWitness(branch1, branch2 []byte, key, branchC16, branchC1 byte, isBranchSPlaceholder, isBranchCPlaceholder bool) ([][]byte, error) {
 	rows := make([][]byte, 17)
 	rows[0] = make([]byte, rowLen)
 
@@ -709,16 +802,45 @@ func prepareTwoBranchesWitness(branch1, branch2 []byte, key, branchC16, branchC1
 			rows[i][rowLen-1] = 1
 		}
 	}
-	prepareBranchWitness(rows, branch1, 0, branch1RLPOffset)
-	prepareBranchWitness(rows, branch2, 2+32, branch2RLPOffset)
+	if err := prepareBranchWitness(rows, branch1, 0, branch1RLPOffset); err != nil {
+		return nil, err
+	}
+	if err := prepareBranchWitness(rows, branch2, 2+32, branch2RLPOffset); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
 
-	return rows
+// isExtensionNode reports whether the RLP encoded trie node is an extension node.
+func isExtensionNode(node []byte) bool {
+	elems, _, err := rlp.SplitList(node)
+	if err != nil {
+		return false
+	}
+	if n, _ := rlp.CountValues(elems); n != 2 {
+		return false
+	}
+	compact, _, err := rlp.SplitString(elems)
+	if err != nil || len(compact) == 0 {
+		return false
+	}
+	return compact[0]>>4&2 == 0
 }
 
-func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNode []byte, isAccountProof bool) ([][]byte, [][]byte, bool) {
+func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNode []byte, isAccountProof bool) ([][]byte, [][]byte, bool, error) {
 	rows := make([][]byte, 0)
 	toBeHashed := make([][]byte, 0)
 
+	// A proof ends in an extension node when the key is inserted into (or deleted
+	// from) the middle of the extension node or when a deletion turns a branch
+	// into an extension node, the witness doesn't support these yet.
+	for _, proof := range [][][]byte{proof1, proof2} {
+		if len(proof) > 0 && isExtensionNode(proof[len(proof)-1]) {
+			return nil, nil, false, unsupportedNode("the modification splits, creates or removes an extension node")
+		}
+	}
+
 	minLen := len(proof1)
 	if len(proof2) < minLen {
 		minLen = len(proof2)
@@ -734,18 +856,24 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 
 	// Check if the last proof element in the shorter proof is a leaf -
 	// if it is, then there is an additional branch.
-	additionalBranchNeeded := func(proofEl []byte) bool {
+	additionalBranchNeeded := func(proofEl []byte) (bool, error) {
 		elems, _, err := rlp.SplitList(proofEl)
-		check(err)
+		if err != nil {
+			return false, &MalformedProofError{Msg: err.Error()}
+		}
 		c, _ := rlp.CountValues(elems)
-		return c == 2
+		return c == 2, nil
 	}
 
 	additionalBranch := false
+	var err error
 	if len1 < len2 && len1 > 0 { // len = 0 when trie trie is empty
-		additionalBranch = additionalBranchNeeded(proof1[len1-1])
+		additionalBranch, err = additionalBranchNeeded(proof1[len1-1])
 	} else if len2 < len1 && len2 > 0 {
-		additionalBranch = additionalBranchNeeded(proof2[len2-1])
+		additionalBranch, err = additionalBranchNeeded(proof2[len2-1])
+	}
+	if err != nil {
+		return nil, nil, false, err
 	}
 
 	upTo := minLen
@@ -762,14 +890,17 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 	for i := 0; i < upTo; i++ {
 		elems, _, err := rlp.SplitList(proof1[i])
 		if err != nil {
-			fmt.Println("decode error", err)
+			return nil, nil, false, &MalformedProofError{Msg: err.Error()}
 		}
 
 		switch c, _ := rlp.CountValues(elems); c {
 		case 2:
 			if proof1[i][0] < 248 && i != len1 - 1 {
 				var numberOfNibbles byte
-				numberOfNibbles, extensionRowS, extensionRowC = prepareExtensionRows(extNibbles, extensionNodeInd, proof1[i], proof2[i])
+				numberOfNibbles, extensionRowS, extensionRowC, err = prepareExtensionRows(extNibbles, extensionNodeInd, proof1[i], proof2[i])
+				if err != nil {
+					return nil, nil, false, err
+				}
 				keyIndex += int(numberOfNibbles)
 				extensionNodeInd++
 				continue
@@ -780,8 +911,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				leafS := proof1[l-1]
 				leafC := proof2[l-1]
 
-				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC :=
+				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, err :=
 					prepareAccountLeafRows(leafS, leafC, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				
 				rows = append(rows, keyRowS)
 				rows = append(rows, keyRowC)
@@ -825,7 +959,10 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				}
 			}
 
-			bRows := prepareTwoBranchesWitness(proof1[i], proof2[i], key[keyIndex], branchC16, branchC1, false, false)
+			bRows, err := prepareTwoBranchesWitness(proof1[i], proof2[i], key[keyIndex], branchC16, branchC1, false, false)
+			if err != nil {
+				return nil, nil, false, err
+			}
 			keyIndex += 1
 
 			// extension node rows
@@ -863,6 +1000,9 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				// adding extension nodes for hashing:
 				addForHashing(proof1[i-1], &toBeHashed)
 				addForHashing(proof2[i-1], &toBeHashed)
+
+				// The extension node belongs only to this branch.
+				extensionRowS, extensionRowC = nil, nil
 			} else {
 				extRows := prepareEmptyExtensionRows()
 				bRows = append(bRows, extRows...)
@@ -880,17 +1020,17 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 					}
 					for j := 0; j < branchNodeRLPLen+32; j++ {
 						if bRows[k][j] != bRows[k][branch2start+j] {
-							panic("witness not properly generated")
+							return nil, nil, false, fmt.Errorf("witness not properly generated: branches differ at position %d", k-1)
 						}
 					}
 				}
 			}
 		default:
-			fmt.Println("invalid number of list elements")
+			return nil, nil, false, malformedProof("invalid number of list elements: %d", c)
 		}
 	}
 
-	addBranch := func(branch1, branch2 []byte, modifiedIndex byte, isCPlaceholder bool, branchC16, branchC1 byte) {
+	addBranch := func(branch1, branch2 []byte, modifiedIndex byte, isCPlaceholder bool, branchC16, branchC1 byte) error {
 		isBranchSPlaceholder := false
 		isBranchCPlaceholder := false
 		if isCPlaceholder {
@@ -898,7 +1038,10 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 		} else {
 			isBranchSPlaceholder = true
 		}
-		bRows := prepareTwoBranchesWitness(branch1, branch2, modifiedIndex, branchC16, branchC1, isBranchSPlaceholder, isBranchCPlaceholder)
+		bRows, err := prepareTwoBranchesWitness(branch1, branch2, modifiedIndex, branchC16, branchC1, isBranchSPlaceholder, isBranchCPlaceholder)
+		if err != nil {
+			return err
+		}
 		rows = append(rows, bRows...)
 
 		branchToBeHashed := branch1
@@ -906,6 +1049,8 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 			branchToBeHashed = branch2
 		}
 		addForHashing(branchToBeHashed, &toBeHashed)
+
+		return nil
 	}
 
 	getDriftedPosition := func(leafKeyRow []byte, numberOfNibbles int) byte {
@@ -972,8 +1117,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 					branchC1 = 0
 				}
 			} else {
-				numNibbles, extensionRowS, extensionRowC :=
+				numNibbles, extensionRowS, extensionRowC, err :=
 					prepareExtensionRows(extNibbles, extensionNodeInd, proof1[len1 - 3], proof1[len1 - 3])
+				if err != nil {
+					return nil, nil, false, err
+				}
 				numberOfNibbles = int(numNibbles)
 				extRows = append(extRows, extensionRowS)
 				extRows = append(extRows, extensionRowC)
@@ -992,7 +1140,9 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				}
 			}
 
-			addBranch(proof1[len1-2], proof1[len1-2], key[keyIndex + numberOfNibbles], true, branchC16, branchC1)
+			if err := addBranch(proof1[len1-2], proof1[len1-2], key[keyIndex + numberOfNibbles], true, branchC16, branchC1); err != nil {
+				return nil, nil, false, err
+			}
 			rows = append(rows, extRows...)
 
 			var leafRows [][]byte
@@ -1003,8 +1153,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 
 				// When generating a proof that account doesn't exist, the length of both proofs is the same (doesn't reach
 				// this code).
-				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC :=
+				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, err :=
 					prepareAccountLeafRows(leafS, leafC, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				leafRows = append(leafRows, keyRowS)
 				leafRows = append(leafRows, keyRowC)
 				leafRows = append(leafRows, nonExistingAccountRow) // not really needed
@@ -1088,8 +1241,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				h := append(neighbourNode, 5)
 				toBeHashed = append(toBeHashed, h)
 
-				keyRowS, _, _, _, _, _, _ :=
+				keyRowS, _, _, _, _, _, _, err :=
 					prepareAccountLeafRows(neighbourNode, neighbourNode, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				keyRowS = append(keyRowS, 10)
 				rows = append(rows, keyRowS)
 			} else {
@@ -1105,8 +1261,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 
 				// When generating a proof that account doesn't exist, the length of both proofs is the same (doesn't reach
 				// this code).
-				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC :=
+				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, err :=
 					prepareAccountLeafRows(leafS, leafC, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				
 				rows = append(rows, keyRowS)
 				rows = append(rows, keyRowC)
@@ -1152,8 +1311,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 					branchC1 = 0
 				}
 			} else { // diff is 2 when extension node is added
-				numNibbles, extensionRowS, extensionRowC :=
+				numNibbles, extensionRowS, extensionRowC, err :=
 					prepareExtensionRows(extNibbles, extensionNodeInd, proof2[len2 - 3], proof2[len2 - 3])
+				if err != nil {
+					return nil, nil, false, err
+				}
 				numberOfNibbles = int(numNibbles)
 				extRows = append(extRows, extensionRowS)
 				extRows = append(extRows, extensionRowC)
@@ -1172,7 +1334,9 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				}
 			}
 
-			addBranch(proof2[len2-2], proof2[len2-2], key[keyIndex + numberOfNibbles], false, branchC16, branchC1)
+			if err := addBranch(proof2[len2-2], proof2[len2-2], key[keyIndex + numberOfNibbles], false, branchC16, branchC1); err != nil {
+				return nil, nil, false, err
+			}
 			rows = append(rows, extRows...)
 
 			// Note that this is not just reversed order compared to
@@ -1190,8 +1354,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 
 				// When generating a proof that account doesn't exist, the length of both proofs is the same (doesn't reach
 				// this code).
-				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC :=
+				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, err :=
 					prepareAccountLeafRows(leafS, leafC, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				leafRows = append(leafRows, keyRowS)
 				leafRows = append(leafRows, keyRowC)
 				leafRows = append(leafRows, nonExistingAccountRow)
@@ -1265,8 +1432,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 				h := append(neighbourNode, 5)
 				toBeHashed = append(toBeHashed, h)
 
-				keyRowS, _, _, _, _, _, _ :=
+				keyRowS, _, _, _, _, _, _, err :=
 					prepareAccountLeafRows(neighbourNode, neighbourNode, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				keyRowS = append(keyRowS, 10)
 				rows = append(rows, keyRowS)
 			} else {
@@ -1283,8 +1453,11 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 
 				// When generating a proof that account doesn't exist, the length of both proofs is the same (doesn't reach
 				// this code).
-				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC :=
+				keyRowS, keyRowC, nonExistingAccountRow, nonceBalanceRowS, nonceBalanceRowC, storageCodeHashRowS, storageCodeHashRowC, err :=
 					prepareAccountLeafRows(leafS, leafC, key)
+				if err != nil {
+					return nil, nil, false, err
+				}
 				
 				rows = append(rows, keyRowS)
 				rows = append(rows, keyRowC)
@@ -1318,30 +1491,89 @@ func prepareWitness(proof1, proof2, extNibbles [][]byte, key []byte, neighbourNo
 		rows = append(rows, pRows...)
 	}
 
-	return rows, toBeHashed, extensionNodeInd > 0
+	return rows, toBeHashed, extensionNodeInd > 0, nil
 }
 
-func GetParallelProofs(nodeUrl string, blockNum int, trieModifications []TrieModification) [][]byte {
-	blockNumberParent := big.NewInt(int64(blockNum))
-	oracle.NodeUrl = nodeUrl
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+func GetParallelProofs(nodeUrl string, blockNum int, trieModifications []TrieModification) ([][]byte, error) {
+	return GetParallelProofsFromSource(oracle.NewRPCSource(nodeUrl), blockNum, trieModifications)
+}
 
-	for i := 0; i < len(trieModifications); i++ {
-		// TODO: remove SetState (using it now just because this particular key might
-		// not be set and we will obtain empty storageProof)
-		v := common.BigToHash(big.NewInt(int64(17)))
-		statedb.SetState(trieModifications[i].Address, trieModifications[i].Key, v)
-		// TODO: enable GetState to get the preimages -
-		// GetState calls GetCommittedState which calls PrefetchStorage to get the preimages
-		// statedb.GetState(addr, keys[i])
+// GetParallelProofsFromSource is like GetParallelProofs, but the state of the block is
+// obtained from src (for example local fixtures) instead of a node.
+func GetParallelProofsFromSource(src oracle.NodeSource, blockNum int, trieModifications []TrieModification) ([][]byte, error) {
+	return GetParallelProofsWithOracle(oracle.NewOracle(src), blockNum, trieModifications)
+}
+
+// GetParallelProofsWithOracle is like GetParallelProofsFromSource, but the state is
+// obtained through orc, which keeps everything it fetched (see oracle.Oracle.Bundle).
+func GetParallelProofsWithOracle(orc *oracle.Oracle, blockNum int, trieModifications []TrieModification) ([][]byte, error) {
+	statedb, err := newStateDB(orc, blockNum)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := prefetchProofs(trieModifications, statedb); err != nil {
+		return nil, err
+	}
+	if err := loadStorage(trieModifications, statedb); err != nil {
+		return nil, err
 	}
 
 	return getParallelProofs(trieModifications, statedb)
 }
 
-func prepareProof(ind int, newProof [][]byte, addrh []byte, sRoot, cRoot, startRoot, finalRoot common.Hash, mType ModType) [][]byte {
+// newStateDB returns the state of block blockNum obtained through orc.
+func newStateDB(orc *oracle.Oracle, blockNum int) (*state.StateDB, error) {
+	blockHeader, err := orc.PrefetchBlock(big.NewInt(int64(blockNum)), true, nil)
+	if err != nil {
+		return nil, err
+	}
+	database, err := state.NewDatabase(blockHeader, orc)
+	if err != nil {
+		return nil, err
+	}
+	return state.New(blockHeader.Root, database, nil)
+}
+
+// prefetchProofs fetches (in parallel) the proofs of all the accounts and storage
+// slots the modifications touch, together with the proofs of the next block which
+// are needed when a deletion turns a branch into a leaf or an extension node.
+func prefetchProofs(trieModifications []TrieModification, statedb *state.StateDB) error {
+	blockNumber := statedb.Db.BlockNumber
+	nextBlockNumber := big.NewInt(blockNumber.Int64() + 1)
+	var reqs []oracle.ProofRequest
+	for _, tMod := range trieModifications {
+		req := oracle.ProofRequest{BlockNumber: blockNumber, Address: tMod.Address}
+		switch tMod.Type {
+		case StorageMod, NonExistingStorage, StorageRead:
+			req.Keys = []common.Hash{tMod.Key}
+			if tMod.Type == StorageMod && tMod.Value == (common.Hash{}) {
+				reqs = append(reqs, oracle.ProofRequest{BlockNumber: nextBlockNumber, Address: tMod.Address,
+					Keys: []common.Hash{tMod.Key}, PostProcess: trie.GenPossibleShortNodePreimage})
+			}
+		case DeleteAccount:
+			reqs = append(reqs, oracle.ProofRequest{BlockNumber: nextBlockNumber, Address: tMod.Address,
+				PostProcess: trie.GenPossibleShortNodePreimage})
+		}
+		reqs = append(reqs, req)
+	}
+	return statedb.Db.Oracle.Prefetch(reqs, 0)
+}
+
+// loadStorage reads the storage slots that are to be modified. GetState calls
+// GetCommittedState which prefetches the storage proof, so the trie nodes on the
+// path of each key (up to where the path ends for keys that are not set) are
+// available and the S proofs present the state of the block.
+func loadStorage(trieModifications []TrieModification, statedb *state.StateDB) error {
+	for _, tMod := range trieModifications {
+		if tMod.Type == StorageMod || tMod.Type == NonExistingStorage || tMod.Type == StorageRead {
+			statedb.GetState(tMod.Address, tMod.Key)
+		}
+	}
+	return statedb.Error()
+}
+
+func prepareProof(ind int, newProof [][]byte, addrh []byte, sRoot, cRoot common.Hash, tMod TrieModification) [][]byte {
 	firstLevelBoundary := branchRows
 	if newProof[0][len(newProof[0])-1] == 6 {
 		// 6 presents account leaf key S.
@@ -1355,6 +1587,9 @@ func prepareProof(ind int, newProof [][]byte, addrh []byte, sRoot, cRoot, startR
 	isCodeHashMod := byte(0)
 	isAccountDeleteMod := byte(0)
 	isNonExistingAccount := byte(0)
+	isNonExistingStorage := byte(0)
+	isAccountMod := byte(0)
+	mType, fields := tMod.flags()
 	if mType == StorageMod {
 		isStorageMod = 1
 	} else if mType == NonceMod {
@@ -1363,12 +1598,26 @@ func prepareProof(ind int, newProof [][]byte, addrh []byte, sRoot, cRoot, startR
 		isBalanceMod = 1
 	} else if mType == CodeHashMod {
 		isCodeHashMod = 1
-	} else if mType == CreateAccount {
-		isNonceMod = 1 // TODO: setting as nonce mod for now, this depends on the lookup
+	} else if mType == AccountMod {
+		isAccountMod = 1
+		if fields&FieldStorageRoot != 0 {
+			isStorageMod = 1
+		}
+		if fields&FieldNonce != 0 {
+			isNonceMod = 1
+		}
+		if fields&FieldBalance != 0 {
+			isBalanceMod = 1
+		}
+		if fields&FieldCodeHash != 0 {
+			isCodeHashMod = 1
+		}
 	} else if mType == DeleteAccount {
 		isAccountDeleteMod = 1
 	} else if mType == NonExistingAccount {
 		isNonExistingAccount = 1
+	} else if mType == NonExistingStorage {
+		isNonExistingStorage = 1
 	}
 
 	counter := make([]byte, counterLen)
@@ -1381,87 +1630,140 @@ func prepareProof(ind int, newProof [][]byte, addrh []byte, sRoot, cRoot, startR
 			notFirstLevel = 0
 		}
 		r := insertMetaInfo(newProof[j], sRoot.Bytes(), cRoot.Bytes(), addrh, counter, notFirstLevel, 
-			isStorageMod, isNonceMod, isBalanceMod, isCodeHashMod, isAccountDeleteMod, isNonExistingAccount)
+			isStorageMod, isNonceMod, isBalanceMod, isCodeHashMod, isAccountDeleteMod, isNonExistingAccount, isNonExistingStorage, isAccountMod)
 		proof = append(proof, r)
 	}
-	insertPublicRoot(newProof, startRoot.Bytes(), finalRoot.Bytes())
 
 	return proof
 }
 
-func prepareAccountProof(i int, tMod TrieModification, tModsLen int, statedb *state.StateDB) ([][]byte, [][]byte) {
+// checkAccountRead returns ReadMismatchError if tMod is an account read and the
+// value it reads is not the value in the state or the account doesn't exist (the
+// read can't be proved, NonExistingAccount proves that the account doesn't exist).
+func checkAccountRead(tMod TrieModification, statedb *state.StateDB) error {
+	addr := tMod.Address
+	var read, value string
+	switch tMod.Type {
+	case NonceRead:
+		read, value = fmt.Sprint(tMod.Nonce), fmt.Sprint(statedb.GetNonce(addr))
+	case BalanceRead:
+		read, value = bigOrZero(tMod.Balance).String(), statedb.GetBalance(addr).String()
+	case CodeHashRead:
+		read, value = crypto.Keccak256Hash(tMod.CodeHash).Hex(), statedb.GetCodeHash(addr).Hex()
+	default:
+		return nil
+	}
+	exists := statedb.Exist(addr)
+	if err := statedb.Error(); err != nil {
+		return err
+	}
+	if !exists {
+		return &ReadMismatchError{Type: tMod.Type, Address: addr, Read: read, State: "no such account (use NonExistingAccount)"}
+	}
+	if read != value {
+		return &ReadMismatchError{Type: tMod.Type, Address: addr, Read: read, State: value}
+	}
+	return nil
+}
+
+func prepareAccountProof(i int, tMod TrieModification, statedb *state.StateDB) ([][]byte, [][]byte, error) {
 	statedb.IntermediateRoot(false)
 
 	addr := tMod.Address
 	addrh := crypto.Keccak256(addr.Bytes())
 	accountAddr := trie.KeybytesToHex(addrh)
 
-	// This needs to called before oracle.PrefetchAccount, otherwise oracle.PrefetchAccount
+	// This needs to called before Oracle.PrefetchAccount, otherwise Oracle.PrefetchAccount
 	// will cache the proof and won't return it.
-	// Calling oracle.PrefetchAccount after statedb.SetStateObjectIfExists is needed only
+	// Calling Oracle.PrefetchAccount after statedb.SetStateObjectIfExists is needed only
 	// for cases when statedb.loadRemoteAccountsIntoStateObjects = false.
 	statedb.SetStateObjectIfExists(tMod.Address)
+	if err := statedb.Error(); err != nil {
+		return nil, nil, err
+	}
 
-	oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil)
+	if _, err := statedb.Db.Oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil); err != nil {
+		return nil, nil, err
+	}
 	accountProof, aNeighbourNode1, aExtNibbles1, err := statedb.GetProof(addr)
-	check(err)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var startRoot common.Hash
-	var finalRoot common.Hash
+	if err := checkAccountRead(tMod, statedb); err != nil {
+		return nil, nil, err
+	}
 
 	sRoot := statedb.GetTrie().Hash()
-	if i == 0 {
-		startRoot = sRoot
-	}
 
 	if tMod.Type == NonceMod {
 		statedb.SetNonce(addr, tMod.Nonce)
 	} else if tMod.Type == BalanceMod {
-		statedb.SetBalance(addr, tMod.Balance)
+		statedb.SetBalance(addr, bigOrZero(tMod.Balance))
 	} else if tMod.Type == CodeHashMod {
 		statedb.SetCode(addr, tMod.CodeHash)
 	} else if tMod.Type == CreateAccount {
 		statedb.CreateAccount(tMod.Address)
 	} else if tMod.Type == DeleteAccount {
 		statedb.DeleteAccount(tMod.Address)
+	} else if tMod.Type == AccountMod && tMod.Account != nil {
+		if tMod.Account.Nonce != nil {
+			statedb.SetNonce(addr, *tMod.Account.Nonce)
+		}
+		if tMod.Account.Balance != nil {
+			statedb.SetBalance(addr, tMod.Account.Balance)
+		}
+		if tMod.Account.CodeHash != nil {
+			statedb.SetCode(addr, tMod.Account.CodeHash)
+		}
+		if tMod.Account.StorageRoot != nil {
+			statedb.SetStorageRoot(addr, *tMod.Account.StorageRoot)
+		}
 	}
-	// No statedb change in case of NonExistingAccount
+	// No statedb change in case of NonExistingAccount and the read modifications
 
 	statedb.IntermediateRoot(false)
+	if err := statedb.Error(); err != nil {
+		return nil, nil, err
+	}
 
 	cRoot := statedb.GetTrie().Hash()
-	if i == tModsLen-1 {
-		finalRoot = cRoot
-	}
 
 	accountProof1, aNeighbourNode2, aExtNibbles2, err := statedb.GetProof(addr)
-	check(err)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	aNode := aNeighbourNode2
 	aExtNibbles := aExtNibbles2
 	if len(accountProof) > len(accountProof1) {
 		// delete operation
-		aNode = aNeighbourNode1
+		aNode, err = statedb.ResolveNeighbour(aNeighbourNode1)
+		if err != nil {
+			return nil, nil, err
+		}
 		aExtNibbles = aExtNibbles1
 	}
 	
-	rowsState, toBeHashedAcc, _ :=
+	rowsState, toBeHashedAcc, _, err :=
 		prepareWitness(accountProof, accountProof1, aExtNibbles, accountAddr, aNode, true)
-	proof := prepareProof(i, rowsState, addrh, sRoot, cRoot, startRoot, finalRoot, tMod.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof := prepareProof(i, rowsState, addrh, sRoot, cRoot, tMod)
 
-	return proof, toBeHashedAcc
+	return proof, toBeHashedAcc, nil
 }
 
-func getParallelProofs(trieModifications []TrieModification, statedb *state.StateDB) [][]byte {
+func getParallelProofs(trieModifications []TrieModification, statedb *state.StateDB) ([][]byte, error) {
 	statedb.IntermediateRoot(false)
 	allProofs := [][]byte{}
 	toBeHashed := [][]byte{}	
-	var startRoot common.Hash
-	var finalRoot common.Hash
+	startRoot := statedb.GetTrie().Hash()
 
 	for i := 0; i < len(trieModifications); i++ {
 		tMod := trieModifications[i]
-		if tMod.Type == StorageMod {
+		if tMod.Type == StorageMod || tMod.Type == NonExistingStorage || tMod.Type == StorageRead {
 			kh := crypto.Keccak256(tMod.Key.Bytes())
 			keyHashed := trie.KeybytesToHex(kh)
 
@@ -1469,38 +1771,61 @@ func getParallelProofs(trieModifications []TrieModification, statedb *state.Stat
 			addrh := crypto.Keccak256(addr.Bytes())
 			accountAddr := trie.KeybytesToHex(addrh)
 
-			oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil)
-			// oracle.PrefetchStorage(statedb.Db.BlockNumber, addr, tMod.Key, nil)
+			if _, err := statedb.Db.Oracle.PrefetchAccount(statedb.Db.BlockNumber, tMod.Address, nil); err != nil {
+				return nil, err
+			}
 
 			accountProof, aNeighbourNode1, aExtNibbles1, err := statedb.GetProof(addr)
-			check(err)
+			if err != nil {
+				return nil, err
+			}
 			storageProof, neighbourNode1, extNibbles1, err := statedb.GetStorageProof(addr, tMod.Key)
-			check(err)
+			if err != nil {
+				return nil, err
+			}
 
-			sRoot := statedb.GetTrie().Hash()
-			if i == 0 {
-				startRoot = sRoot
+			if tMod.Type == StorageRead {
+				value := statedb.GetState(addr, tMod.Key)
+				if err := statedb.Error(); err != nil {
+					return nil, err
+				}
+				if value != tMod.Value {
+					return nil, &ReadMismatchError{Type: StorageRead, Address: addr, Key: tMod.Key,
+						Read: tMod.Value.Hex(), State: value.Hex()}
+				}
 			}
 
-			statedb.SetState(addr, tMod.Key, tMod.Value)
+			sRoot := statedb.GetTrie().Hash()
+
+			if tMod.Type == StorageMod {
+				statedb.SetState(addr, tMod.Key, tMod.Value)
+			}
+			// No statedb change in case of NonExistingStorage and StorageRead
 			statedb.IntermediateRoot(false)
+			if err := statedb.Error(); err != nil {
+				return nil, err
+			}
 
 			cRoot := statedb.GetTrie().Hash()
-			if i == len(trieModifications)-1 {
-				finalRoot = cRoot
-			}
 
 			accountProof1, aNeighbourNode2, aExtNibbles2, err := statedb.GetProof(addr)
-			check(err)
+			if err != nil {
+				return nil, err
+			}
 
 			storageProof1, neighbourNode2, extNibbles2, err := statedb.GetStorageProof(addr, tMod.Key)
-			check(err)
+			if err != nil {
+				return nil, err
+			}
 
 			aNode := aNeighbourNode2
 			aExtNibbles := aExtNibbles2
 			if len(accountProof) > len(accountProof1) {
 				// delete operation
-				aNode = aNeighbourNode1
+				aNode, err = statedb.ResolveNeighbour(aNeighbourNode1)
+				if err != nil {
+					return nil, err
+				}
 				aExtNibbles = aExtNibbles1
 			}
 
@@ -1508,17 +1833,26 @@ func getParallelProofs(trieModifications []TrieModification, statedb *state.Stat
 			extNibbles := extNibbles2
 			if len(storageProof) > len(storageProof1) {
 				// delete operation
-				node = neighbourNode1
+				node, err = statedb.ResolveNeighbour(neighbourNode1)
+				if err != nil {
+					return nil, err
+				}
 				extNibbles = extNibbles1
 			}
 			
-			rowsState, toBeHashedAcc, _ :=
+			rowsState, toBeHashedAcc, _, err :=
 				prepareWitness(accountProof, accountProof1, aExtNibbles, accountAddr, aNode, true)
-			rowsStorage, toBeHashedStorage, _ :=
+			if err != nil {
+				return nil, err
+			}
+			rowsStorage, toBeHashedStorage, _, err :=
 				prepareWitness(storageProof, storageProof1, extNibbles, keyHashed, node, false)
+			if err != nil {
+				return nil, err
+			}
 			rowsState = append(rowsState, rowsStorage...)
 
-			proof := prepareProof(i, rowsState, addrh, sRoot, cRoot, startRoot, finalRoot, StorageMod)
+			proof := prepareProof(i, rowsState, addrh, sRoot, cRoot, tMod)
 			allProofs = append(allProofs, proof...)
 			
 			// Put rows that just need to be hashed at the end, because circuit assign function
@@ -1526,56 +1860,76 @@ func getParallelProofs(trieModifications []TrieModification, statedb *state.Stat
 			toBeHashed = append(toBeHashed, toBeHashedAcc...)
 			toBeHashed = append(toBeHashed, toBeHashedStorage...)
 		} else {
-			proof, toBeHashedAcc := prepareAccountProof(i, tMod, len(trieModifications), statedb)
+			proof, toBeHashedAcc, err := prepareAccountProof(i, tMod, statedb)
+			if err != nil {
+				return nil, err
+			}
 			allProofs = append(allProofs, proof...)
 			toBeHashed = append(toBeHashed, toBeHashedAcc...)
 		}
 	}
+	finalRoot := statedb.GetTrie().Hash()
+	insertPublicRoot(allProofs, startRoot.Bytes(), finalRoot.Bytes())
 	allProofs = append(allProofs, toBeHashed...)
 
-	return allProofs
+	return allProofs, nil
 }
 
-func GenerateProof(testName string, trieModifications []TrieModification, statedb *state.StateDB) {
-	proof := getParallelProofs(trieModifications, statedb)
-
-	w := MatrixToJson(proof)
-	fmt.Println(w)
+func GenerateProof(testName string, trieModifications []TrieModification, statedb *state.StateDB) error {
+	proof, err := getParallelProofs(trieModifications, statedb)
+	if err != nil {
+		return err
+	}
 
-	name := testName + ".json"
-	f, err := os.Create("../generated_witnesses/" + name)
-    check(err)
-	defer f.Close()
-	n3, err := f.WriteString(w)
-    check(err)
-    fmt.Printf("wrote %d bytes\n", n3)
+	return writeWitness(testName, proof)
 }
 
-func UpdateStateAndGenProof(testName string, keys, values []common.Hash, addresses []common.Address,
-		trieModifications []TrieModification) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+// UpdateStateAndGenProofFromSource sets the storage slots keys of addresses to values
+// in the state of block blockNum obtained from src (for example a local state, see
+// oracle.GenesisAlloc) and writes the witness of the modifications into
+// generated_witnesses/<testName>.json.
+func UpdateStateAndGenProofFromSource(src oracle.NodeSource, blockNum int, testName string, keys, values []common.Hash,
+		addresses []common.Address, trieModifications []TrieModification) error {
+	proof, err := updateStateAndGetProofs(src, blockNum, keys, values, addresses, trieModifications)
+	if err != nil {
+		return err
+	}
 
+	return writeWitness(testName, proof)
+}
+
+// updateStateAndGetProofs sets the storage slots keys of addresses to values in the
+// state of block blockNum and returns the witness of the modifications.
+func updateStateAndGetProofs(src oracle.NodeSource, blockNum int, keys, values []common.Hash, addresses []common.Address,
+		trieModifications []TrieModification) ([][]byte, error) {
+	statedb, err := newStateDB(oracle.NewOracle(src), blockNum)
+	if err != nil {
+		return nil, err
+	}
 	statedb.DisableLoadingRemoteAccounts()
 
 	// Set the state needed for the test:
 	for i := 0; i < len(keys); i++ {
 		statedb.SetState(addresses[i], keys[i], values[i])
 	}
-	
-	proof := getParallelProofs(trieModifications, statedb)
+	if err := statedb.Error(); err != nil {
+		return nil, err
+	}
+
+	return getParallelProofs(trieModifications, statedb)
+}
 
+// writeWitness stores the witness into generated_witnesses/<testName>.json.
+func writeWitness(testName string, proof [][]byte) error {
 	w := MatrixToJson(proof)
-	fmt.Println(w)
 
 	name := testName + ".json"
 	f, err := os.Create("../generated_witnesses/" + name)
-    check(err)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
-	n3, err := f.WriteString(w)
-    check(err)
-    fmt.Printf("wrote %d bytes\n", n3)
-}
\ No newline at end of file
+	_, err = f.WriteString(w)
+
+	return err
+}
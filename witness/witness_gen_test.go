@@ -10,6 +10,62 @@ import (
 	"github.com/miha-stopar/mpt/state"
 )
 
+// testBlockNum is the block of the local test state.
+const testBlockNum = 1
+
+// testSource returns the local test state: the accounts of testdata/genesis.json
+// at block testBlockNum. Besides some filler accounts, it contains the account
+// 0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B, a contract at 0xc0de and accounts
+// that make 0x21 a placeholder branch and 0x40 a placeholder extension when added.
+func testSource(t *testing.T) oracle.NodeSource {
+	alloc, err := oracle.ReadGenesisAlloc("testdata/genesis.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := alloc.Source(testBlockNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+// prepareStateDB returns the local test state.
+func prepareStateDB(t *testing.T) *state.StateDB {
+	statedb, err := newStateDB(oracle.NewOracle(testSource(t)), testBlockNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return statedb
+}
+
+// updateStateAndGenProof is UpdateStateAndGenProofFromSource on the local test state, the
+// witness is compared with the golden file (see checkWitness).
+func updateStateAndGenProof(t *testing.T, testName string, keys, values []common.Hash, addresses []common.Address,
+		trieModifications []TrieModification) error {
+	t.Helper()
+	proof, err := updateStateAndGetProofs(testSource(t), testBlockNum, keys, values, addresses, trieModifications)
+	if err != nil {
+		return err
+	}
+	checkWitness(t, testName, proof)
+
+	return nil
+}
+
+// generateProof is GenerateProof, but the witness is compared with the golden
+// file (see checkWitness).
+func generateProof(t *testing.T, testName string, trieModifications []TrieModification, statedb *state.StateDB) error {
+	t.Helper()
+	proof, err := getParallelProofs(trieModifications, statedb)
+	if err != nil {
+		return err
+	}
+	checkWitness(t, testName, proof)
+
+	return nil
+}
+
 func TestUpdateOneLevel(t *testing.T) {
 	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
 	// hexed keys:
@@ -35,7 +91,9 @@ func TestUpdateOneLevel(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateOneLevel", ks[:], values, []common.Address{addr, addr}, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateOneLevel", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateOneLevel1(t *testing.T) {
@@ -57,7 +115,9 @@ func TestUpdateOneLevel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateOneLevel1", ks[:], values, []common.Address{addr, addr}, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateOneLevel1", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateOneLevelBigVal(t *testing.T) {
@@ -87,7 +147,9 @@ func TestUpdateOneLevelBigVal(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateOneLevelBigVal", ks[:], values, []common.Address{addr, addr}, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateOneLevelBigVal", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateTwoLevels(t *testing.T) {
@@ -119,7 +181,9 @@ func TestUpdateTwoLevels(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateTwoLevels", ks[:], values, []common.Address{addr, addr, addr}, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateTwoLevels", ks[:], values, []common.Address{addr, addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateTwoLevelsBigVal(t *testing.T) {
@@ -152,7 +216,9 @@ func TestUpdateTwoLevelsBigVal(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 	
-	UpdateStateAndGenProof("UpdateTwoLevelsBigVal", ks[:], values, []common.Address{addr, addr, addr}, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateTwoLevelsBigVal", ks[:], values, []common.Address{addr, addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateThreeLevels(t *testing.T) {
@@ -207,7 +273,9 @@ func TestUpdateThreeLevels(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateThreeLevels", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateThreeLevels", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestFromNilToValue(t *testing.T) {
@@ -247,7 +315,9 @@ func TestFromNilToValue(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("FromNilToValue", ks[:], values, addresses, trieModifications) 
+	if err := updateStateAndGenProof(t, "FromNilToValue", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDelete(t *testing.T) {
@@ -279,7 +349,9 @@ func TestDelete(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("Delete", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "Delete", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestUpdateOneLevelEvenAddress(t *testing.T) {
@@ -307,7 +379,9 @@ func TestUpdateOneLevelEvenAddress(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("UpdateOneLevelEvenAddress", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "UpdateOneLevelEvenAddress", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAddBranch(t *testing.T) {
@@ -341,7 +415,9 @@ func TestAddBranch(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("AddBranch", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "AddBranch", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAddBranchLong(t *testing.T) {
@@ -378,7 +454,9 @@ func TestAddBranchLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("AddBranchLong", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "AddBranchLong", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteBranch(t *testing.T) {
@@ -416,7 +494,9 @@ func TestDeleteBranch(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("DeleteBranch", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "DeleteBranch", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteBranchLong(t *testing.T) {
@@ -457,7 +537,9 @@ func TestDeleteBranchLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("DeleteBranchLong", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "DeleteBranchLong", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAddBranchTwoLevels(t *testing.T) {
@@ -506,7 +588,9 @@ func TestAddBranchTwoLevels(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("AddBranchTwoLevels", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "AddBranchTwoLevels", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAddBranchTwoLevelsLong(t *testing.T) {
@@ -550,7 +634,9 @@ func TestAddBranchTwoLevelsLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("AddBranchTwoLevelsLong", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "AddBranchTwoLevelsLong", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteBranchTwoLevels(t *testing.T) {
@@ -589,7 +675,9 @@ func TestDeleteBranchTwoLevels(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("DeleteBranchTwoLevels", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "DeleteBranchTwoLevels", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteBranchTwoLevelsLong(t *testing.T) {
@@ -630,7 +718,9 @@ func TestDeleteBranchTwoLevelsLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("DeleteBranchTwoLevelsLong", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "DeleteBranchTwoLevelsLong", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionOneKeyByteSel1(t *testing.T) {
@@ -686,7 +776,9 @@ func TestExtensionOneKeyByteSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionOneKeyByteSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionOneKeyByteSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedOneKeyByteSel1(t *testing.T) {
@@ -725,7 +817,9 @@ func TestExtensionAddedOneKeyByteSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionAddedOneKeyByteSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionAddedOneKeyByteSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionDeletedOneKeyByteSel1(t *testing.T) {
@@ -765,7 +859,9 @@ func TestExtensionDeletedOneKeyByteSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionDeletedOneKeyByteSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionDeletedOneKeyByteSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionOneKeyByteSel2(t *testing.T) {
@@ -798,7 +894,9 @@ func TestExtensionOneKeyByteSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionOneKeyByteSel2", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionOneKeyByteSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedOneKeyByteSel2(t *testing.T) {
@@ -835,7 +933,9 @@ func TestExtensionAddedOneKeyByteSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionAddedOneKeyByteSel2", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionAddedOneKeyByteSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionDeletedOneKeyByteSel2(t *testing.T) {
@@ -869,7 +969,9 @@ func TestExtensionDeletedOneKeyByteSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionDeletedOneKeyByteSel2", ks[:], values, addresses, trieModifications) 
+	if err := updateStateAndGenProof(t, "ExtensionDeletedOneKeyByteSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionTwoKeyBytesSel1(t *testing.T) {
@@ -909,7 +1011,9 @@ func TestExtensionTwoKeyBytesSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionTwoKeyBytesSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionTwoKeyBytesSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedTwoKeyBytesSel1(t *testing.T) {
@@ -947,7 +1051,9 @@ func TestExtensionAddedTwoKeyBytesSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionAddedTwoKeyBytesSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionAddedTwoKeyBytesSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionDeletedTwoKeyBytesSel1(t *testing.T) {
@@ -982,7 +1088,9 @@ func TestExtensionDeletedTwoKeyBytesSel1(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionDeletedTwoKeyBytesSel1", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionDeletedTwoKeyBytesSel1", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionTwoKeyBytesSel2(t *testing.T) {
@@ -1015,7 +1123,9 @@ func TestExtensionTwoKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionTwoKeyBytesSel2", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionTwoKeyBytesSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedTwoKeyBytesSel2(t *testing.T) {
@@ -1052,7 +1162,9 @@ func TestExtensionAddedTwoKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionAddedTwoKeyBytesSel2", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionAddedTwoKeyBytesSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionDeletedTwoKeyBytesSel2(t *testing.T) {
@@ -1086,7 +1198,9 @@ func TestExtensionDeletedTwoKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionDeletedTwoKeyBytesSel2", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionDeletedTwoKeyBytesSel2", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionInFirstStorageLevel(t *testing.T) {
@@ -1117,15 +1231,13 @@ func TestExtensionInFirstStorageLevel(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	UpdateStateAndGenProof("ExtensionInFirstStorageLevel", ks[:], values, addresses, trieModifications)
+	if err := updateStateAndGenProof(t, "ExtensionInFirstStorageLevel", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionInFirstStorageLevelOneKeyByte(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50efbf12580138bc623c95757286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1150,15 +1262,13 @@ func TestExtensionInFirstStorageLevelOneKeyByte(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionInFirstStorageLevelOneKeyByte", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionInFirstStorageLevelOneKeyByte", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedInFirstStorageLevelOneKeyByte(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50efbf12580138bc623c95757286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1180,15 +1290,13 @@ func TestExtensionAddedInFirstStorageLevelOneKeyByte(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionAddedInFirstStorageLevelOneKeyByte", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionAddedInFirstStorageLevelOneKeyByte", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionInFirstStorageLevelTwoKeyBytes(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50efbf12580138bc623c95757286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1211,15 +1319,13 @@ func TestExtensionInFirstStorageLevelTwoKeyBytes(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionInFirstStorageLevelTwoKeyBytes", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionInFirstStorageLevelTwoKeyBytes", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedInFirstStorageLevelTwoKeyBytes(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50efbf12580138bc623c95757286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1242,15 +1348,13 @@ func TestExtensionAddedInFirstStorageLevelTwoKeyBytes(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionAddedInFirstStorageLevelTwoKeyBytes", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionAddedInFirstStorageLevelTwoKeyBytes", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionThreeKeyBytesSel2(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50feb1f2580138bc623c97557286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1275,15 +1379,13 @@ func TestExtensionThreeKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionThreeKeyBytesSel2", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionThreeKeyBytesSel2", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionAddedThreeKeyBytesSel2(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50feb1f2580138bc623c97557286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1306,15 +1408,13 @@ func TestExtensionAddedThreeKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionAddedThreeKeyBytesSel2", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionAddedThreeKeyBytesSel2", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionDeletedThreeKeyBytesSel2(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50feb1f2580138bc623c97557286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1339,15 +1439,13 @@ func TestExtensionDeletedThreeKeyBytesSel2(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionDeletedThreeKeyBytesSel2", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionDeletedThreeKeyBytesSel2", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestExtensionThreeKeyBytes(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x50fbe1f25aa0843b623c97557286df4e24eb81c9")
 
 	statedb.DisableLoadingRemoteAccounts()
@@ -1382,15 +1480,13 @@ func TestExtensionThreeKeyBytes(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ExtensionThreeKeyBytes", trieModifications, statedb)
+	if err := generateProof(t, "ExtensionThreeKeyBytes", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestOnlyLeafInStorageProof(t *testing.T) {
-	blockNum := 14209217
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 
 	statedb.DisableLoadingRemoteAccounts()
 	
@@ -1401,8 +1497,9 @@ func TestOnlyLeafInStorageProof(t *testing.T) {
 
 	accountProof, _, _, err := statedb.GetProof(addr)
 	fmt.Println(len(accountProof))
-	check(err)	
-
+	if err != nil {
+		t.Fatal(err)
+	}
 	h = fmt.Sprintf("0x2111d%d", 0)
 	key2 := common.HexToHash(h)
 	val1 := common.BigToHash(big.NewInt(int64(1)))
@@ -1421,15 +1518,13 @@ func TestOnlyLeafInStorageProof(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("OnlyLeafInStorageProof", trieModifications, statedb)
+	if err := generateProof(t, "OnlyLeafInStorageProof", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestLeafAddedToEmptyTrie(t *testing.T) {
-	blockNum := 14209217
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 
 	statedb.DisableLoadingRemoteAccounts()
 	
@@ -1440,8 +1535,9 @@ func TestLeafAddedToEmptyTrie(t *testing.T) {
 
 	accountProof, _, _, err := statedb.GetProof(addr)
 	fmt.Println(len(accountProof))
-	check(err)
-
+	if err != nil {
+		t.Fatal(err)
+	}
 	// emptyTrieHash := statedb.StorageTrie(addr).Hash()
 	// fmt.Println(emptyTrieHash.Bytes())
 	
@@ -1463,15 +1559,13 @@ func TestLeafAddedToEmptyTrie(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("LeafAddedToEmptyTrie", trieModifications, statedb)
+	if err := generateProof(t, "LeafAddedToEmptyTrie", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteToEmptyTrie(t *testing.T) {
-	blockNum := 14209217
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 
 	statedb.DisableLoadingRemoteAccounts()
 	
@@ -1482,8 +1576,9 @@ func TestDeleteToEmptyTrie(t *testing.T) {
 
 	accountProof, _, _, err := statedb.GetProof(addr)
 	fmt.Println(len(accountProof))
-	check(err)
-
+	if err != nil {
+		t.Fatal(err)
+	}
 	h = fmt.Sprintf("0x2111d%d", 0)
 	key2 := common.HexToHash(h)
 	val1 := common.BigToHash(big.NewInt(int64(1)))
@@ -1502,105 +1597,10 @@ func TestDeleteToEmptyTrie(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("DeleteToEmptyTrie", trieModifications, statedb)
-}
-
-/*
-func TestFoo(t *testing.T) {
-	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
-	var values []common.Hash
-	for i := 0; i < len(ks); i++ {
-		values = append(values, common.BigToHash(big.NewInt(int64(i + 1)))) // don't put 0 value because otherwise nothing will be set (if 0 is prev value), see state_object.go line 279
-	}
-	addr := common.HexToAddress("0x4E5B2e1dc63F6b91cb6Cd759936495434C7e972F")
-	var addresses []common.Address
-	for i := 0; i < len(ks); i++ {
-		addresses = append(addresses, addr)
-	}
-
-	nodeUrl := "https://mainnet.infura.io/v3/9aa3d95b3bc440fa88ea12eaa4456161"
-	blockNum := 14359865
-
-	GetProof(nodeUrl, blockNum, ks[:], values, addresses)
-}
-*/
-
-/*
-func TestFindAccount(t *testing.T) {
-	blockNum := 0
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
-	
-	for i := 14000; i < 17000; i++ {
-		h := fmt.Sprintf("0x%d", i)
-		addr := common.HexToAddress(h)
-		// statedb.IntermediateRoot(false)
-		// statedb.CreateAccount(addr)
-
-		if statedb.GetCode(addr) == nil {
-			continue
-		}
-		accountProof, _, _, err := statedb.GetProof(addr)
-		fmt.Println(len(accountProof))
-		check(err)
-		fmt.Println(len(accountProof))
-		if len(accountProof) < 2 {
-			fmt.Println(len(accountProof))
-			fmt.Println("asdfsadf")
-		}
-
-		for i := 0; i < 1000; i++ {
-			h := fmt.Sprintf("0x2111d%d", i)
-			key2 := common.HexToHash(h)
-			val1 := common.BigToHash(big.NewInt(int64(1)))
-			statedb.SetState(addr, key2, val1)
-			statedb.IntermediateRoot(false)
-
-			storageProof, _, _, err := statedb.GetStorageProof(addr, key2)
-			check(err)
-			fmt.Println(len(storageProof))
-
-			v := common.Hash{} // empty value deletes the key
-			statedb.SetState(addr, key2, v)
-			statedb.IntermediateRoot(false)
-		}
-	}
-}
-*/
-
-/*
-func TestExtensionThreeBytesSel2(t *testing.T) {
-	// still searching for the right values
-	a := 0
-	h := fmt.Sprintf("0xf8a%d", a)
-	ks := []common.Hash{common.HexToHash(h)}
-	for i := 0; i < 1000; i++ {
-		a += 1
-		h := fmt.Sprintf("0xf8a%d", a)
-		ks = append(ks, common.HexToHash(h))
-	}
-	
-	var values []common.Hash
-	for i := 0; i < len(ks); i++ {
-		values = append(values, common.BigToHash(big.NewInt(int64(i + 1)))) // don't put 0 value because otherwise nothing will be set (if 0 is prev value), see state_object.go line 279
-	}
-
-	toBeModified := common.HexToHash("0xfa935")
-	addr := common.HexToAddress("0x75fbef2150818c32b36c57957226df4e24eb81c9")
-	val := common.BigToHash(big.NewInt(int64(17)))
-	trieMod := TrieModification{
-    	Type: StorageMod,
-		Key: toBeModified,
-		Value: val,
-		Address: addr,
+	if err := generateProof(t, "DeleteToEmptyTrie", trieModifications, statedb); err != nil {
+		t.Fatal(err)
 	}
-	trieModifications := []TrieModification{trieMod}
-
-	UpdateStateAndGenProof("ExtensionThreeBytesSel2", ks[:], values, addresses, trieModifications)
 }
-*/
 
 func TestUpdateTwoModifications(t *testing.T) {
 	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
@@ -1632,40 +1632,13 @@ func TestUpdateTwoModifications(t *testing.T) {
 
 	trieModifications := []TrieModification{trieMod1, trieMod2}
 
-	UpdateStateAndGenProof("UpdateTwoModifications", ks[:], values, addresses, trieModifications)
-}
-
-/*
-func TestFindAccountWithPlaceholderBranch(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
-	
-	for i := 0; i < 100; i++ {
-		h := fmt.Sprintf("0x%d", i)
-		addr := common.HexToAddress(h)
-		oracle.PrefetchAccount(statedb.Db.BlockNumber, addr, nil)
-
-		accountProof, _, _, _ := statedb.GetProof(addr)
-		statedb.CreateAccount(addr)
-		statedb.IntermediateRoot(false)
-		accountProof1, _, _, _ := statedb.GetProof(addr)
-
-		if len(accountProof1) == len(accountProof) + 1 {
-			fmt.Println("a;lskdfja;slkdfj")
-		}
+	if err := updateStateAndGenProof(t, "UpdateTwoModifications", ks[:], values, addresses, trieModifications); err != nil {
+		t.Fatal(err)
 	}
 }
-*/
 
 func TestNonceModCShort(t *testing.T) {
-	blockNum := 14766377
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
 
 	trieMod := TrieModification{
@@ -1675,15 +1648,13 @@ func TestNonceModCShort(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("NonceModCShort", trieModifications, statedb)
+	if err := generateProof(t, "NonceModCShort", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestNonceModCLong(t *testing.T) {
-	blockNum := 14766377
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
 
 	trieMod := TrieModification{
@@ -1693,15 +1664,13 @@ func TestNonceModCLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("NonceModCLong", trieModifications, statedb)
+	if err := generateProof(t, "NonceModCLong", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestBalanceModCShort(t *testing.T) {
-	blockNum := 14766377
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
 
 	trieMod := TrieModification{
@@ -1711,15 +1680,13 @@ func TestBalanceModCShort(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("BalanceModCShort", trieModifications, statedb)
+	if err := generateProof(t, "BalanceModCShort", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestBalanceModCLong(t *testing.T) {
-	blockNum := 14766377
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
 
 	trieMod := TrieModification{
@@ -1729,15 +1696,33 @@ func TestBalanceModCLong(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("BalanceModCLong", trieModifications, statedb)
+	if err := generateProof(t, "BalanceModCLong", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonceAndBalanceMod(t *testing.T) {
+	statedb := prepareStateDB(t)
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+
+	nonce := uint64(33)
+	trieMod := TrieModification{
+		Type: AccountMod,
+		Account: &AccountUpdate{
+			Nonce: &nonce,
+			Balance: big.NewInt(23),
+		},
+		Address: addr,
+	}
+	trieModifications := []TrieModification{trieMod}
+
+	if err := generateProof(t, "NonceAndBalanceMod", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAddAccount(t *testing.T) {
-	blockNum := 1
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
 	statedb.IntermediateRoot(false)
@@ -1748,15 +1733,13 @@ func TestAddAccount(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("AddAccount", trieModifications, statedb)
+	if err := generateProof(t, "AddAccount", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteAccount(t *testing.T) {
-	blockNum := 1
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
 	statedb.CreateAccount(addr)
@@ -1768,15 +1751,13 @@ func TestDeleteAccount(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("DeleteAccount", trieModifications, statedb)
+	if err := generateProof(t, "DeleteAccount", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestImplicitlyCreateAccountWithNonce(t *testing.T) {
-	blockNum := 1
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	addr := common.HexToAddress("0xaabccf12580138bc2bbceeeaa111df4e42ab81ab")
 
@@ -1787,15 +1768,13 @@ func TestImplicitlyCreateAccountWithNonce(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ImplicitlyCreateAccountWithNonce", trieModifications, statedb)
+	if err := generateProof(t, "ImplicitlyCreateAccountWithNonce", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestImplicitlyCreateAccountWithBalance(t *testing.T) {
-	blockNum := 1
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	addr := common.HexToAddress("0xaabccf12580138bc2bbceeeaa111df4e42ab81ab")
 
@@ -1806,15 +1785,13 @@ func TestImplicitlyCreateAccountWithBalance(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("ImplicitlyCreateAccountWithBalance", trieModifications, statedb)
+	if err := generateProof(t, "ImplicitlyCreateAccountWithBalance", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAccountAddPlaceholderBranch(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	// We need an account that doesn't exist yet.
 	i := 21
@@ -1828,15 +1805,13 @@ func TestAccountAddPlaceholderBranch(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("AccountAddPlaceholderBranch", trieModifications, statedb)
+	if err := generateProof(t, "AccountAddPlaceholderBranch", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAccountDeletePlaceholderBranch(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	i := 21
 	h := fmt.Sprintf("0x%d", i)
@@ -1850,15 +1825,13 @@ func TestAccountDeletePlaceholderBranch(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("AccountDeletePlaceholderBranch", trieModifications, statedb)
+	if err := generateProof(t, "AccountDeletePlaceholderBranch", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAccountAddPlaceholderExtension(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	// We need an account that doesn't exist yet.
 	i := 40
@@ -1872,15 +1845,13 @@ func TestAccountAddPlaceholderExtension(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("AccountAddPlaceholderExtension", trieModifications, statedb)
+	if err := generateProof(t, "AccountAddPlaceholderExtension", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAccountDeletePlaceholderExtension(t *testing.T) {
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	i := 40
 	h := fmt.Sprintf("0x%d", i)
@@ -1894,16 +1865,14 @@ func TestAccountDeletePlaceholderExtension(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("AccountDeletePlaceholderExtension", trieModifications, statedb)
+	if err := generateProof(t, "AccountDeletePlaceholderExtension", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestNonExistingAccountNilObject(t *testing.T) {
 	// At the account address, there is a nil object.
-	blockNum := 1
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 	
 	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ab")
 	statedb.IntermediateRoot(false)
@@ -1914,17 +1883,15 @@ func TestNonExistingAccountNilObject(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("NonExistingAccountNilObject", trieModifications, statedb)
+	if err := generateProof(t, "NonExistingAccountNilObject", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestNonExistingAccount(t *testing.T) {
 	// The leaf is returned that doesn't have the required address - but the two addresses overlaps in all nibbles up to
 	// to the position in branch.
-	blockNum := 13284469
-	blockNumberParent := big.NewInt(int64(blockNum))
-	blockHeaderParent := oracle.PrefetchBlock(blockNumberParent, true, nil)
-	database := state.NewDatabase(blockHeaderParent)
-	statedb, _ := state.New(blockHeaderParent.Root, database, nil)
+	statedb := prepareStateDB(t)
 
 	i := 21
 	h := fmt.Sprintf("0x%d", i)
@@ -1936,5 +1903,95 @@ func TestNonExistingAccount(t *testing.T) {
 	}
 	trieModifications := []TrieModification{trieMod}
 
-	GenerateProof("NonExistingAccount", trieModifications, statedb)
+	if err := generateProof(t, "NonExistingAccount", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonExistingStorageLeaf(t *testing.T) {
+	// The leaf is returned that doesn't have the required key - but the two keys overlap
+	// in the nibble at the position in branch.
+	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+	// hexed keys:
+	// [11,11,8,10,...
+	// [3,10,6,3,...
+	// The hexed key 0x11 starts with 3 too.
+
+	var values []common.Hash
+	for i := 0; i < len(ks); i++ {
+		values = append(values, common.BigToHash(big.NewInt(int64(i + 1))))
+	}
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+
+	trieMod := TrieModification{
+		Type: NonExistingStorage,
+		Key: common.HexToHash("0x11"),
+		Address: addr,
+	}
+	trieModifications := []TrieModification{trieMod}
+
+	if err := updateStateAndGenProof(t, "NonExistingStorageLeaf", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonExistingStorageBranch(t *testing.T) {
+	// There is no node at the position of the key in the branch.
+	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+	// The hexed key 0x5 starts with 0, the branch has children at position 3 and 11 only.
+
+	var values []common.Hash
+	for i := 0; i < len(ks); i++ {
+		values = append(values, common.BigToHash(big.NewInt(int64(i + 1))))
+	}
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+
+	trieMod := TrieModification{
+		Type: NonExistingStorage,
+		Key: common.HexToHash("0x5"),
+		Address: addr,
+	}
+	trieModifications := []TrieModification{trieMod}
+
+	if err := updateStateAndGenProof(t, "NonExistingStorageBranch", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageRead(t *testing.T) {
+	ks := [...]common.Hash{common.HexToHash("0x12"), common.HexToHash("0x21")}
+
+	var values []common.Hash
+	for i := 0; i < len(ks); i++ {
+		values = append(values, common.BigToHash(big.NewInt(int64(i + 1))))
+	}
+	addr := common.HexToAddress("0xaaaccf12580138bc2bbceeeaa111df4e42ab81ff")
+
+	trieMod := TrieModification{
+		Type: StorageRead,
+		Key: ks[0],
+		Value: values[0],
+		Address: addr,
+	}
+	trieModifications := []TrieModification{trieMod}
+
+	if err := updateStateAndGenProof(t, "StorageRead", ks[:], values, []common.Address{addr, addr}, trieModifications); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonceRead(t *testing.T) {
+	statedb := prepareStateDB(t)
+	addr := common.HexToAddress("0x68D5a6E78BD8734B7d190cbD98549B72bFa0800B")
+
+	trieMod := TrieModification{
+		Type: NonceRead,
+		Nonce: statedb.GetNonce(addr),
+		Address: addr,
+	}
+	trieModifications := []TrieModification{trieMod}
+
+	if err := generateProof(t, "NonceRead", trieModifications, statedb); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,171 @@
+package witness
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testMatrix returns a small matrix with the same row shapes as GetParallelProofs
+// returns: a branch (init + children), extension rows, a leaf row and a row to be hashed.
+func testMatrix() [][]byte {
+	rows := make([][]byte, 17)
+	for i := range rows {
+		rows[i] = make([]byte, rowLen)
+		rows[i][rowLen-1] = byte(RowBranchChild)
+		rows[i][2] = byte(i)
+		rows[i][branch2start+2] = byte(2 * i)
+	}
+	rows[0][rowLen-1] = byte(RowBranchInit)
+	rows[0][keyPos] = 3
+	rows[0][isBranchC16Pos] = 1
+	rows = append(rows, prepareEmptyExtensionRows()...)
+	leafRows, leafForHashing := prepareStorageLeafRows([]byte{226, 160, 32, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 1}, 2, false)
+	rows = append(rows, leafRows...)
+
+	addrh := crypto.Keccak256(common.HexToAddress("0x1").Bytes())
+	matrix := prepareProof(1, rows, addrh, common.HexToHash("0x11"), common.HexToHash("0x22"), TrieModification{Type: StorageMod})
+
+	return append(matrix, leafForHashing)
+}
+
+func TestWitnessMatrixRoundTrip(t *testing.T) {
+	matrix := testMatrix()
+	w, err := WitnessFromMatrix(matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Rows[0].Kind != RowBranchInit || w.Rows[0].Branch().ModifiedIndex != 3 || !w.Rows[0].Branch().IsC16 {
+		t.Errorf("branch init not decoded: %+v", w.Rows[0].Branch())
+	}
+	if w.Rows[1].Counter != 1 || w.Rows[1].Modification != StorageMod || w.Rows[1].CRoot != common.HexToHash("0x22") {
+		t.Errorf("meta info not decoded: %+v", w.Rows[1])
+	}
+	if last := w.Rows[len(w.Rows)-1]; last.Kind != RowHash {
+		t.Errorf("expected hash row, got %s", last.Kind)
+	}
+
+	back := w.Matrix()
+	if len(back) != len(matrix) {
+		t.Fatalf("got %d rows, want %d", len(back), len(matrix))
+	}
+	for i := range matrix {
+		if !bytes.Equal(back[i], matrix[i]) {
+			t.Fatalf("row %d differs:\n%v\n%v", i, back[i], matrix[i])
+		}
+	}
+}
+
+func TestWitnessAccountModRoundTrip(t *testing.T) {
+	rows := testMatrix()
+	nonce := uint64(1)
+	tMod := TrieModification{Type: AccountMod, Account: &AccountUpdate{Nonce: &nonce, Balance: common.Big1}}
+	addrh := crypto.Keccak256(common.HexToAddress("0x1").Bytes())
+	matrix := prepareProof(0, [][]byte{rows[0][:rowLen]}, addrh, common.HexToHash("0x11"), common.HexToHash("0x22"), tMod)
+
+	w, err := WitnessFromMatrix(matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Rows[0].Modification != AccountMod || w.Rows[0].Fields != FieldNonce|FieldBalance {
+		t.Errorf("account modification not decoded: %s %s", w.Rows[0].Modification, w.Rows[0].Fields)
+	}
+	enc, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(enc), `"fields":["nonce","balance"]`) {
+		t.Errorf("fields not encoded: %s", enc)
+	}
+	var dec Witness
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		t.Fatal(err)
+	}
+	if MatrixToJson(dec.Matrix()) != MatrixToJson(matrix) {
+		t.Fatal("witness changed after round trip")
+	}
+}
+
+func TestWitnessJSONRoundTrip(t *testing.T) {
+	w, err := WitnessFromMatrix(testMatrix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec Witness
+	if err := json.Unmarshal(enc, &dec); err != nil {
+		t.Fatal(err)
+	}
+	if MatrixToJson(dec.Matrix()) != MatrixToJson(w.Matrix()) {
+		t.Fatal("witness changed after JSON round trip")
+	}
+
+	err = json.Unmarshal([]byte(strings.Replace(string(enc), `"version":1`, `"version":2`, 1)), &dec)
+	if verr, ok := err.(*WitnessVersionError); !ok || verr.Version != 2 {
+		t.Errorf("expected version error for version 2, got %v", err)
+	}
+	tampered := strings.Replace(string(enc), `"modified_index":3`, `"modified_index":4`, 1)
+	if err := json.Unmarshal([]byte(tampered), &dec); err == nil {
+		t.Error("expected error for branch flags not matching s")
+	}
+}
+
+func TestParseLegacyWitness(t *testing.T) {
+	// Drop the meta bytes that the legacy layout doesn't have.
+	matrix := testMatrix()
+	for i, row := range matrix[:len(matrix)-1] {
+		matrix[i] = append(row[:len(row)-metaLen], row[len(row)-legacyMetaLen:]...)
+	}
+	_, err := ParseWitness([]byte(MatrixToJson(matrix)))
+	verr, ok := err.(*WitnessVersionError)
+	if !ok || verr.Version != 0 || verr.MetaLen != legacyMetaLen {
+		t.Errorf("expected version 0 error, got %v", err)
+	}
+	if ErrorKind(err) != ErrKindInvalidWitness {
+		t.Errorf("error kind %s", ErrorKind(err))
+	}
+
+	// Only the last proof row in the legacy layout.
+	mixed := testMatrix()
+	mixed[len(mixed)-2] = matrix[len(matrix)-2]
+	_, err = ParseWitness([]byte(MatrixToJson(mixed)))
+	if err == nil {
+		t.Error("expected error for mixed layouts")
+	} else if _, ok := err.(*WitnessVersionError); ok {
+		t.Errorf("expected mixed layouts error, got %v", err)
+	}
+}
+
+func TestParseGeneratedWitnesses(t *testing.T) {
+	files, err := filepath.Glob("../generated_witnesses/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := ParseWitness(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if MatrixToJson(w.Matrix()) != strings.TrimSpace(string(data)) {
+			t.Errorf("%s: matrix changed after conversion", name)
+		}
+		if err := w.Print(ioutil.Discard); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
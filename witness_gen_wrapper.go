@@ -4,17 +4,42 @@ import "C"
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/miha-stopar/mpt/oracle"
 	"github.com/miha-stopar/mpt/witness"
 )
 
 type Config struct {
 	NodeUrl string `json:"NodeUrl"`
+	FixtureDir string `json:"FixtureDir"` // if set, the state is read from the fixtures instead of NodeUrl
 	BlockNum int `json:"BlockNum"`
 	Addr string `json:"Addr"`
 	Keys []string `json:"Keys"`
 	Values []string `json:"Values"`
+	Format string `json:"Format"` // "witness" for the versioned witness JSON, the matrix is returned otherwise
+	FullBlock bool `json:"FullBlock"` // if set, the witness covers all state changes of the block (Addr, Keys, Values are ignored)
+	StateDiffFile string `json:"StateDiffFile"` // if set (with FullBlock), the state diffs of the block are read from this prestateTracer dump instead of the node
+	Timeout int `json:"Timeout"` // deadline of each node request in seconds (oracle.DefaultRPCConfig is used if 0)
+	RequestsPerSecond float64 `json:"RequestsPerSecond"` // limits the rate of the node requests (0 means no limit)
+	CacheDir string `json:"CacheDir"` // directory of the node response cache (the responses are not cached if empty)
+	Bundle string `json:"Bundle"` // if set, the state is read from this preimage bundle (see oracle.Bundle) instead of NodeUrl
+	BundleOut string `json:"BundleOut"` // if set, everything obtained from the node is written into this bundle file (not with FullBlock)
+}
+
+// errorJson returns the error as {"error":{"kind":...,"message":...}}, the kinds
+// are the ones of witness.ErrorKind plus "invalid_config".
+func errorJson(kind string, err error) *C.char {
+	type errorObject struct {
+		Kind    string `json:"kind"`
+		Message string `json:"message"`
+	}
+	b, _ := json.Marshal(struct {
+		Error errorObject `json:"error"`
+	}{errorObject{kind, err.Error()}})
+
+	return C.CString(string(b))
 }
 
 //export GetParallelProofs
@@ -22,23 +47,81 @@ func GetParallelProofs(proofConf *C.char) *C.char {
 	var config Config
 
 	err := json.Unmarshal([]byte(C.GoString(proofConf)), &config)
-	fmt.Println(err)
-	fmt.Println(config)
-
-	trieModifications := []witness.TrieModification{}
-
-	addr := common.HexToAddress(config.Addr)
-	for i := 0; i < len(config.Keys); i++ {
-		trieMod := witness.TrieModification{
-			Type: witness.StorageMod,
-			Key: common.HexToHash(config.Keys[i]),
-			Value: common.HexToHash(config.Values[i]),
-			Address: addr,
+	if err != nil {
+		return errorJson("invalid_config", err)
+	}
+	if len(config.Keys) != len(config.Values) {
+		return errorJson("invalid_config", fmt.Errorf("%d keys but %d values", len(config.Keys), len(config.Values)))
+	}
+	if config.NodeUrl == "" && config.FixtureDir == "" && config.Bundle == "" {
+		return errorJson("invalid_config", fmt.Errorf("one of NodeUrl, FixtureDir and Bundle is needed"))
+	}
+	if config.FullBlock && config.BundleOut != "" {
+		return errorJson("invalid_config", fmt.Errorf("BundleOut is not supported with FullBlock"))
+	}
+
+	rpcConfig := oracle.DefaultRPCConfig
+	if config.Timeout > 0 {
+		rpcConfig.Timeout = time.Duration(config.Timeout) * time.Second
+	}
+	rpcConfig.RequestsPerSecond = config.RequestsPerSecond
+	if config.CacheDir != "" {
+		rpcConfig.CacheDir = config.CacheDir
+	}
+	var src oracle.NodeSource = oracle.NewRPCSourceWithConfig(config.NodeUrl, rpcConfig)
+	if config.FixtureDir != "" {
+		src = oracle.NewFileSource(config.FixtureDir)
+	}
+	if config.Bundle != "" {
+		bundle, err := oracle.ReadBundleFile(config.Bundle)
+		if err != nil {
+			return errorJson("invalid_config", err)
 		}
-		trieModifications = append(trieModifications, trieMod)
+		src = bundle.Source()
 	}
 
-	proof := witness.GetParallelProofs(config.NodeUrl, config.BlockNum, trieModifications)
+	var proof [][]byte
+	if config.FullBlock {
+		var diffs oracle.DiffSource = src.(oracle.DiffSource)
+		if config.StateDiffFile != "" {
+			diffs = oracle.StateDiffFile(config.StateDiffFile)
+		}
+		proof, _, err = witness.GetBlockProofs(src, diffs, config.BlockNum, nil)
+	} else {
+		trieModifications := []witness.TrieModification{}
+
+		addr := common.HexToAddress(config.Addr)
+		for i := 0; i < len(config.Keys); i++ {
+			trieMod := witness.TrieModification{
+				Type: witness.StorageMod,
+				Key: common.HexToHash(config.Keys[i]),
+				Value: common.HexToHash(config.Values[i]),
+				Address: addr,
+			}
+			trieModifications = append(trieModifications, trieMod)
+		}
+
+		orc := oracle.NewOracle(src)
+		proof, err = witness.GetParallelProofsWithOracle(orc, config.BlockNum, trieModifications)
+		if err == nil && config.BundleOut != "" {
+			err = orc.Bundle().WriteFile(config.BundleOut)
+		}
+	}
+	if err != nil {
+		return errorJson(witness.ErrorKind(err), err)
+	}
+
+	if config.Format == "witness" {
+		w, err := witness.WitnessFromMatrix(proof)
+		if err != nil {
+			return errorJson(witness.ErrorKind(err), err)
+		}
+		b, err := json.Marshal(w)
+		if err != nil {
+			return errorJson(witness.ErrorKind(err), err)
+		}
+		return C.CString(string(b))
+	}
 
 	return C.CString(witness.MatrixToJson(proof))
 }